@@ -0,0 +1,323 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tamasd/ratelimiter/internal/radix"
+)
+
+var (
+	// ErrInvalidInterval is returned by NewAccessListFile when the interval
+	// is not positive.
+	ErrInvalidInterval = errors.New("ratelimiter: access list file interval must be positive")
+)
+
+// AccessList is a set of CIDRs and keys.
+//
+// Access lists are used by the middleware to let requests bypass the limiter
+// (allow list), or to block them with 403 Forbidden (deny list). The CIDRs are
+// matched against the client IP, the keys against the key of the request and
+// the configured access header.
+type AccessList struct {
+	cidrs *radix.Tree
+	keys  map[string]struct{}
+}
+
+// AccessListSource provides the current version of an access list.
+type AccessListSource interface {
+	AccessList() *AccessList
+}
+
+// NewAccessList creates an empty access list.
+func NewAccessList() *AccessList {
+	return &AccessList{
+		cidrs: radix.New(),
+		keys:  make(map[string]struct{}),
+	}
+}
+
+// AccessList implements the AccessListSource interface.
+func (al *AccessList) AccessList() *AccessList {
+	return al
+}
+
+// Add adds a CIDR, an IP address or a key to the list.
+//
+// Values that cannot be parsed as a CIDR or an IP address are added as keys.
+// Add is not thread-safe, build the list before passing it to the middleware.
+func (al *AccessList) Add(value string) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		al.cidrs.Insert(prefix)
+		return
+	}
+
+	if addr, err := netip.ParseAddr(value); err == nil {
+		al.cidrs.Insert(netip.PrefixFrom(addr, addr.BitLen()))
+		return
+	}
+
+	al.keys[value] = struct{}{}
+}
+
+// ContainsIP reports whether the address is in one of the CIDRs of the list.
+func (al *AccessList) ContainsIP(addr netip.Addr) bool {
+	return al.cidrs.Contains(addr)
+}
+
+// ContainsKey reports whether the key is in the list.
+func (al *AccessList) ContainsKey(key string) bool {
+	_, ok := al.keys[key]
+	return ok
+}
+
+// Len returns the number of CIDRs and keys in the list.
+func (al *AccessList) Len() int {
+	return al.cidrs.Len() + len(al.keys)
+}
+
+type accessListJSON struct {
+	CIDRs []string `json:"cidrs"`
+	Keys  []string `json:"keys"`
+}
+
+// ParseAccessList reads an access list.
+//
+// The list is either a JSON object with "cidrs" and "keys" arrays, or a text
+// file with one CIDR, IP address or key per line. Empty lines and lines
+// starting with # are ignored in the text format. Lines that cannot be parsed
+// as a CIDR or an IP address are added as keys, see Add().
+func ParseAccessList(r io.Reader) (*AccessList, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	list := NewAccessList()
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var parsed accessListJSON
+		if err := json.Unmarshal(trimmed, &parsed); err != nil {
+			return nil, err
+		}
+		for _, cidr := range parsed.CIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, err
+			}
+			list.cidrs.Insert(prefix)
+		}
+		for _, key := range parsed.Keys {
+			list.keys[key] = struct{}{}
+		}
+
+		return list, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list.Add(line)
+	}
+
+	return list, scanner.Err()
+}
+
+// LoadAccessList reads an access list from a file.
+//
+// See ParseAccessList() for the format of the file.
+func LoadAccessList(path string) (*AccessList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseAccessList(f)
+}
+
+// AccessListFile is an access list that is reloaded when its file changes.
+//
+// The file is reloaded when its modification time changes, or when the
+// process receives a SIGHUP signal. If the new version of the file cannot be
+// loaded, the previous version stays in use.
+type AccessListFile struct {
+	path     string
+	interval time.Duration
+
+	mtx     sync.RWMutex
+	list    *AccessList
+	modTime time.Time
+	err     error
+
+	quitch chan struct{}
+}
+
+// NewAccessListFile loads an access list file.
+//
+// The interval parameter sets how often the modification time of the file is
+// checked after Start() is called, it must be positive.
+func NewAccessListFile(path string, interval time.Duration) (*AccessListFile, error) {
+	if interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+
+	alf := &AccessListFile{
+		path:     path,
+		interval: interval,
+		quitch:   make(chan struct{}),
+	}
+
+	if err := alf.Reload(); err != nil {
+		return nil, err
+	}
+
+	return alf, nil
+}
+
+// AccessList implements the AccessListSource interface.
+func (alf *AccessListFile) AccessList() *AccessList {
+	alf.mtx.RLock()
+	defer alf.mtx.RUnlock()
+
+	return alf.list
+}
+
+// Err returns the error of the last failed reload.
+func (alf *AccessListFile) Err() error {
+	alf.mtx.RLock()
+	defer alf.mtx.RUnlock()
+
+	return alf.err
+}
+
+// Reload loads the file again.
+func (alf *AccessListFile) Reload() error {
+	info, err := os.Stat(alf.path)
+	if err == nil {
+		var list *AccessList
+		if list, err = LoadAccessList(alf.path); err == nil {
+			alf.mtx.Lock()
+			alf.list = list
+			alf.modTime = info.ModTime()
+			alf.err = nil
+			alf.mtx.Unlock()
+
+			return nil
+		}
+	}
+
+	alf.mtx.Lock()
+	alf.err = err
+	alf.mtx.Unlock()
+
+	return err
+}
+
+// changed reports whether the modification time of the file changed since
+// the last reload.
+func (alf *AccessListFile) changed() bool {
+	info, err := os.Stat(alf.path)
+	if err != nil {
+		return false
+	}
+
+	alf.mtx.RLock()
+	defer alf.mtx.RUnlock()
+
+	return !info.ModTime().Equal(alf.modTime)
+}
+
+// Start watches the file for changes, until Stop() is called.
+func (alf *AccessListFile) Start() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	ticker := time.NewTicker(alf.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if alf.changed() {
+				_ = alf.Reload()
+			}
+		case <-sighup:
+			_ = alf.Reload()
+		case <-alf.quitch:
+			return
+		}
+	}
+}
+
+// Stop stops watching the file.
+func (alf *AccessListFile) Stop() {
+	close(alf.quitch)
+}
+
+// accessControl matches requests against the allow and deny lists.
+type accessControl struct {
+	allow  AccessListSource
+	deny   AccessListSource
+	header string
+}
+
+// matches reports whether the request matches the access list.
+func (ac accessControl) matches(source AccessListSource, r *http.Request, key string) bool {
+	list := source.AccessList()
+	if list == nil {
+		return false
+	}
+
+	if addr, err := netip.ParseAddr(ClientIP(r)); err == nil && list.ContainsIP(addr) {
+		return true
+	}
+	if key != "" && list.ContainsKey(key) {
+		return true
+	}
+	if ac.header != "" {
+		if value := r.Header.Get(ac.header); value != "" && list.ContainsKey(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ac accessControl) denied(r *http.Request, key string) bool {
+	return ac.deny != nil && ac.matches(ac.deny, r, key)
+}
+
+func (ac accessControl) allowed(r *http.Request, key string) bool {
+	return ac.allow != nil && ac.matches(ac.allow, r, key)
+}
@@ -0,0 +1,155 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func TestParseAccessList_Text(t *testing.T) {
+	list, err := ratelimiter.ParseAccessList(strings.NewReader(`
+# internal networks
+10.0.0.0/8
+2001:db8::/32
+192.0.2.1
+
+partner-key
+`))
+	require.NoError(t, err)
+
+	require.Equal(t, 4, list.Len())
+	require.True(t, list.ContainsIP(netip.MustParseAddr("10.20.30.40")))
+	require.True(t, list.ContainsIP(netip.MustParseAddr("2001:db8::1")))
+	require.True(t, list.ContainsIP(netip.MustParseAddr("192.0.2.1")))
+	require.False(t, list.ContainsIP(netip.MustParseAddr("192.0.2.2")))
+	require.True(t, list.ContainsKey("partner-key"))
+	require.False(t, list.ContainsKey("# internal networks"))
+}
+
+func TestParseAccessList_Keys(t *testing.T) {
+	keys := []string{"cafe.babe", "dead:beef", "deadbeef", "partner.key", "team/42", "10.0.0.0/33"}
+	list, err := ratelimiter.ParseAccessList(strings.NewReader(strings.Join(keys, "\n")))
+	require.NoError(t, err)
+
+	require.Equal(t, len(keys), list.Len())
+	for _, key := range keys {
+		require.True(t, list.ContainsKey(key), key)
+	}
+	require.False(t, list.ContainsIP(netip.MustParseAddr("10.0.0.1")))
+}
+
+func TestParseAccessList_JSON(t *testing.T) {
+	list, err := ratelimiter.ParseAccessList(strings.NewReader(`{"cidrs": ["10.0.0.0/8"], "keys": ["partner-key"]}`))
+	require.NoError(t, err)
+
+	require.True(t, list.ContainsIP(netip.MustParseAddr("10.0.0.1")))
+	require.True(t, list.ContainsKey("partner-key"))
+
+	_, err = ratelimiter.ParseAccessList(strings.NewReader(`{"cidrs": ["invalid"]}`))
+	require.Error(t, err)
+}
+
+func testAccessResponseCode(mw *ratelimiter.Middleware, remoteAddr, apiKey string) int {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remoteAddr
+	r.Header.Set("X-API-Key", apiKey)
+	mw.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+		decision, _ := ratelimiter.GetDecision(r)
+		if decision.Exempt {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return w.Result().StatusCode
+}
+
+func TestMiddleware_AccessLists(t *testing.T) {
+	allow := ratelimiter.NewAccessList()
+	allow.Add("10.0.0.0/8")
+	allow.Add("partner-key")
+	deny := ratelimiter.NewAccessList()
+	deny.Add("203.0.113.0/24")
+
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetAllowList(allow)
+	(&config).SetDenyList(deny)
+	(&config).SetAccessHeader("X-API-Key")
+	mw := ratelimiter.New(config)
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusAccepted, testAccessResponseCode(mw, "10.1.1.1:1234", ""))
+		require.Equal(t, http.StatusAccepted, testAccessResponseCode(mw, "192.0.2.1:1234", "partner-key"))
+		require.Equal(t, http.StatusForbidden, testAccessResponseCode(mw, "203.0.113.5:1234", "partner-key"))
+	}
+
+	require.Equal(t, http.StatusOK, testAccessResponseCode(mw, "192.0.2.1:1234", ""))
+	require.Equal(t, http.StatusTooManyRequests, testAccessResponseCode(mw, "192.0.2.1:1234", ""))
+}
+
+func writeAccessListFile(t *testing.T, path, content string, modTime time.Time) {
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestAccessListFile_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	writeAccessListFile(t, path, "10.0.0.0/8\n", time.Now().Add(-time.Hour))
+
+	file, err := ratelimiter.NewAccessListFile(path, time.Millisecond*10)
+	require.NoError(t, err)
+	go file.Start()
+	t.Cleanup(file.Stop)
+	require.True(t, file.AccessList().ContainsIP(netip.MustParseAddr("10.0.0.1")))
+
+	writeAccessListFile(t, path, "192.168.0.0/16\n", time.Now())
+	require.Eventually(t, func() bool {
+		return file.AccessList().ContainsIP(netip.MustParseAddr("192.168.0.1"))
+	}, time.Second, time.Millisecond*10)
+	require.False(t, file.AccessList().ContainsIP(netip.MustParseAddr("10.0.0.1")))
+}
+
+func TestAccessListFile_KeepsOldVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow.json")
+	writeAccessListFile(t, path, `{"keys": ["partner-key"]}`, time.Now())
+
+	file, err := ratelimiter.NewAccessListFile(path, time.Hour)
+	require.NoError(t, err)
+
+	writeAccessListFile(t, path, `{"keys": [`, time.Now())
+	require.Error(t, file.Reload())
+	require.Error(t, file.Err())
+	require.True(t, file.AccessList().ContainsKey("partner-key"))
+
+	_, err = ratelimiter.NewAccessListFile(filepath.Join(t.TempDir(), "missing.txt"), time.Hour)
+	require.Error(t, err)
+
+	_, err = ratelimiter.NewAccessListFile(path, 0)
+	require.Equal(t, ratelimiter.ErrInvalidInterval, err)
+}
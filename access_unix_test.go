@@ -0,0 +1,54 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package ratelimiter_test
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func TestAccessListFile_SIGHUP(t *testing.T) {
+	// Make sure that the signal does not terminate the test before the file
+	// starts listening to it.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	modTime := time.Now().Add(-time.Hour)
+	writeAccessListFile(t, path, "partner-a\n", modTime)
+
+	file, err := ratelimiter.NewAccessListFile(path, time.Hour)
+	require.NoError(t, err)
+	go file.Start()
+	t.Cleanup(file.Stop)
+
+	writeAccessListFile(t, path, "partner-b\n", modTime)
+	require.Eventually(t, func() bool {
+		_ = syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+		return file.AccessList().ContainsKey("partner-b")
+	}, time.Second, time.Millisecond*10)
+}
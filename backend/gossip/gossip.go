@@ -0,0 +1,562 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package gossip enforces approximate global limits without a central store.
+//
+// Every node counts the units of the keys in positive-negative counters
+// (PN-counters): a grow-only counter of the accepted units and one of the
+// refunded units, with an entry for each node. The nodes send their counters
+// to their peers periodically. The received counters are merged by taking the
+// maximum of each entry, so the nodes converge to the same cluster-wide
+// totals.
+//
+// A node starts with its share of the limit, the limit divided by the number
+// of nodes. It takes its share of the units that remain when the merged
+// counters show that the other nodes accepted more units, or when a peer has
+// seen every unit the node accepted since its last share. Late or duplicated
+// messages do not change the share.
+// A node that does not hear from its peers only accepts its share of the
+// limit.
+//
+// The limit is approximate: the shares are computed from the counters seen so
+// far, so when the nodes accept units while their messages are in flight, the
+// cluster can accept more than the limit. The excess is bounded by the shares
+// handed out between two gossip rounds, and a single node never accepts more
+// than the limit.
+//
+//	nodeConfig := gossip.CreateConfig("node-1", 100, time.Minute)
+//	nodeConfig.SetPeers("http://node-2:8080/gossip", "http://node-3:8080/gossip")
+//	nodeConfig.SetSecret(secret)
+//	node := gossip.New(nodeConfig)
+//	http.Handle("/gossip", node)
+//	go node.Start()
+//	defer node.Stop()
+//
+//	mw := ratelimiter.NewWithBucketFactory(ratelimiter.CreateMiddlewareConfig(100), node.Factory())
+//
+// Anyone who can send messages to a node can raise the counters of any key,
+// and lock the key out for the rest of the window. Set a shared secret to sign
+// the messages, or keep the gossip handler on a private network.
+//
+// The counters are kept for fixed windows, so the clocks of the nodes should
+// be synchronized.
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tamasd/ratelimiter/bucket"
+)
+
+// SignatureHeader carries the signature of the messages, when the nodes share
+// a secret.
+const SignatureHeader = "X-Gossip-Signature"
+
+// maxMessageSize is the maximum size of a received message.
+const maxMessageSize = 16 << 20
+
+// Config holds the configuration of the Node type.
+type Config struct {
+	id        string
+	limit     uint
+	window    time.Duration
+	peers     []string
+	interval  time.Duration
+	fanout    int
+	client    *http.Client
+	secret    []byte
+	errorFunc func(peer string, err error)
+}
+
+// CreateConfig creates a configuration for the node with the given unique id,
+// that accepts limit units per window in the whole cluster.
+//
+// By default, the node sends its counters to every peer every 100
+// milliseconds.
+func CreateConfig(id string, limit uint, window time.Duration) Config {
+	return Config{
+		id:       id,
+		limit:    limit,
+		window:   window,
+		interval: 100 * time.Millisecond,
+		client:   http.DefaultClient,
+	}
+}
+
+// SetPeers sets the URLs of the gossip handlers of the other nodes.
+func (c *Config) SetPeers(peers ...string) {
+	c.peers = peers
+}
+
+// SetInterval sets the time between two gossip rounds.
+func (c *Config) SetInterval(interval time.Duration) {
+	c.interval = interval
+}
+
+// SetFanout sets the number of randomly chosen peers that receive the counters
+// in a round. Zero means every peer.
+func (c *Config) SetFanout(fanout int) {
+	c.fanout = fanout
+}
+
+// SetClient sets the HTTP client that sends the counters.
+func (c *Config) SetClient(client *http.Client) {
+	c.client = client
+}
+
+// SetSecret sets the secret shared by the nodes of the cluster. The messages
+// are signed with HMAC-SHA256, and the messages without a valid signature are
+// rejected.
+func (c *Config) SetSecret(secret []byte) {
+	c.secret = secret
+}
+
+// SetErrorFunc sets a function that is called when the counters cannot be sent
+// to a peer.
+func (c *Config) SetErrorFunc(errorFunc func(peer string, err error)) {
+	c.errorFunc = errorFunc
+}
+
+// nodes returns the number of nodes in the cluster.
+func (c Config) nodes() uint64 {
+	return uint64(len(c.peers)) + 1
+}
+
+// Message is the payload of a gossip round.
+type Message struct {
+	// From is the id of the sender.
+	From string `json:"from"`
+
+	// Window is the start of the window of the counters, in unix
+	// nanoseconds.
+	Window int64 `json:"window"`
+
+	// Counters holds the counts of the nodes for each key.
+	Counters map[string]map[string]uint64 `json:"counters"`
+
+	// Refunds holds the refunded units of the nodes for each key.
+	Refunds map[string]map[string]uint64 `json:"refunds,omitempty"`
+}
+
+// counter is a PN-counter, and the number of units the node may count for
+// itself.
+type counter struct {
+	counts  map[string]uint64
+	refunds map[string]uint64
+	cap     uint64
+
+	// base is the count of the node when its share was computed.
+	base uint64
+}
+
+func (c *counter) total() uint64 {
+	var total, refunded uint64
+	for _, count := range c.counts {
+		total += count
+	}
+	for _, count := range c.refunds {
+		refunded += count
+	}
+	if refunded > total {
+		return 0
+	}
+
+	return total - refunded
+}
+
+// net returns the units counted by the node, without its refunds.
+func (c *counter) net(id string) uint64 {
+	return c.counts[id] - c.refunds[id]
+}
+
+// Node is a member of a gossiping cluster.
+type Node struct {
+	config Config
+	now    func() time.Time
+
+	mtx      sync.Mutex
+	window   int64
+	counters map[string]*counter
+
+	quitch chan struct{}
+	once   sync.Once
+}
+
+// New creates a Node.
+func New(config Config) *Node {
+	return &Node{
+		config:   config,
+		now:      time.Now,
+		counters: make(map[string]*counter),
+		quitch:   make(chan struct{}),
+	}
+}
+
+// InputN counts n units for the key, if the node has enough units left from
+// its share.
+func (n *Node) InputN(key string, units uint) bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.advance()
+	c := n.counter(key)
+	if c.total()+uint64(units) > uint64(n.config.limit) || c.net(n.config.id)+uint64(units) > c.cap {
+		return false
+	}
+
+	c.counts[n.config.id] += uint64(units)
+
+	return true
+}
+
+// Refund gives back units counted by the node for the key.
+//
+// The node can only give back the units it counted itself in the current
+// window.
+func (n *Node) Refund(key string, units uint) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.advance()
+	c, ok := n.counters[key]
+	if !ok {
+		return
+	}
+
+	refund := uint64(units)
+	if own := c.net(n.config.id); refund > own {
+		refund = own
+	}
+	c.refunds[n.config.id] += refund
+}
+
+// Total returns the number of units counted for the key in the cluster, as
+// observed by the node.
+func (n *Node) Total(key string) uint {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.advance()
+	if c, ok := n.counters[key]; ok {
+		return uint(c.total())
+	}
+
+	return 0
+}
+
+// Message returns the counters of the current window.
+func (n *Node) Message() Message {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.advance()
+	msg := Message{
+		From:     n.config.id,
+		Window:   n.window,
+		Counters: make(map[string]map[string]uint64, len(n.counters)),
+		Refunds:  make(map[string]map[string]uint64),
+	}
+	for key, c := range n.counters {
+		msg.Counters[key] = copyCounts(c.counts)
+		if len(c.refunds) > 0 {
+			msg.Refunds[key] = copyCounts(c.refunds)
+		}
+	}
+
+	return msg
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	copied := make(map[string]uint64, len(counts))
+	for id, count := range counts {
+		copied[id] = count
+	}
+
+	return copied
+}
+
+// Merge merges the counters of a message into the counters of the node.
+//
+// The counters of other windows are ignored.
+func (n *Node) Merge(msg Message) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.advance()
+	if msg.Window != n.window {
+		return
+	}
+
+	for key, counts := range msg.Counters {
+		c := n.counter(key)
+		refunds := msg.Refunds[key]
+		seen := c.net(n.config.id) > c.base &&
+			counts[n.config.id] >= c.counts[n.config.id] &&
+			refunds[n.config.id] >= c.refunds[n.config.id]
+		changed := merge(c.counts, counts, n.config.id)
+		if merge(c.refunds, refunds, n.config.id) {
+			changed = true
+		}
+		if changed || seen {
+			n.share(c)
+		}
+	}
+}
+
+// merge takes the maximum of the entries of the other nodes, and reports
+// whether any of them grew.
+func merge(dst, src map[string]uint64, self string) bool {
+	grown := false
+	for id, count := range src {
+		if id != self && count > dst[id] {
+			dst[id] = count
+			grown = true
+		}
+	}
+
+	return grown
+}
+
+// ServeHTTP receives the messages of the peers.
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !n.verify(body, r.Header.Get(SignatureHeader)) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n.Merge(msg)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Gossip sends the counters to the peers. It returns the first error, every
+// error is reported to the error function.
+func (n *Node) Gossip(ctx context.Context) error {
+	buf, err := json.Marshal(n.Message())
+	if err != nil {
+		return err
+	}
+
+	var first error
+	for _, peer := range n.targets() {
+		if err := n.send(ctx, peer, buf); err != nil {
+			if n.config.errorFunc != nil {
+				n.config.errorFunc(peer, err)
+			}
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
+
+// Start sends the counters to the peers periodically, until Stop() is called.
+func (n *Node) Start() {
+	ticker := time.NewTicker(n.config.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), n.config.interval)
+			_ = n.Gossip(ctx)
+			cancel()
+		case <-n.quitch:
+			return
+		}
+	}
+}
+
+// Stop stops the gossip loop.
+func (n *Node) Stop() {
+	n.once.Do(func() {
+		close(n.quitch)
+	})
+}
+
+// Factory returns a bucket factory for ratelimiter.NewWithBucketFactory().
+func (n *Node) Factory() func(key string) bucket.Bucket {
+	return func(key string) bucket.Bucket {
+		return n.Bucket(key)
+	}
+}
+
+// Bucket returns the bucket of the given key.
+func (n *Node) Bucket(key string) *Bucket {
+	return &Bucket{
+		node: n,
+		key:  key,
+	}
+}
+
+func (n *Node) send(ctx context.Context, peer string, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.config.secret != nil {
+		req.Header.Set(SignatureHeader, n.sign(buf))
+	}
+
+	resp, err := n.config.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("gossip: %s responded with %s", peer, resp.Status)
+	}
+
+	return nil
+}
+
+// sign returns the signature of a message.
+func (n *Node) sign(body []byte) string {
+	mac := hmac.New(sha256.New, n.config.secret)
+	_, _ = mac.Write(body)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature of a message, if the node has a secret.
+func (n *Node) verify(body []byte, signature string) bool {
+	if n.config.secret == nil {
+		return true
+	}
+
+	return hmac.Equal([]byte(signature), []byte(n.sign(body)))
+}
+
+// targets returns the peers of a round.
+func (n *Node) targets() []string {
+	peers := n.config.peers
+	if n.config.fanout <= 0 || n.config.fanout >= len(peers) {
+		return peers
+	}
+
+	targets := make([]string, len(peers))
+	copy(targets, peers)
+	rand.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+
+	return targets[:n.config.fanout]
+}
+
+// advance drops the counters when a new window starts. The mutex must be held.
+func (n *Node) advance() {
+	window := n.now().Truncate(n.config.window).UnixNano()
+	if window != n.window {
+		n.window = window
+		n.counters = make(map[string]*counter)
+	}
+}
+
+// counter returns the counter of the key. The mutex must be held.
+func (n *Node) counter(key string) *counter {
+	c, ok := n.counters[key]
+	if !ok {
+		c = &counter{
+			counts:  make(map[string]uint64),
+			refunds: make(map[string]uint64),
+		}
+		n.share(c)
+		n.counters[key] = c
+	}
+
+	return c
+}
+
+// share gives the node its share of the remaining units, on top of the units
+// it already counted. The mutex must be held.
+func (n *Node) share(c *counter) {
+	c.base = c.net(n.config.id)
+	c.cap = c.base
+	if total, limit := c.total(), uint64(n.config.limit); total < limit {
+		nodes := n.config.nodes()
+		c.cap += (limit - total + nodes - 1) / nodes
+	}
+}
+
+// Bucket is the bucket of a key in a gossiping cluster.
+//
+// The counters are dropped at the end of the windows, so Leak() does nothing.
+// Use Refund() to give back units.
+type Bucket struct {
+	node *Node
+	key  string
+}
+
+// Input counts one unit.
+func (b *Bucket) Input() bool {
+	return b.node.InputN(b.key, 1)
+}
+
+// InputN counts n units.
+func (b *Bucket) InputN(n uint) bool {
+	return b.node.InputN(b.key, n)
+}
+
+// Refund gives back n units counted by the node.
+func (b *Bucket) Refund(n uint) {
+	b.node.Refund(b.key, n)
+}
+
+// Persistent returns true, the counters are shared with the cluster, so they
+// are not saved in the snapshots of a single node.
+func (b *Bucket) Persistent() bool {
+	return true
+}
+
+// Leak does nothing, the counters are bound to the windows.
+func (b *Bucket) Leak() {}
+
+// Level returns the number of units counted in the cluster, and the limit.
+func (b *Bucket) Level() (level, limit uint) {
+	return b.node.Total(b.key), b.node.config.limit
+}
@@ -0,0 +1,313 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gossip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/internal/backendtest"
+)
+
+// testCluster starts nodes that gossip over loopback HTTP servers.
+func testCluster(t *testing.T, size int, limit uint, clock *backendtest.Clock, configure func(config *Config)) []*Node {
+	handlers := make([]http.Handler, size)
+	urls := make([]string, size)
+	for i := range urls {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		t.Cleanup(server.Close)
+		urls[i] = server.URL
+	}
+
+	nodes := make([]*Node, size)
+	for i := range nodes {
+		var peers []string
+		for j, url := range urls {
+			if j != i {
+				peers = append(peers, url)
+			}
+		}
+
+		config := CreateConfig(string(rune('a'+i)), limit, time.Hour)
+		config.SetPeers(peers...)
+		if configure != nil {
+			configure(&config)
+		}
+		nodes[i] = New(config)
+		nodes[i].now = clock.Now
+		handlers[i] = nodes[i]
+	}
+
+	return nodes
+}
+
+func gossip(t *testing.T, nodes []*Node) {
+	for _, node := range nodes {
+		require.NoError(t, node.Gossip(context.Background()))
+	}
+}
+
+func TestNode_Skewed(t *testing.T) {
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	nodes := testCluster(t, 3, 30, clock, nil)
+
+	// Every node can use its share before hearing from the others.
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if nodes[0].Bucket("x").Input() {
+			allowed++
+		}
+	}
+	require.Equal(t, 10, allowed)
+
+	// The share of the node grows as the others report no usage.
+	for round := 0; round < 10; round++ {
+		gossip(t, nodes)
+		for i := 0; i < 20; i++ {
+			if nodes[0].Bucket("x").Input() {
+				allowed++
+			}
+		}
+	}
+	require.Equal(t, 30, allowed)
+
+	gossip(t, nodes)
+	for _, node := range nodes {
+		level, limit := node.Bucket("x").Level()
+		require.Equal(t, uint(30), level)
+		require.Equal(t, uint(30), limit)
+		require.False(t, node.Bucket("x").Input())
+	}
+}
+
+func TestNode_Balanced(t *testing.T) {
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	nodes := testCluster(t, 4, 100, clock, nil)
+
+	allowed := 0
+	for round := 0; round < 20; round++ {
+		for _, node := range nodes {
+			for i := 0; i < 10; i++ {
+				if node.Bucket("x").Input() {
+					allowed++
+				}
+			}
+		}
+		gossip(t, nodes)
+	}
+
+	require.LessOrEqual(t, allowed, 100+len(nodes)-1)
+	require.GreaterOrEqual(t, allowed, 100)
+	require.Equal(t, uint(allowed), nodes[0].Total("x"))
+}
+
+func spend(nodes []*Node, key string, attempts int) int {
+	allowed := 0
+	for _, node := range nodes {
+		for i := 0; i < attempts; i++ {
+			if node.Bucket(key).Input() {
+				allowed++
+			}
+		}
+	}
+
+	return allowed
+}
+
+func TestNode_Refund(t *testing.T) {
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	nodes := testCluster(t, 2, 10, clock, nil)
+	b := nodes[0].Bucket("x")
+
+	require.Equal(t, 5, spend(nodes[:1], "x", 10))
+	b.Refund(2)
+	require.Equal(t, uint(3), nodes[0].Total("x"))
+	require.Equal(t, 2, spend(nodes[:1], "x", 10))
+
+	// The refunds are gossiped, and a node cannot give back more than it
+	// counted.
+	nodes[1].Bucket("x").Refund(5)
+	gossip(t, nodes)
+	require.Equal(t, uint(5), nodes[1].Total("x"))
+	require.Equal(t, 3, spend(nodes[1:], "x", 10))
+	require.Equal(t, uint(8), nodes[1].Total("x"))
+
+	require.True(t, b.Persistent())
+}
+
+func TestNode_LateMessages(t *testing.T) {
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	nodes := testCluster(t, 3, 90, clock, nil)
+
+	allowed := spend(nodes, "x", 5)
+	gossip(t, nodes)
+	stale := make([]Message, len(nodes))
+	for i, node := range nodes {
+		stale[i] = node.Message()
+	}
+
+	allowed += spend(nodes, "x", 100)
+	require.Equal(t, 90, allowed)
+
+	// The messages sent before the units were accepted arrive late, and
+	// more than once.
+	for round := 0; round < 3; round++ {
+		for i, node := range nodes {
+			for j, msg := range stale {
+				if i != j {
+					node.Merge(msg)
+				}
+			}
+		}
+		allowed += spend(nodes, "x", 100)
+	}
+	require.Equal(t, 90, allowed)
+}
+
+func TestNode_CrossingMessages(t *testing.T) {
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	nodes := testCluster(t, 3, 90, clock, nil)
+
+	allowed := 0
+	for round := 0; round < 5; round++ {
+		allowed += spend(nodes, "x", 20)
+
+		// Every node sends its counters at the same time.
+		msgs := make([]Message, len(nodes))
+		for i, node := range nodes {
+			msgs[i] = node.Message()
+		}
+		for i, node := range nodes {
+			for j, msg := range msgs {
+				if i != j {
+					node.Merge(msg)
+				}
+			}
+		}
+	}
+
+	require.Equal(t, 90, allowed)
+	for _, node := range nodes {
+		require.Equal(t, uint(90), node.Total("x"))
+	}
+}
+
+func TestNode_Secret(t *testing.T) {
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	nodes := testCluster(t, 2, 10, clock, func(config *Config) {
+		config.SetSecret([]byte("secret"))
+	})
+
+	require.True(t, nodes[0].Bucket("x").InputN(3))
+	gossip(t, nodes)
+	require.Equal(t, uint(3), nodes[1].Total("x"))
+
+	forged := New(CreateConfig("c", 10, time.Hour))
+	forged.now = clock.Now
+	require.True(t, forged.Bucket("x").InputN(5))
+	forged.config.SetPeers(nodes[0].config.peers...)
+	require.Error(t, forged.Gossip(context.Background()))
+	require.Equal(t, uint(3), nodes[1].Total("x"))
+}
+
+func TestNode_Window(t *testing.T) {
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	nodes := testCluster(t, 2, 2, clock, nil)
+
+	require.True(t, nodes[0].Bucket("x").Input())
+	require.False(t, nodes[0].Bucket("x").Input())
+	msg := nodes[0].Message()
+
+	clock.Add(time.Hour)
+	require.Zero(t, nodes[0].Total("x"))
+	require.True(t, nodes[0].Bucket("x").Input())
+
+	// The counters of old windows are ignored.
+	nodes[1].Merge(msg)
+	require.Zero(t, nodes[1].Total("x"))
+}
+
+func TestNode_Unreachable(t *testing.T) {
+	var peers []string
+	config := CreateConfig("a", 10, time.Minute)
+	config.SetPeers("http://127.0.0.1:1/gossip")
+	config.SetErrorFunc(func(peer string, err error) {
+		peers = append(peers, peer)
+	})
+	node := New(config)
+
+	require.Error(t, node.Gossip(context.Background()))
+	require.Equal(t, []string{"http://127.0.0.1:1/gossip"}, peers)
+
+	// Without the peers, the node only uses its share.
+	require.True(t, node.Bucket("x").InputN(5))
+	require.False(t, node.Bucket("x").Input())
+}
+
+func TestNode_ServeHTTP(t *testing.T) {
+	node := New(CreateConfig("a", 10, time.Minute))
+
+	w := httptest.NewRecorder()
+	node.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	node.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{")))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestNode_Start(t *testing.T) {
+	clock := backendtest.NewClock(time.Now())
+	nodes := testCluster(t, 3, 9, clock, func(config *Config) {
+		config.SetInterval(10 * time.Millisecond)
+		config.SetFanout(1)
+	})
+	for _, node := range nodes {
+		go node.Start()
+		defer node.Stop()
+	}
+
+	require.True(t, nodes[0].Bucket("x").InputN(3))
+	require.Eventually(t, func() bool {
+		return nodes[1].Total("x") == 3 && nodes[2].Total("x") == 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMiddleware_Gossip(t *testing.T) {
+	node := New(CreateConfig("a", 1, time.Minute))
+	mw := ratelimiter.NewWithBucketFactory(ratelimiter.CreateMiddlewareConfig(1), node.Factory())
+
+	code := func() int {
+		w := httptest.NewRecorder()
+		mw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		return w.Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, code())
+	require.Equal(t, http.StatusTooManyRequests, code())
+}
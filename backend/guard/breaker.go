@@ -0,0 +1,173 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guard
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+	// Closed breakers let the inputs through to the backend.
+	Closed State = iota
+
+	// Open breakers keep the inputs from the backend.
+	Open
+
+	// HalfOpen breakers let a single input through to probe the backend.
+	HalfOpen
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// breaker is a consecutive failure circuit breaker.
+//
+// Every state change starts a new generation. The inputs are tagged with the
+// generation they started in, and the results of the inputs of the previous
+// generations are ignored, so a late result cannot close an open breaker, or
+// interfere with the probe of a half-open one.
+type breaker struct {
+	threshold uint
+	cooldown  time.Duration
+	now       func() time.Time
+	changed   func(state State)
+
+	mtx      sync.Mutex
+	current  State
+	failures uint
+	openedAt time.Time
+	probing  bool
+	gen      uint64
+}
+
+// allow reports whether an input can be sent to the backend, and returns the
+// generation of the input.
+func (b *breaker) allow() (uint64, bool) {
+	if b.threshold == 0 {
+		return 0, true
+	}
+
+	var changes []State
+	defer b.notify(&changes)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch b.current {
+	case Open:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return b.gen, false
+		}
+		changes = b.set(changes, HalfOpen)
+		fallthrough
+	case HalfOpen:
+		if b.probing {
+			return b.gen, false
+		}
+		b.probing = true
+	}
+
+	return b.gen, true
+}
+
+// success records a successful input of the given generation.
+func (b *breaker) success(gen uint64) {
+	if b.threshold == 0 {
+		return
+	}
+
+	var changes []State
+	defer b.notify(&changes)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if gen != b.gen {
+		return
+	}
+
+	b.failures = 0
+	b.probing = false
+	if b.current != Closed {
+		changes = b.set(changes, Closed)
+	}
+}
+
+// failure records a failed input of the given generation.
+func (b *breaker) failure(gen uint64) {
+	if b.threshold == 0 {
+		return
+	}
+
+	var changes []State
+	defer b.notify(&changes)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if gen != b.gen {
+		return
+	}
+
+	b.failures++
+	b.probing = false
+	if b.current == HalfOpen || (b.current == Closed && b.failures >= b.threshold) {
+		b.openedAt = b.now()
+		changes = b.set(changes, Open)
+	}
+}
+
+func (b *breaker) state() State {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.current
+}
+
+// set changes the state, and records the change. The mutex must be held.
+func (b *breaker) set(changes []State, state State) []State {
+	b.current = state
+	b.gen++
+	return append(changes, state)
+}
+
+// notify reports the state changes. It is called after the mutex is released.
+func (b *breaker) notify(changes *[]State) {
+	if b.changed == nil {
+		return
+	}
+	for _, state := range *changes {
+		b.changed(state)
+	}
+}
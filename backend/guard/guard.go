@@ -0,0 +1,410 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package guard protects the middleware from slow or unavailable bucket
+// backends.
+//
+// A Guard wraps the buckets of a remote backend. Every input gets a timeout,
+// and a circuit breaker stops calling the backend after consecutive failures.
+// While the backend is failing, the inputs are handled by a failure policy:
+// they are allowed, denied, or counted in local leaky buckets with a smaller
+// limit:
+//
+//	guardConfig := guard.CreateConfig(50 * time.Millisecond)
+//	guardConfig.SetFallback(20, time.Second) // a fifth of the limit, for 5 replicas
+//	g := guard.New(guardConfig)
+//	expvar.Publish("ratelimiter_backend", g)
+//
+//	mw := ratelimiter.NewWithBucketFactory(ratelimiter.CreateMiddlewareConfig(100), g.Factory(func(key string) guard.Backend {
+//		return backend.Bucket(key)
+//	}))
+//
+// The buckets of the redis, memcache and sqldb packages implement the Backend
+// interface, and their refunds are guarded as well.
+package guard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tamasd/ratelimiter/bucket"
+	"github.com/tamasd/ratelimiter/internal/remote"
+)
+
+// ErrOpen is reported when the input is not sent to the backend, because the
+// circuit breaker is open.
+var ErrOpen = errors.New("guard: circuit breaker is open")
+
+// Backend is a bucket that can be filled with a context.
+type Backend interface {
+	bucket.Bucket
+	InputContext(ctx context.Context, n uint) (bool, error)
+}
+
+// refunder is implemented by the backends that can give back units with a
+// context.
+type refunder interface {
+	RefundContext(ctx context.Context, n uint) error
+}
+
+// Policy decides the outcome of the inputs that failed.
+type Policy int
+
+const (
+	// Allow accepts the inputs while the backend is failing.
+	Allow Policy = iota
+
+	// Deny rejects the inputs while the backend is failing.
+	Deny
+
+	// Fallback counts the inputs in local leaky buckets while the backend is
+	// failing.
+	Fallback
+)
+
+// Config holds the configuration of the Guard type.
+type Config struct {
+	timeout        time.Duration
+	policy         Policy
+	threshold      uint
+	cooldown       time.Duration
+	fallbackLimit  uint
+	fallbackWindow time.Duration
+	errorFunc      remote.ErrorFunc
+	stateFunc      func(state State)
+}
+
+// CreateConfig creates a configuration with the given timeout for the inputs.
+//
+// By default, the failed inputs are allowed, and the circuit breaker opens
+// after 5 consecutive failures for 10 seconds.
+func CreateConfig(timeout time.Duration) Config {
+	return Config{
+		timeout:   timeout,
+		policy:    Allow,
+		threshold: 5,
+		cooldown:  10 * time.Second,
+	}
+}
+
+// SetPolicy sets the failure policy.
+func (c *Config) SetPolicy(policy Policy) {
+	c.policy = policy
+}
+
+// SetFallback sets the Fallback policy, with local buckets that accept limit
+// units per window.
+//
+// The local buckets only see the traffic of one instance, so the limit should
+// be the share of the instance from the global limit.
+func (c *Config) SetFallback(limit uint, window time.Duration) {
+	c.policy = Fallback
+	c.fallbackLimit = limit
+	c.fallbackWindow = window
+}
+
+// SetBreaker configures the circuit breaker.
+//
+// The breaker opens after threshold consecutive failures, and stays open for
+// the cooldown period. After the cooldown, a single input is sent to the
+// backend; the breaker closes if it succeeds, and opens again if it fails.
+// Zero threshold disables the breaker.
+func (c *Config) SetBreaker(threshold uint, cooldown time.Duration) {
+	c.threshold = threshold
+	c.cooldown = cooldown
+}
+
+// SetErrorFunc sets a function that is called with the failures of the
+// inputs.
+func (c *Config) SetErrorFunc(errorFunc func(key string, err error)) {
+	c.errorFunc = errorFunc
+}
+
+// SetStateFunc sets a function that is called when the state of the circuit
+// breaker changes.
+func (c *Config) SetStateFunc(stateFunc func(state State)) {
+	c.stateFunc = stateFunc
+}
+
+// Stats holds the counters of a Guard.
+type Stats struct {
+	// Calls is the number of inputs sent to the backend.
+	Calls uint64 `json:"calls"`
+
+	// Errors is the number of inputs that failed, including the timeouts.
+	Errors uint64 `json:"errors"`
+
+	// Timeouts is the number of inputs that timed out.
+	Timeouts uint64 `json:"timeouts"`
+
+	// ShortCircuits is the number of inputs that were not sent to the
+	// backend, because the breaker was open.
+	ShortCircuits uint64 `json:"short_circuits"`
+
+	// Trips is the number of times the breaker opened.
+	Trips uint64 `json:"trips"`
+
+	// Allowed and Denied count the outcomes of the failure policy.
+	Allowed uint64 `json:"allowed"`
+	Denied  uint64 `json:"denied"`
+
+	// State is the current state of the breaker.
+	State State `json:"state"`
+}
+
+// Guard wraps the buckets of a backend with timeouts, a shared circuit
+// breaker and a failure policy.
+type Guard struct {
+	config  Config
+	breaker breaker
+
+	calls         uint64
+	errors        uint64
+	timeouts      uint64
+	shortCircuits uint64
+	trips         uint64
+	allowed       uint64
+	denied        uint64
+}
+
+// New creates a Guard.
+func New(config Config) *Guard {
+	g := &Guard{
+		config: config,
+	}
+	g.breaker = breaker{
+		threshold: config.threshold,
+		cooldown:  config.cooldown,
+		now:       time.Now,
+		changed:   g.changed,
+	}
+
+	return g
+}
+
+// Wrap wraps a bucket of the backend.
+func (g *Guard) Wrap(key string, b Backend) *Bucket {
+	return &Bucket{
+		guard:   g,
+		key:     key,
+		backend: b,
+	}
+}
+
+// Factory wraps a bucket factory of the backend, for
+// ratelimiter.NewWithBucketFactory().
+func (g *Guard) Factory(factory func(key string) Backend) func(key string) bucket.Bucket {
+	return func(key string) bucket.Bucket {
+		return g.Wrap(key, factory(key))
+	}
+}
+
+// State returns the state of the circuit breaker.
+func (g *Guard) State() State {
+	return g.breaker.state()
+}
+
+// Stats returns the counters of the guard.
+func (g *Guard) Stats() Stats {
+	return Stats{
+		Calls:         atomic.LoadUint64(&g.calls),
+		Errors:        atomic.LoadUint64(&g.errors),
+		Timeouts:      atomic.LoadUint64(&g.timeouts),
+		ShortCircuits: atomic.LoadUint64(&g.shortCircuits),
+		Trips:         atomic.LoadUint64(&g.trips),
+		Allowed:       atomic.LoadUint64(&g.allowed),
+		Denied:        atomic.LoadUint64(&g.denied),
+		State:         g.State(),
+	}
+}
+
+// String returns the stats as JSON, so the guard can be published with the
+// expvar package.
+func (g *Guard) String() string {
+	buf, _ := json.Marshal(g.Stats())
+	return string(buf)
+}
+
+// input sends the input to the backend, unless the breaker is open.
+func (g *Guard) input(key string, b Backend, n uint) (bool, error) {
+	var allowed bool
+	err := g.call(key, func(ctx context.Context) (err error) {
+		allowed, err = b.InputContext(ctx, n)
+		return err
+	})
+
+	return allowed, err
+}
+
+// call calls the backend with a timeout, unless the breaker is open, and
+// records the outcome in the breaker.
+//
+// While the breaker is half-open, the call is the probe, or it is not made.
+func (g *Guard) call(key string, f func(ctx context.Context) error) error {
+	gen, ok := g.breaker.allow()
+	if !ok {
+		atomic.AddUint64(&g.shortCircuits, 1)
+		return ErrOpen
+	}
+
+	ctx, cancel := remote.Context(g.config.timeout)
+	defer cancel()
+
+	atomic.AddUint64(&g.calls, 1)
+	if err := f(ctx); err != nil {
+		atomic.AddUint64(&g.errors, 1)
+		if errors.Is(err, context.DeadlineExceeded) {
+			atomic.AddUint64(&g.timeouts, 1)
+		}
+		g.breaker.failure(gen)
+		g.config.errorFunc.Report(key, err)
+		return err
+	}
+
+	g.breaker.success(gen)
+
+	return nil
+}
+
+// outcome records the outcome of the failure policy.
+func (g *Guard) outcome(allowed bool) bool {
+	if allowed {
+		atomic.AddUint64(&g.allowed, 1)
+	} else {
+		atomic.AddUint64(&g.denied, 1)
+	}
+
+	return allowed
+}
+
+func (g *Guard) changed(state State) {
+	if state == Open {
+		atomic.AddUint64(&g.trips, 1)
+	}
+	if g.config.stateFunc != nil {
+		g.config.stateFunc(state)
+	}
+}
+
+// Bucket is a backend bucket wrapped by a Guard.
+type Bucket struct {
+	guard   *Guard
+	key     string
+	backend Backend
+
+	once     sync.Once
+	fallback *bucket.Timed
+}
+
+// Input fills the bucket with one unit.
+func (b *Bucket) Input() bool {
+	return b.InputN(1)
+}
+
+// InputN fills the bucket with n units.
+//
+// If the backend fails, or the breaker is open, the input is handled by the
+// failure policy.
+func (b *Bucket) InputN(n uint) bool {
+	allowed, err := b.guard.input(b.key, b.backend, n)
+	if err == nil {
+		return allowed
+	}
+
+	switch b.guard.config.policy {
+	case Deny:
+		return b.guard.outcome(false)
+	case Fallback:
+		return b.guard.outcome(bucket.InputN(b.local(), n))
+	default:
+		return b.guard.outcome(true)
+	}
+}
+
+// Refund gives back n units.
+//
+// Backends implementing RefundContext(ctx context.Context, n uint) error are
+// called the same way as the inputs: with the timeout, and through the
+// breaker. If the refund is not sent to the backend or fails, the units are
+// given back to the local bucket of the Fallback policy.
+func (b *Bucket) Refund(n uint) {
+	var err error
+	switch r := b.backend.(type) {
+	case refunder:
+		err = b.guard.call(b.key, func(ctx context.Context) error {
+			return r.RefundContext(ctx, n)
+		})
+	case interface{ Refund(n uint) }:
+		if b.guard.State() == Open {
+			err = ErrOpen
+		} else {
+			r.Refund(n)
+		}
+	}
+
+	if err != nil && b.guard.config.policy == Fallback {
+		b.local().Refund(n)
+	}
+}
+
+// Persistent returns true, if the backend bucket keeps its state outside of
+// the process.
+func (b *Bucket) Persistent() bool {
+	p, ok := b.backend.(bucket.Persistent)
+	return ok && p.Persistent()
+}
+
+// Leak leaks the backend bucket.
+//
+// The local bucket leaks based on the time.
+func (b *Bucket) Leak() {
+	b.backend.Leak()
+}
+
+// Level returns the level of the backend bucket, or the level of the local
+// bucket, if it is relatively fuller.
+func (b *Bucket) Level() (level, limit uint) {
+	if m, ok := b.backend.(bucket.Meter); ok {
+		level, limit = m.Level()
+	}
+
+	if b.guard.config.policy == Fallback {
+		local, localLimit := b.local().Level()
+		if limit == 0 || local*limit > level*localLimit {
+			level, limit = local, localLimit
+		}
+	}
+
+	return level, limit
+}
+
+// local returns the fallback bucket.
+func (b *Bucket) local() *bucket.Timed {
+	b.once.Do(func() {
+		config := b.guard.config
+		interval := config.fallbackWindow
+		if config.fallbackLimit > 0 {
+			interval /= time.Duration(config.fallbackLimit)
+		}
+		b.fallback = bucket.NewTimed(bucket.NewLeaky(config.fallbackLimit), interval)
+	})
+
+	return b.fallback
+}
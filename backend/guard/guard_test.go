@@ -0,0 +1,335 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/bucket"
+	"github.com/tamasd/ratelimiter/internal/backendtest"
+)
+
+var errBackend = errors.New("backend error")
+
+// fakeBackend is a backend bucket that can be made to fail or hang.
+type fakeBackend struct {
+	mtx      sync.Mutex
+	bucket   *bucket.Leaky
+	err      error
+	hang     bool
+	calls    int
+	refunded uint
+}
+
+func newFakeBackend(limit uint) *fakeBackend {
+	return &fakeBackend{bucket: bucket.NewLeaky(limit)}
+}
+
+func (f *fakeBackend) Input() bool {
+	return f.InputN(1)
+}
+
+func (f *fakeBackend) InputN(n uint) bool {
+	allowed, _ := f.InputContext(context.Background(), n)
+	return allowed
+}
+
+func (f *fakeBackend) InputContext(ctx context.Context, n uint) (bool, error) {
+	f.mtx.Lock()
+	f.calls++
+	err, hang := f.err, f.hang
+	f.mtx.Unlock()
+
+	if hang {
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.bucket.InputN(n), nil
+}
+
+func (f *fakeBackend) Refund(n uint) {
+	_ = f.RefundContext(context.Background(), n)
+}
+
+func (f *fakeBackend) RefundContext(ctx context.Context, n uint) error {
+	f.mtx.Lock()
+	f.calls++
+	err, hang := f.err, f.hang
+	f.mtx.Unlock()
+
+	if hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.refunded += n
+	return nil
+}
+
+func (f *fakeBackend) Leak() {}
+
+func (f *fakeBackend) Level() (level, limit uint) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.bucket.Level()
+}
+
+func (f *fakeBackend) fail(err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.err = err
+}
+
+func testGuard(config Config) (*Guard, *backendtest.Clock) {
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	g := New(config)
+	g.breaker.now = clock.Now
+
+	return g, clock
+}
+
+func TestBucket_Success(t *testing.T) {
+	g, _ := testGuard(CreateConfig(time.Second))
+	backend := newFakeBackend(2)
+	b := g.Wrap("a", backend)
+
+	require.True(t, b.Input())
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+	level, limit := b.Level()
+	require.Equal(t, uint(2), level)
+	require.Equal(t, uint(2), limit)
+
+	b.Refund(1)
+	require.Equal(t, uint(1), backend.refunded)
+	require.Equal(t, Stats{Calls: 4, State: Closed}, g.Stats())
+}
+
+func TestBucket_Timeout(t *testing.T) {
+	var errs []error
+	config := CreateConfig(10 * time.Millisecond)
+	config.SetPolicy(Deny)
+	config.SetErrorFunc(func(key string, err error) {
+		errs = append(errs, err)
+	})
+	g, _ := testGuard(config)
+	backend := newFakeBackend(2)
+	backend.hang = true
+
+	start := time.Now()
+	require.False(t, g.Wrap("a", backend).Input())
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+	require.Equal(t, []error{context.DeadlineExceeded}, errs)
+
+	stats := g.Stats()
+	require.Equal(t, uint64(1), stats.Errors)
+	require.Equal(t, uint64(1), stats.Timeouts)
+	require.Equal(t, uint64(1), stats.Denied)
+}
+
+func TestBucket_RefundTimeout(t *testing.T) {
+	config := CreateConfig(10 * time.Millisecond)
+	config.SetBreaker(1, 10*time.Second)
+	g, clock := testGuard(config)
+	backend := newFakeBackend(2)
+	b := g.Wrap("a", backend)
+	require.True(t, b.Input())
+
+	backend.hang = true
+	start := time.Now()
+	b.Refund(1)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+	require.Equal(t, Open, g.State())
+	require.Equal(t, uint64(1), g.Stats().Timeouts)
+
+	// The refunds are not sent while the breaker is open.
+	b.Refund(1)
+	require.Equal(t, 2, backend.calls)
+
+	// A refund is a probe like any other call.
+	backend.hang = false
+	clock.Add(10 * time.Second)
+	b.Refund(1)
+	require.Equal(t, Closed, g.State())
+	require.Equal(t, uint(1), backend.refunded)
+}
+
+func TestBucket_Breaker(t *testing.T) {
+	var states []State
+	config := CreateConfig(time.Second)
+	config.SetBreaker(3, 10*time.Second)
+	config.SetStateFunc(func(state State) {
+		states = append(states, state)
+	})
+	g, clock := testGuard(config)
+	backend := newFakeBackend(100)
+	backend.fail(errBackend)
+	b := g.Wrap("a", backend)
+
+	for i := 0; i < 5; i++ {
+		require.True(t, b.Input())
+	}
+	require.Equal(t, 3, backend.calls)
+	require.Equal(t, Open, g.State())
+
+	// A failed probe opens the breaker again.
+	clock.Add(10 * time.Second)
+	require.True(t, b.Input())
+	require.Equal(t, 4, backend.calls)
+	require.Equal(t, Open, g.State())
+
+	// A successful probe closes it.
+	backend.fail(nil)
+	clock.Add(10 * time.Second)
+	require.True(t, b.Input())
+	require.Equal(t, Closed, g.State())
+	require.Equal(t, []State{Open, HalfOpen, Open, HalfOpen, Closed}, states)
+
+	require.Equal(t, Stats{
+		Calls:         5,
+		Errors:        4,
+		ShortCircuits: 2,
+		Trips:         2,
+		Allowed:       6,
+		State:         Closed,
+	}, g.Stats())
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	g, clock := testGuard(CreateConfig(time.Second))
+	g.breaker.threshold = 1
+	gen, ok := g.breaker.allow()
+	require.True(t, ok)
+	g.breaker.failure(gen)
+	require.Equal(t, Open, g.State())
+
+	clock.Add(g.config.cooldown)
+	_, ok = g.breaker.allow()
+	require.True(t, ok)
+	require.Equal(t, HalfOpen, g.State())
+	_, ok = g.breaker.allow()
+	require.False(t, ok, "only one probe is sent")
+}
+
+func TestBreaker_StaleResults(t *testing.T) {
+	g, clock := testGuard(CreateConfig(time.Second))
+	g.breaker.threshold = 1
+	stale, _ := g.breaker.allow()
+	gen, _ := g.breaker.allow()
+	g.breaker.failure(gen)
+	require.Equal(t, Open, g.State())
+
+	// A call that started before the breaker opened does not close it.
+	g.breaker.success(stale)
+	require.Equal(t, Open, g.State())
+
+	// Nor does it interfere with the probe.
+	clock.Add(g.config.cooldown)
+	probe, ok := g.breaker.allow()
+	require.True(t, ok)
+	g.breaker.failure(stale)
+	require.Equal(t, HalfOpen, g.State())
+	_, ok = g.breaker.allow()
+	require.False(t, ok)
+
+	g.breaker.success(probe)
+	require.Equal(t, Closed, g.State())
+}
+
+func TestBucket_Fallback(t *testing.T) {
+	config := CreateConfig(time.Second)
+	config.SetFallback(2, time.Hour)
+	g, _ := testGuard(config)
+	backend := newFakeBackend(10)
+	backend.fail(errBackend)
+	b := g.Wrap("a", backend)
+
+	require.True(t, b.Input())
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+	level, limit := b.Level()
+	require.Equal(t, uint(2), level)
+	require.Equal(t, uint(2), limit)
+
+	// The refund fails on the backend as well, so it goes to the local bucket.
+	b.Refund(1)
+	require.Zero(t, backend.refunded)
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+
+	for i := 0; i < 5; i++ {
+		b.Input()
+	}
+	require.Equal(t, Open, g.State())
+	b.Refund(1)
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+
+	// Other keys have their own local buckets.
+	require.True(t, g.Wrap("b", backend).Input())
+
+	stats := g.Stats()
+	require.Equal(t, uint64(5), stats.Allowed)
+	require.Equal(t, uint64(8), stats.Denied)
+}
+
+func TestGuard_String(t *testing.T) {
+	g, _ := testGuard(CreateConfig(time.Second))
+	require.True(t, g.Wrap("a", newFakeBackend(1)).Input())
+
+	var stats map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(g.String()), &stats))
+	require.Equal(t, float64(1), stats["calls"])
+	require.Equal(t, "closed", stats["state"])
+}
+
+func TestMiddleware_Guard(t *testing.T) {
+	config := CreateConfig(time.Second)
+	config.SetPolicy(Deny)
+	g := New(config)
+	backend := newFakeBackend(1)
+	backend.fail(errBackend)
+	mw := ratelimiter.NewWithBucketFactory(ratelimiter.CreateMiddlewareConfig(1), g.Factory(func(key string) Backend {
+		return backend
+	}))
+
+	w := httptest.NewRecorder()
+	mw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	require.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+}
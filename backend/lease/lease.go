@@ -0,0 +1,485 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package lease serves the units of a remote backend from local leases.
+//
+// Instead of sending every input to the backend, a Leaser takes batches of
+// units from the backend bucket, and serves the inputs from them locally.
+// The size of the batches follows the request rate of the key, so busy keys
+// need a round trip every lease period, and quiet keys take a unit at a time:
+//
+//	leaser := lease.New(lease.CreateConfig(time.Second / 100))
+//	go leaser.Start()
+//	defer leaser.Stop()
+//
+//	mw := ratelimiter.NewWithBucketFactory(ratelimiter.CreateMiddlewareConfig(100), leaser.Factory(func(key string) lease.Backend {
+//		return backend.Bucket(key)
+//	}))
+//
+// The leased units count against the limit in the backend, even if they are
+// not used. The units that are not used in time are given back, and Stop()
+// gives back every leased unit that is still in the backend.
+//
+// Backends that leak, or count in windows, free the leased units over time.
+// A unit that is freed in the backend cannot be used from the lease anymore,
+// because the backend would accept another unit in its place, and it is not
+// given back, because the backend would subtract it from the units of the
+// other instances. The leaser assumes that the units of a lease are freed
+// first, one every leak interval.
+package lease
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tamasd/ratelimiter/bucket"
+)
+
+// Backend is a backend bucket that units can be leased from.
+//
+// The buckets of the redis, memcache, sqldb and guard packages implement this
+// interface.
+type Backend interface {
+	bucket.Bucket
+	InputN(n uint) bool
+	Refund(n uint)
+}
+
+// rateWindow is the time constant of the request rate estimation.
+const rateWindow = time.Second
+
+// Config holds the configuration of the Leaser type.
+type Config struct {
+	interval time.Duration
+	period   time.Duration
+	ttl      time.Duration
+	minBatch uint
+	maxBatch uint
+}
+
+// CreateConfig creates a configuration for a backend that frees a unit every
+// interval, e.g. the window divided by the limit. Zero interval means that
+// the units stay in the backend until they are given back.
+//
+// By default, a lease is sized to last 100 milliseconds, between 1 and 100
+// units, and the units that are not used for a second are given back.
+func CreateConfig(interval time.Duration) Config {
+	return Config{
+		interval: interval,
+		period:   100 * time.Millisecond,
+		ttl:      time.Second,
+		minBatch: 1,
+		maxBatch: 100,
+	}
+}
+
+// SetPeriod sets how long a lease should last at the observed request rate.
+//
+// Longer periods mean less round trips, and a less accurate global limit.
+func (c *Config) SetPeriod(period time.Duration) {
+	c.period = period
+}
+
+// SetTTL sets how long the leased units can stay unused, before they are
+// given back to the backend.
+func (c *Config) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// SetBatch sets the minimum and the maximum size of a lease.
+func (c *Config) SetBatch(min, max uint) {
+	if min == 0 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	c.minBatch = min
+	c.maxBatch = max
+}
+
+// Stats holds the counters of a Leaser.
+type Stats struct {
+	// Inputs is the number of inputs of the buckets.
+	Inputs uint64 `json:"inputs"`
+
+	// Leases is the number of successful leases, and Leased is the number
+	// of units leased.
+	Leases uint64 `json:"leases"`
+	Leased uint64 `json:"leased"`
+
+	// Rejections is the number of leases rejected by the backend.
+	Rejections uint64 `json:"rejections"`
+
+	// Returned is the number of unused units given back to the backend.
+	Returned uint64 `json:"returned"`
+
+	// Expired is the number of unused units that were freed by the backend.
+	Expired uint64 `json:"expired"`
+}
+
+// Leaser leases units from backend buckets.
+type Leaser struct {
+	config Config
+	now    func() time.Time
+
+	mtx     sync.Mutex
+	buckets map[string]*Bucket
+
+	quitch chan struct{}
+	once   sync.Once
+
+	inputs     uint64
+	leases     uint64
+	leased     uint64
+	rejections uint64
+	returned   uint64
+	expired    uint64
+}
+
+// New creates a Leaser.
+func New(config Config) *Leaser {
+	return &Leaser{
+		config:  config,
+		now:     time.Now,
+		buckets: make(map[string]*Bucket),
+		quitch:  make(chan struct{}),
+	}
+}
+
+// Bucket returns the leasing bucket of the key.
+//
+// The leaser keeps track of the buckets with unused units, so the same bucket
+// is returned for a key, until its units are given back.
+func (l *Leaser) Bucket(key string, backend Backend) *Bucket {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if b, ok := l.buckets[key]; ok {
+		return b
+	}
+
+	b := &Bucket{
+		leaser:  l,
+		key:     key,
+		backend: backend,
+		last:    l.now(),
+	}
+	l.buckets[key] = b
+
+	return b
+}
+
+// Factory wraps a bucket factory of the backend, for
+// ratelimiter.NewWithBucketFactory().
+func (l *Leaser) Factory(factory func(key string) Backend) func(key string) bucket.Bucket {
+	return func(key string) bucket.Bucket {
+		l.mtx.Lock()
+		b, ok := l.buckets[key]
+		l.mtx.Unlock()
+		if ok {
+			return b
+		}
+
+		return l.Bucket(key, factory(key))
+	}
+}
+
+// Start gives back the expired leases periodically, until Stop() is called.
+func (l *Leaser) Start() {
+	interval := l.config.ttl / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.Expire()
+		case <-l.quitch:
+			return
+		}
+	}
+}
+
+// Stop stops the expiration loop, and gives back every leased unit.
+func (l *Leaser) Stop() {
+	l.once.Do(func() {
+		close(l.quitch)
+	})
+
+	l.sweep(func(b *Bucket, now time.Time) bool {
+		return true
+	})
+}
+
+// Expire gives back the units of the leases that were not used for the TTL,
+// and forgets the idle buckets.
+func (l *Leaser) Expire() {
+	l.sweep(func(b *Bucket, now time.Time) bool {
+		return now.Sub(b.last) >= l.config.ttl
+	})
+}
+
+// Stats returns the counters of the leaser.
+func (l *Leaser) Stats() Stats {
+	return Stats{
+		Inputs:     atomic.LoadUint64(&l.inputs),
+		Leases:     atomic.LoadUint64(&l.leases),
+		Leased:     atomic.LoadUint64(&l.leased),
+		Rejections: atomic.LoadUint64(&l.rejections),
+		Returned:   atomic.LoadUint64(&l.returned),
+		Expired:    atomic.LoadUint64(&l.expired),
+	}
+}
+
+// sweep gives back the units of the matching buckets, and forgets them.
+func (l *Leaser) sweep(match func(b *Bucket, now time.Time) bool) {
+	now := l.now()
+
+	l.mtx.Lock()
+	var expired []*Bucket
+	for key, b := range l.buckets {
+		b.mtx.Lock()
+		if match(b, now) {
+			expired = append(expired, b)
+			delete(l.buckets, key)
+			b.forgotten = true
+		}
+		b.mtx.Unlock()
+	}
+	l.mtx.Unlock()
+
+	for _, b := range expired {
+		b.release()
+	}
+}
+
+// track keeps track of a forgotten bucket that took a new lease. If there is
+// already another bucket for the key, the units of the lease are given back.
+func (l *Leaser) track(b *Bucket) {
+	l.mtx.Lock()
+	other, ok := l.buckets[b.key]
+	if !ok {
+		l.buckets[b.key] = b
+	}
+	l.mtx.Unlock()
+
+	if ok && other != b {
+		b.release()
+	}
+}
+
+// batch returns the size of the next lease for the given request rate.
+func (l *Leaser) batch(rate float64) uint {
+	size := math.Ceil(rate * l.config.period.Seconds())
+	switch {
+	case size < float64(l.config.minBatch):
+		return l.config.minBatch
+	case size > float64(l.config.maxBatch):
+		return l.config.maxBatch
+	}
+
+	return uint(size)
+}
+
+// Bucket serves the inputs from units leased from a backend bucket.
+type Bucket struct {
+	leaser  *Leaser
+	key     string
+	backend Backend
+
+	mtx       sync.Mutex
+	tokens    uint
+	size      uint
+	leasedAt  time.Time
+	rate      float64
+	last      time.Time
+	forgotten bool
+}
+
+// Input takes one unit.
+func (b *Bucket) Input() bool {
+	return b.InputN(1)
+}
+
+// InputN takes n units.
+//
+// If the lease does not have enough units, a new lease is taken from the
+// backend. If the backend rejects the lease, smaller leases are tried, down to
+// the missing units. The backend is called without holding the lock of the
+// bucket, so concurrent inputs may take leases at the same time.
+func (b *Bucket) InputN(n uint) bool {
+	l := b.leaser
+	atomic.AddUint64(&l.inputs, 1)
+
+	b.mtx.Lock()
+	now := l.now()
+	b.observe(n, now)
+	b.expire(now)
+	if b.tokens >= n {
+		b.tokens -= n
+		b.mtx.Unlock()
+		return true
+	}
+
+	taken := b.tokens
+	b.tokens = 0
+	need := n - taken
+	size := l.batch(b.rate)
+	b.mtx.Unlock()
+
+	if size < need {
+		size = need
+	}
+	size, ok := b.lease(size, need)
+
+	b.mtx.Lock()
+	if !ok {
+		b.tokens += taken
+		b.mtx.Unlock()
+		return false
+	}
+
+	b.expire(now)
+	b.tokens += size - need
+	b.size = b.tokens
+	b.leasedAt = now
+	forgotten := b.forgotten
+	b.forgotten = false
+	b.mtx.Unlock()
+
+	if forgotten {
+		l.track(b)
+	}
+
+	return true
+}
+
+// lease takes a lease of the given size from the backend. If the backend
+// rejects it, the size is halved, down to need.
+func (b *Bucket) lease(size, need uint) (uint, bool) {
+	l := b.leaser
+	for {
+		if b.backend.InputN(size) {
+			atomic.AddUint64(&l.leases, 1)
+			atomic.AddUint64(&l.leased, uint64(size))
+			return size, true
+		}
+
+		atomic.AddUint64(&l.rejections, 1)
+		if size == need {
+			return 0, false
+		}
+
+		size /= 2
+		if size < need {
+			size = need
+		}
+	}
+}
+
+// Refund gives back n units to the lease.
+func (b *Bucket) Refund(n uint) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.tokens += n
+	b.size += n
+}
+
+// Persistent returns true, if the backend bucket keeps its state outside of
+// the process.
+func (b *Bucket) Persistent() bool {
+	p, ok := b.backend.(bucket.Persistent)
+	return ok && p.Persistent()
+}
+
+// Leak leaks the backend bucket.
+func (b *Bucket) Leak() {
+	b.backend.Leak()
+}
+
+// Level returns the level of the backend bucket, without the unused units of
+// the lease.
+func (b *Bucket) Level() (level, limit uint) {
+	m, ok := b.backend.(bucket.Meter)
+	if !ok {
+		return 0, 0
+	}
+
+	level, limit = m.Level()
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if level > b.tokens {
+		return level - b.tokens, limit
+	}
+
+	return 0, limit
+}
+
+// observe updates the estimated request rate. The mutex must be held.
+func (b *Bucket) observe(n uint, now time.Time) {
+	elapsed := now.Sub(b.last)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	b.rate = b.rate*math.Exp(-elapsed.Seconds()/rateWindow.Seconds()) + float64(n)/rateWindow.Seconds()
+	b.last = now
+}
+
+// expire drops the units of the lease that the backend freed since the lease
+// was taken. The mutex must be held.
+func (b *Bucket) expire(now time.Time) {
+	interval := b.leaser.config.interval
+	if interval <= 0 || b.tokens == 0 {
+		return
+	}
+
+	valid := uint(0)
+	if freed := now.Sub(b.leasedAt) / interval; freed < time.Duration(b.size) {
+		valid = b.size - uint(freed)
+	}
+
+	if valid < b.tokens {
+		atomic.AddUint64(&b.leaser.expired, uint64(b.tokens-valid))
+		b.tokens = valid
+	}
+}
+
+// release gives back the unused units to the backend, which the backend did
+// not free yet.
+func (b *Bucket) release() {
+	b.mtx.Lock()
+	b.expire(b.leaser.now())
+	tokens := b.tokens
+	b.tokens = 0
+	b.mtx.Unlock()
+
+	if tokens > 0 {
+		b.backend.Refund(tokens)
+		atomic.AddUint64(&b.leaser.returned, uint64(tokens))
+	}
+}
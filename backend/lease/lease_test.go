@@ -0,0 +1,266 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package lease
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/bucket"
+	"github.com/tamasd/ratelimiter/internal/backendtest"
+)
+
+// fakeBackend is a shared backend bucket that counts the round trips.
+type fakeBackend struct {
+	mtx    sync.Mutex
+	bucket *bucket.Leaky
+	calls  int
+	block  chan struct{}
+}
+
+func newFakeBackend(limit uint) *fakeBackend {
+	return &fakeBackend{bucket: bucket.NewLeaky(limit)}
+}
+
+func (f *fakeBackend) Input() bool {
+	return f.InputN(1)
+}
+
+func (f *fakeBackend) InputN(n uint) bool {
+	if f.block != nil {
+		<-f.block
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls++
+	return f.bucket.InputN(n)
+}
+
+func (f *fakeBackend) Refund(n uint) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for i := uint(0); i < n; i++ {
+		f.bucket.Leak()
+	}
+}
+
+func (f *fakeBackend) Leak() {}
+
+func (f *fakeBackend) Level() (level, limit uint) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.bucket.Level()
+}
+
+func testLeaser(config Config) (*Leaser, *backendtest.Clock) {
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	l := New(config)
+	l.now = clock.Now
+
+	return l, clock
+}
+
+func TestBucket_AdaptiveBatch(t *testing.T) {
+	l, clock := testLeaser(CreateConfig(0))
+	backend := newFakeBackend(10000)
+	b := l.Bucket("a", backend)
+
+	// A quiet key leases a unit at a time.
+	for i := 0; i < 5; i++ {
+		clock.Add(10 * time.Second)
+		require.True(t, b.Input())
+	}
+	require.Equal(t, 5, backend.calls)
+	level, _ := backend.Level()
+	require.Equal(t, uint(5), level)
+
+	// A busy key leases bigger batches.
+	backend.calls = 0
+	for i := 0; i < 1000; i++ {
+		clock.Add(time.Millisecond)
+		require.True(t, b.Input())
+	}
+	require.Less(t, backend.calls, 100)
+
+	// At a steady rate, a lease lasts for the period.
+	backend.calls = 0
+	for i := 0; i < 1000; i++ {
+		clock.Add(time.Millisecond)
+		require.True(t, b.Input())
+	}
+	require.LessOrEqual(t, backend.calls, 15)
+
+	level, _ = backend.Level()
+	local, _ := b.Level()
+	require.Equal(t, uint(2005), local)
+	require.Greater(t, level, local)
+
+	stats := l.Stats()
+	require.Equal(t, uint64(2005), stats.Inputs)
+	require.Equal(t, uint64(level), stats.Leased)
+	require.Zero(t, stats.Rejections)
+}
+
+func TestBucket_Rejected(t *testing.T) {
+	config := CreateConfig(0)
+	config.SetBatch(100, 100)
+	l, _ := testLeaser(config)
+	backend := newFakeBackend(10)
+	b := l.Bucket("a", backend)
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if b.Input() {
+			allowed++
+		}
+	}
+	require.Equal(t, 10, allowed)
+
+	b.Refund(2)
+	require.True(t, b.InputN(2))
+	require.False(t, b.Input())
+}
+
+func TestLeaser_Stop(t *testing.T) {
+	l, clock := testLeaser(CreateConfig(0))
+	backend := newFakeBackend(10000)
+	b := l.Bucket("a", backend)
+
+	for i := 0; i < 100; i++ {
+		clock.Add(time.Millisecond)
+		require.True(t, b.Input())
+	}
+	level, _ := backend.Level()
+	require.Greater(t, level, uint(100))
+
+	l.Stop()
+	level, _ = backend.Level()
+	require.Equal(t, uint(100), level)
+	require.Equal(t, l.Stats().Leased-100, l.Stats().Returned)
+}
+
+func TestLeaser_Expire(t *testing.T) {
+	l, clock := testLeaser(CreateConfig(0))
+	backend := newFakeBackend(10000)
+	b := l.Factory(func(key string) Backend {
+		return backend
+	})("a")
+
+	for i := 0; i < 100; i++ {
+		clock.Add(time.Millisecond)
+		require.True(t, b.Input())
+	}
+
+	l.Expire()
+	level, _ := backend.Level()
+	require.Greater(t, level, uint(100), "the lease is still in use")
+
+	clock.Add(time.Second)
+	l.Expire()
+	level, _ = backend.Level()
+	require.Equal(t, uint(100), level)
+
+	// The forgotten bucket is tracked again, when it takes a new lease.
+	clock.Add(time.Millisecond)
+	require.True(t, b.Input())
+	l.Stop()
+	level, _ = backend.Level()
+	require.Equal(t, uint(101), level)
+}
+
+func TestLeaser_Leaking(t *testing.T) {
+	config := CreateConfig(10 * time.Millisecond)
+	config.SetBatch(100, 100)
+	l, clock := testLeaser(config)
+	backend := newFakeBackend(10000)
+	b := l.Bucket("a", backend)
+
+	require.True(t, b.InputN(10))
+
+	// The backend freed 50 units, which are assumed to be the unused ones,
+	// so 40 units are left from the lease.
+	clock.Add(500 * time.Millisecond)
+	require.True(t, b.InputN(40))
+	require.Equal(t, 1, backend.calls)
+	require.Equal(t, uint64(50), l.Stats().Expired)
+
+	require.True(t, b.InputN(10))
+	require.Equal(t, 2, backend.calls)
+
+	clock.Add(200 * time.Millisecond)
+	require.True(t, b.Input())
+	require.Equal(t, 2, backend.calls)
+
+	// The units freed by the backend are not given back.
+	clock.Add(300 * time.Millisecond)
+	l.Stop()
+	stats := l.Stats()
+	require.Equal(t, uint64(200), stats.Leased)
+	require.Equal(t, uint64(40), stats.Returned)
+	require.Equal(t, uint64(200-61-40), stats.Expired)
+}
+
+func TestBucket_LeaseUnlocked(t *testing.T) {
+	config := CreateConfig(0)
+	config.SetBatch(5, 5)
+	l, _ := testLeaser(config)
+	backend := newFakeBackend(100)
+	b := l.Bucket("a", backend)
+	require.True(t, b.Input())
+
+	backend.block = make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		done <- b.InputN(10)
+	}()
+
+	// The lease in progress does not block the inputs that can be served
+	// locally.
+	require.Eventually(t, func() bool {
+		b.Refund(1)
+		return b.Input()
+	}, time.Second, time.Millisecond)
+
+	close(backend.block)
+	require.True(t, <-done)
+}
+
+func TestMiddleware_Lease(t *testing.T) {
+	l := New(CreateConfig(0))
+	defer l.Stop()
+	backend := newFakeBackend(1)
+	mw := ratelimiter.NewWithBucketFactory(ratelimiter.CreateMiddlewareConfig(1), l.Factory(func(key string) Backend {
+		return backend
+	}))
+
+	code := func() int {
+		w := httptest.NewRecorder()
+		mw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		return w.Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, code())
+	require.Equal(t, http.StatusTooManyRequests, code())
+}
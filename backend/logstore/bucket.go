@@ -0,0 +1,54 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package logstore
+
+// Bucket is a bucket stored in a Store.
+//
+// The bucket leaks based on the time passed since its last use, so Leak()
+// does nothing. Use Refund() to give back units.
+type Bucket struct {
+	backend *Backend
+	key     string
+}
+
+// Input fills the bucket with one unit.
+func (b *Bucket) Input() bool {
+	return b.backend.InputN(b.key, 1)
+}
+
+// InputN fills the bucket with n units.
+func (b *Bucket) InputN(n uint) bool {
+	return b.backend.InputN(b.key, n)
+}
+
+// Refund gives back n units.
+func (b *Bucket) Refund(n uint) {
+	b.backend.Refund(b.key, n)
+}
+
+// Persistent returns true, the buckets are stored in the log.
+func (b *Bucket) Persistent() bool {
+	return true
+}
+
+// Leak does nothing, the bucket leaks based on the time.
+func (b *Bucket) Leak() {}
+
+// Level returns the level and the capacity of the bucket.
+func (b *Bucket) Level() (level, limit uint) {
+	return b.backend.Level(b.key), b.backend.config.limit
+}
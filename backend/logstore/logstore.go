@@ -0,0 +1,319 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package logstore is a persistent bucket backend for single-node
+// deployments.
+//
+// The buckets are stored in an append-only log on the local disk, so they
+// survive restarts without an external service:
+//
+//	store, err := logstore.Open("/var/lib/myservice/ratelimiter.log")
+//	if err != nil {
+//		return err
+//	}
+//	backend := logstore.New(store, logstore.CreateConfig(100, time.Second))
+//	go backend.Start()
+//	defer backend.Stop()
+//
+//	middleware := ratelimiter.NewWithBucketFactory(config, backend.Factory())
+//
+// The buckets leak based on the time passed since their last use, including
+// the time the service was down.
+package logstore
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/tamasd/ratelimiter/bucket"
+	"github.com/tamasd/ratelimiter/internal/remote"
+)
+
+// compactThreshold is the minimum number of stale records that triggers a
+// compaction.
+const compactThreshold = 1024
+
+// stateSize is the size of the encoded state of a bucket.
+const stateSize = 16
+
+// Config holds the configuration of the Backend type.
+type Config struct {
+	limit        uint
+	window       time.Duration
+	syncInterval time.Duration
+	errorFunc    remote.ErrorFunc
+}
+
+// CreateConfig creates a configuration that accepts limit units per window.
+//
+// The changes are synced to the disk every second by default.
+func CreateConfig(limit uint, window time.Duration) Config {
+	return Config{
+		limit:        limit,
+		window:       window,
+		syncInterval: time.Second,
+	}
+}
+
+// SetSyncInterval sets how often Start() syncs the changes to the disk.
+//
+// The changes since the last sync are lost if the process crashes.
+func (c *Config) SetSyncInterval(interval time.Duration) {
+	c.syncInterval = interval
+}
+
+// SetErrorFunc sets a function that is called with the errors of the store.
+//
+// The errors of the background tasks are reported with an empty key.
+func (c *Config) SetErrorFunc(errorFunc func(key string, err error)) {
+	c.errorFunc = errorFunc
+}
+
+// interval returns the time it takes to leak one unit.
+//
+// The interval is at least a nanosecond, even if the window is zero or
+// shorter than the limit.
+func (c Config) interval() time.Duration {
+	interval := c.window
+	if c.limit > 0 {
+		interval /= time.Duration(c.limit)
+	}
+	if interval < time.Nanosecond {
+		interval = time.Nanosecond
+	}
+
+	return interval
+}
+
+// state is the state of a bucket: the level, and the time of the last leak.
+type state struct {
+	level    uint64
+	leakedAt int64
+}
+
+func decodeState(value []byte) (state, bool) {
+	if len(value) != stateSize {
+		return state{}, false
+	}
+
+	return state{
+		level:    binary.LittleEndian.Uint64(value),
+		leakedAt: int64(binary.LittleEndian.Uint64(value[8:])),
+	}, true
+}
+
+func (s state) encode() []byte {
+	value := make([]byte, stateSize)
+	binary.LittleEndian.PutUint64(value, s.level)
+	binary.LittleEndian.PutUint64(value[8:], uint64(s.leakedAt))
+
+	return value
+}
+
+// leak leaks the units that leaked since the last leak.
+func (s *state) leak(now time.Time, interval time.Duration) {
+	elapsed := now.UnixNano() - s.leakedAt
+	if elapsed <= 0 {
+		return
+	}
+
+	leaked := uint64(elapsed / int64(interval))
+	if leaked >= s.level {
+		s.level = 0
+		s.leakedAt = now.UnixNano()
+		return
+	}
+
+	s.level -= leaked
+	s.leakedAt += int64(leaked) * int64(interval)
+}
+
+// Backend stores leaky buckets in a Store.
+type Backend struct {
+	store  *Store
+	config Config
+	now    func() time.Time
+
+	mtx sync.Mutex
+
+	quitch chan struct{}
+	once   sync.Once
+}
+
+// New creates a backend.
+func New(store *Store, config Config) *Backend {
+	return &Backend{
+		store:  store,
+		config: config,
+		now:    time.Now,
+		quitch: make(chan struct{}),
+	}
+}
+
+// Bucket returns the bucket of the given key.
+func (b *Backend) Bucket(key string) *Bucket {
+	return &Bucket{
+		backend: b,
+		key:     key,
+	}
+}
+
+// Factory returns a bucket factory for ratelimiter.NewWithBucketFactory().
+func (b *Backend) Factory() func(key string) bucket.Bucket {
+	return func(key string) bucket.Bucket {
+		return b.Bucket(key)
+	}
+}
+
+// InputN fills the bucket of the given key with n units, and returns whether
+// the units were accepted.
+func (b *Backend) InputN(key string, n uint) bool {
+	accepted := false
+	b.update(key, func(s *state) {
+		if s.level+uint64(n) <= uint64(b.config.limit) {
+			s.level += uint64(n)
+			accepted = true
+		}
+	})
+
+	return accepted
+}
+
+// Refund gives back n units to the bucket of the given key.
+func (b *Backend) Refund(key string, n uint) {
+	b.update(key, func(s *state) {
+		if s.level > uint64(n) {
+			s.level -= uint64(n)
+		} else {
+			s.level = 0
+		}
+	})
+}
+
+// Level returns the level of the bucket of the given key.
+func (b *Backend) Level(key string) uint {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	s := b.load(key)
+	return uint(s.level)
+}
+
+// Cleanup deletes the buckets that leaked completely.
+func (b *Backend) Cleanup() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := b.now()
+	var drained []string
+	b.store.Range(func(key string, value []byte) bool {
+		s, ok := decodeState(value)
+		if ok {
+			s.leak(now, b.config.interval())
+		}
+		if s.level == 0 {
+			drained = append(drained, key)
+		}
+		return true
+	})
+
+	for _, key := range drained {
+		if err := b.store.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Start periodically syncs the store, deletes the drained buckets, and
+// compacts the log.
+func (b *Backend) Start() {
+	ticker := time.NewTicker(b.config.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.report("", b.maintain())
+		case <-b.quitch:
+			return
+		}
+	}
+}
+
+// Stop stops the background tasks, and syncs the store.
+//
+// The store is not closed.
+func (b *Backend) Stop() {
+	b.once.Do(func() {
+		close(b.quitch)
+	})
+
+	b.report("", b.store.Sync())
+}
+
+func (b *Backend) maintain() error {
+	if err := b.Cleanup(); err != nil {
+		return err
+	}
+	if stale := b.store.Stale(); stale >= compactThreshold && stale > b.store.Len() {
+		return b.store.Compact()
+	}
+
+	return b.store.Sync()
+}
+
+// update leaks the bucket, applies f, and stores the new state.
+func (b *Backend) update(key string, f func(s *state)) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	s := b.load(key)
+	f(&s)
+
+	var err error
+	if s.level == 0 {
+		err = b.store.Delete(key)
+	} else {
+		err = b.store.Put(key, s.encode())
+	}
+	b.report(key, err)
+}
+
+// load returns the leaked state of a bucket. The caller must hold the lock.
+func (b *Backend) load(key string) state {
+	now := b.now()
+	value, ok := b.store.Get(key)
+	if !ok {
+		return state{leakedAt: now.UnixNano()}
+	}
+
+	s, ok := decodeState(value)
+	if !ok {
+		return state{leakedAt: now.UnixNano()}
+	}
+	s.leak(now, b.config.interval())
+
+	return s
+}
+
+func (b *Backend) report(key string, err error) {
+	if err != nil {
+		b.config.errorFunc.Report(key, err)
+	}
+}
@@ -0,0 +1,135 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package logstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/internal/backendtest"
+)
+
+func testBackend(t *testing.T, store *Store, clock *backendtest.Clock, config Config) *Backend {
+	backend := New(store, config)
+	backend.now = clock.Now
+
+	return backend
+}
+
+func TestBucket(t *testing.T) {
+	store, _ := testStore(t)
+	defer store.Close()
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	backend := testBackend(t, store, clock, CreateConfig(3, time.Second))
+
+	b := backend.Bucket("a")
+	require.True(t, b.Input())
+	require.True(t, b.InputN(2))
+	require.False(t, b.Input())
+	level, limit := b.Level()
+	require.Equal(t, uint(3), level)
+	require.Equal(t, uint(3), limit)
+
+	clock.Add(time.Second / 3)
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+
+	b.Refund(3)
+	level, _ = b.Level()
+	require.Zero(t, level)
+	require.Zero(t, store.Len())
+}
+
+func TestBucket_ZeroWindow(t *testing.T) {
+	store, _ := testStore(t)
+	defer store.Close()
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	backend := testBackend(t, store, clock, CreateConfig(10, 0))
+
+	b := backend.Bucket("a")
+	require.True(t, b.InputN(10))
+	level, limit := b.Level()
+	require.Equal(t, uint(10), level)
+	require.Equal(t, uint(10), limit)
+
+	clock.Add(time.Nanosecond)
+	level, _ = b.Level()
+	require.Equal(t, uint(9), level)
+}
+
+func TestBackend_Restart(t *testing.T) {
+	store, path := testStore(t)
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	backend := testBackend(t, store, clock, CreateConfig(10, 10*time.Second))
+
+	require.True(t, backend.Bucket("a").InputN(10))
+	backend.Stop()
+	require.NoError(t, store.Close())
+
+	// The bucket leaks while the service is down.
+	clock.Add(3 * time.Second)
+	store, err := Open(path)
+	require.NoError(t, err)
+	defer store.Close()
+	backend = testBackend(t, store, clock, CreateConfig(10, 10*time.Second))
+
+	level, _ := backend.Bucket("a").Level()
+	require.Equal(t, uint(7), level)
+	require.True(t, backend.Bucket("a").InputN(3))
+	require.False(t, backend.Bucket("a").Input())
+}
+
+func TestBackend_Maintain(t *testing.T) {
+	store, _ := testStore(t)
+	defer store.Close()
+	clock := backendtest.NewClock(time.Unix(1600000000, 0))
+	backend := testBackend(t, store, clock, CreateConfig(10000, time.Second))
+
+	for i := 0; i < 2*compactThreshold; i++ {
+		backend.Bucket(strconv.Itoa(i % 10)).Input()
+	}
+	backend.Bucket("drained").Input()
+	require.Equal(t, 11, store.Len())
+
+	clock.Add(time.Second / 10000)
+	require.NoError(t, backend.maintain())
+	require.Equal(t, 10, store.Len())
+	require.Zero(t, store.Stale())
+}
+
+func TestMiddleware_Logstore(t *testing.T) {
+	store, _ := testStore(t)
+	defer store.Close()
+	backend := New(store, CreateConfig(1, time.Minute))
+	mw := ratelimiter.NewWithBucketFactory(ratelimiter.CreateMiddlewareConfig(1), backend.Factory())
+
+	code := func() int {
+		w := httptest.NewRecorder()
+		mw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		return w.Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, code())
+	require.Equal(t, http.StatusTooManyRequests, code())
+}
@@ -0,0 +1,331 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package logstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+
+	// headerSize is the size of the checksum and the length of the payload.
+	headerSize = 8
+
+	// maxPayload is the maximum size of a record without the header.
+	maxPayload = 1 << 20
+)
+
+// ErrCorrupted is returned when a record of the log is invalid.
+//
+// A truncated or corrupted record at the end of the log is the result of a
+// crash, and it is discarded when the log is opened.
+var ErrCorrupted = errors.New("logstore: corrupted record")
+
+// ErrTooLarge is returned for keys and values larger than 1 MiB.
+var ErrTooLarge = errors.New("logstore: record too large")
+
+// Store is a key/value store backed by an append-only log.
+//
+// Every change is appended to the log, and all values are kept in memory. The
+// log is replayed when the store is opened. Compact() rewrites the log with
+// the live values only.
+//
+// The changes are buffered, and only written to the disk by Sync().
+type Store struct {
+	path string
+
+	mtx    sync.Mutex
+	values map[string][]byte
+	file   *os.File
+	w      *bufio.Writer
+	stale  int
+}
+
+// Open opens the store at the given path, creating it if it does not exist.
+func Open(path string) (*Store, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		path:   path,
+		values: make(map[string][]byte),
+		file:   file,
+	}
+
+	if err := s.replay(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	s.w = bufio.NewWriter(file)
+
+	return s, nil
+}
+
+// Get returns the value of a key.
+func (s *Store) Get(key string) ([]byte, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Put sets the value of a key.
+func (s *Store) Put(key string, value []byte) error {
+	if len(key)+len(value) > maxPayload-1-binary.MaxVarintLen64 {
+		return ErrTooLarge
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.values[key]; ok {
+		s.stale++
+	}
+	s.values[key] = append([]byte(nil), value...)
+
+	return writeRecord(s.w, opPut, key, value)
+}
+
+// Delete deletes a key.
+func (s *Store) Delete(key string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.values[key]; !ok {
+		return nil
+	}
+	delete(s.values, key)
+	s.stale += 2
+
+	return writeRecord(s.w, opDelete, key, nil)
+}
+
+// Range calls f for every key, until it returns false.
+//
+// The store must not be modified from f.
+func (s *Store) Range(f func(key string, value []byte) bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for key, value := range s.values {
+		if !f(key, value) {
+			return
+		}
+	}
+}
+
+// Len returns the number of keys.
+func (s *Store) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return len(s.values)
+}
+
+// Stale returns the number of records in the log that are overwritten or
+// deleted, and would be removed by Compact().
+func (s *Store) Stale() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.stale
+}
+
+// Sync writes the buffered changes to the disk.
+func (s *Store) Sync() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.sync()
+}
+
+// Compact rewrites the log with the live values only.
+//
+// The new log is written next to the old one, and renamed over it, so the
+// store is never left without a complete log.
+func (s *Store) Compact() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err := s.sync(); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".compact"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for key, value := range s.values {
+		if err = writeRecord(w, opPut, key, value); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	_ = s.file.Close()
+	s.file = file
+	s.w = bufio.NewWriter(file)
+	s.stale = 0
+
+	return nil
+}
+
+// Close syncs and closes the store.
+func (s *Store) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err := s.sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (s *Store) sync() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+// replay reads the log into the memory, and truncates the incomplete record at
+// the end of the log.
+func (s *Store) replay() error {
+	r := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		op, key, value, size, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF || err == ErrCorrupted {
+			if err := s.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset += size
+
+		if _, ok := s.values[key]; ok {
+			s.stale++
+		}
+		switch op {
+		case opPut:
+			s.values[key] = value
+		case opDelete:
+			delete(s.values, key)
+			s.stale++
+		}
+	}
+
+	_, err := s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// writeRecord writes a record.
+//
+// The record starts with the CRC-32 checksum and the length of the payload.
+// The payload is the operation, the length of the key as an uvarint, the key
+// and the value.
+func writeRecord(w io.Writer, op byte, key string, value []byte) error {
+	payload := make([]byte, 1+binary.MaxVarintLen64+len(key)+len(value))
+	payload[0] = op
+	n := 1 + binary.PutUvarint(payload[1:], uint64(len(key)))
+	n += copy(payload[n:], key)
+	n += copy(payload[n:], value)
+	payload = payload[:n]
+
+	header := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(header, crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(payload)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readRecord reads a record, and returns its size.
+func readRecord(r io.Reader) (op byte, key string, value []byte, size int64, err error) {
+	header := make([]byte, headerSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	checksum := binary.LittleEndian.Uint32(header)
+	length := binary.LittleEndian.Uint32(header[4:])
+	if length == 0 || length > maxPayload {
+		err = ErrCorrupted
+		return
+	}
+
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		err = ErrCorrupted
+		return
+	}
+
+	op = payload[0]
+	keyLength, n := binary.Uvarint(payload[1:])
+	if n <= 0 || uint64(len(payload)-1-n) < keyLength || (op != opPut && op != opDelete) {
+		err = ErrCorrupted
+		return
+	}
+	key = string(payload[1+n : 1+n+int(keyLength)])
+	value = payload[1+n+int(keyLength):]
+	size = int64(headerSize + length)
+
+	return
+}
@@ -0,0 +1,138 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package logstore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T) (*Store, string) {
+	path := filepath.Join(t.TempDir(), "store.log")
+	store, err := Open(path)
+	require.NoError(t, err)
+
+	return store, path
+}
+
+func TestStore_Replay(t *testing.T) {
+	store, path := testStore(t)
+
+	require.NoError(t, store.Put("a", []byte("1")))
+	require.NoError(t, store.Put("b", []byte("2")))
+	require.NoError(t, store.Put("a", []byte("3")))
+	require.NoError(t, store.Delete("b"))
+	require.NoError(t, store.Delete("missing"))
+	require.NoError(t, store.Put("", nil))
+	require.Equal(t, 3, store.Stale())
+	require.NoError(t, store.Close())
+
+	store, err := Open(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	value, ok := store.Get("a")
+	require.True(t, ok)
+	require.Equal(t, []byte("3"), value)
+	_, ok = store.Get("b")
+	require.False(t, ok)
+	_, ok = store.Get("")
+	require.True(t, ok)
+	require.Equal(t, 2, store.Len())
+	require.Equal(t, 3, store.Stale())
+}
+
+func TestStore_TruncatedTail(t *testing.T) {
+	store, path := testStore(t)
+	require.NoError(t, store.Put("a", []byte("1")))
+	require.NoError(t, store.Put("b", []byte("2")))
+	require.NoError(t, store.Close())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-1))
+
+	store, err = Open(path)
+	require.NoError(t, err)
+	_, ok := store.Get("b")
+	require.False(t, ok)
+	require.NoError(t, store.Put("c", []byte("3")))
+	require.NoError(t, store.Close())
+
+	store, err = Open(path)
+	require.NoError(t, err)
+	defer store.Close()
+	require.Equal(t, 2, store.Len())
+	value, _ := store.Get("c")
+	require.Equal(t, []byte("3"), value)
+}
+
+func TestStore_Corrupted(t *testing.T) {
+	store, path := testStore(t)
+	require.NoError(t, store.Put("a", []byte("1")))
+	require.NoError(t, store.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	store, err = Open(path)
+	require.NoError(t, err)
+	defer store.Close()
+	require.Zero(t, store.Len())
+}
+
+func TestStore_Compact(t *testing.T) {
+	store, path := testStore(t)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Put("key"+strconv.Itoa(i%10), []byte(strconv.Itoa(i))))
+	}
+	require.NoError(t, store.Sync())
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Compact())
+	require.Zero(t, store.Stale())
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Less(t, after.Size(), before.Size())
+
+	require.NoError(t, store.Put("key0", []byte("new")))
+	require.NoError(t, store.Close())
+
+	store, err = Open(path)
+	require.NoError(t, err)
+	defer store.Close()
+	require.Equal(t, 10, store.Len())
+	value, _ := store.Get("key0")
+	require.Equal(t, []byte("new"), value)
+	value, _ = store.Get("key9")
+	require.Equal(t, []byte("99"), value)
+}
+
+func TestStore_TooLarge(t *testing.T) {
+	store, _ := testStore(t)
+	defer store.Close()
+
+	require.Equal(t, ErrTooLarge, store.Put("a", make([]byte, maxPayload)))
+}
@@ -0,0 +1,135 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package memcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/tamasd/ratelimiter/internal/remote"
+)
+
+// Bucket is the counter of a key in memcached.
+//
+// The counters expire with their windows, so Leak() does nothing. Use
+// Refund() to give back units.
+type Bucket struct {
+	backend *Backend
+	key     string
+
+	mtx    sync.Mutex
+	level  uint
+	window int64
+}
+
+// Input counts one unit.
+func (b *Bucket) Input() bool {
+	return b.InputN(1)
+}
+
+// InputN counts n units.
+//
+// When the counter cannot be updated, the error is reported, and the input is
+// allowed only if the backend fails open and the error is not ErrContention.
+func (b *Bucket) InputN(n uint) bool {
+	ctx, cancel := remote.Context(b.backend.config.timeout)
+	defer cancel()
+
+	allowed, err := b.InputContext(ctx, n)
+	if err != nil {
+		b.backend.config.errorFunc.Report(b.key, err)
+		return b.backend.config.failOpen && !errors.Is(err, ErrContention)
+	}
+
+	return allowed
+}
+
+// InputContext counts n units, and returns the errors.
+func (b *Bucket) InputContext(ctx context.Context, n uint) (bool, error) {
+	result, err := b.backend.InputN(ctx, b.key, n)
+	if err != nil {
+		return false, err
+	}
+
+	window, _ := b.backend.window()
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.level = result.Level
+	b.window = window
+
+	return result.Allowed, nil
+}
+
+// Refund gives back n units.
+func (b *Bucket) Refund(n uint) {
+	ctx, cancel := remote.Context(b.backend.config.timeout)
+	defer cancel()
+
+	if err := b.RefundContext(ctx, n); err != nil {
+		b.backend.config.errorFunc.Report(b.key, err)
+	}
+}
+
+// RefundContext gives back n units, and returns the errors.
+func (b *Bucket) RefundContext(ctx context.Context, n uint) error {
+	if err := b.backend.Refund(ctx, b.key, n); err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.level > n {
+		b.level -= n
+	} else {
+		b.level = 0
+	}
+
+	return nil
+}
+
+// Persistent returns true, the counters are stored in memcached.
+func (b *Bucket) Persistent() bool {
+	return true
+}
+
+// Leak does nothing, the counters expire with their windows.
+func (b *Bucket) Leak() {}
+
+// Level returns the estimated level of the bucket.
+//
+// The level is estimated from the level returned by the last input, so it
+// does not need a round trip. The level drops to zero when the window of the
+// last input is over. With the sliding window algorithm, it decreases
+// gradually during the next window.
+func (b *Bucket) Level() (level, limit uint) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	window, elapsed := b.backend.window()
+	switch {
+	case window == b.window:
+		level = b.level
+	case window == b.window+1 && b.backend.config.algorithm == SlidingWindow:
+		level = uint(float64(b.level) * (1 - elapsed))
+	}
+
+	return level, b.backend.config.limit
+}
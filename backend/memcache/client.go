@@ -0,0 +1,307 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIdle is the number of idle connections kept by the client.
+const maxIdle = 8
+
+var (
+	// ErrClosed is returned for commands sent through a closed client.
+	ErrClosed = errors.New("memcache: client closed")
+
+	errProtocol = errors.New("memcache: protocol error")
+)
+
+// Error is an error reply of the server.
+type Error string
+
+func (e Error) Error() string {
+	return "memcache: " + string(e)
+}
+
+// item is a value returned by gets.
+type item struct {
+	value []byte
+	cas   uint64
+}
+
+// Client is a minimal memcached client using the text protocol.
+//
+// The client keeps a small pool of connections, and dials new ones when all of
+// them are in use.
+type Client struct {
+	network string
+	address string
+	dialer  net.Dialer
+
+	mtx    sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// NewClient creates a client for the server at the given address.
+//
+// The network is "tcp" or "unix", see net.Dial.
+func NewClient(network, address string) *Client {
+	return &Client{
+		network: network,
+		address: address,
+	}
+}
+
+// Close closes the idle connections of the client.
+//
+// The client is not usable anymore.
+func (c *Client) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.closed = true
+	for _, cn := range c.idle {
+		_ = cn.netConn.Close()
+	}
+	c.idle = nil
+
+	return nil
+}
+
+// gets returns the items of the given keys. Missing keys are not part of the
+// result.
+func (c *Client) gets(ctx context.Context, keys ...string) (map[string]item, error) {
+	items := make(map[string]item, len(keys))
+	err := c.do(ctx, func(cn *conn) error {
+		fmt.Fprintf(cn.w, "gets %s\r\n", strings.Join(keys, " "))
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+
+		for {
+			line, err := cn.readLine()
+			if err != nil {
+				return err
+			}
+			if line == "END" {
+				return nil
+			}
+
+			// VALUE <key> <flags> <bytes> <cas unique>
+			fields := strings.Fields(line)
+			if len(fields) != 5 || fields[0] != "VALUE" {
+				return errProtocol
+			}
+			size, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return errProtocol
+			}
+			cas, err := strconv.ParseUint(fields[4], 10, 64)
+			if err != nil {
+				return errProtocol
+			}
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(cn.r, value); err != nil {
+				return err
+			}
+			items[fields[1]] = item{
+				value: value[:size],
+				cas:   cas,
+			}
+		}
+	})
+
+	return items, err
+}
+
+// store executes a storage command, and returns the reply, e.g. "STORED" or
+// "EXISTS".
+//
+// The expiration time is in the format of the protocol, see exptime(). The cas
+// unique is only sent with the "cas" command.
+func (c *Client) store(ctx context.Context, command, key string, value []byte, expiration int64, cas uint64) (string, error) {
+	var reply string
+	err := c.do(ctx, func(cn *conn) error {
+		fmt.Fprintf(cn.w, "%s %s 0 %d %d", command, key, expiration, len(value))
+		if command == "cas" {
+			fmt.Fprintf(cn.w, " %d", cas)
+		}
+		cn.w.WriteString("\r\n")
+		cn.w.Write(value)
+		cn.w.WriteString("\r\n")
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+
+		var err error
+		reply, err = cn.readLine()
+		return err
+	})
+
+	return reply, err
+}
+
+// incr executes an "incr" or "decr" command. The second return value is false,
+// if the key is missing.
+func (c *Client) incr(ctx context.Context, command, key string, delta uint64) (uint64, bool, error) {
+	var (
+		value uint64
+		found bool
+	)
+	err := c.do(ctx, func(cn *conn) error {
+		fmt.Fprintf(cn.w, "%s %s %d\r\n", command, key, delta)
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+
+		line, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "NOT_FOUND" {
+			return nil
+		}
+
+		value, err = strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return errProtocol
+		}
+		found = true
+		return nil
+	})
+
+	return value, found, err
+}
+
+// do runs f with a connection.
+//
+// The connection is returned to the pool, unless f failed with a connection
+// error.
+func (c *Client) do(ctx context.Context, f func(cn *conn) error) error {
+	cn, err := c.connection(ctx)
+	if err != nil {
+		return err
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := cn.netConn.SetDeadline(deadline); err != nil {
+		_ = cn.netConn.Close()
+		return err
+	}
+
+	err = f(cn)
+	var e Error
+	if err != nil && !errors.As(err, &e) {
+		_ = cn.netConn.Close()
+		return err
+	}
+
+	c.release(cn)
+	return err
+}
+
+func (c *Client) connection(ctx context.Context) (*conn, error) {
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mtx.Unlock()
+		return cn, nil
+	}
+	c.mtx.Unlock()
+
+	netConn, err := c.dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{
+		netConn: netConn,
+		r:       bufio.NewReader(netConn),
+		w:       bufio.NewWriter(netConn),
+	}, nil
+}
+
+func (c *Client) release(cn *conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.closed || len(c.idle) >= maxIdle {
+		_ = cn.netConn.Close()
+		return
+	}
+
+	c.idle = append(c.idle, cn)
+}
+
+type conn struct {
+	netConn net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+}
+
+// readLine reads a reply line, and turns the error replies into an Error.
+func (cn *conn) readLine() (string, error) {
+	line, err := cn.r.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return "", errProtocol
+	}
+	reply := string(line[:len(line)-2])
+
+	if reply == "ERROR" || strings.HasPrefix(reply, "CLIENT_ERROR") || strings.HasPrefix(reply, "SERVER_ERROR") {
+		return "", Error(reply)
+	}
+
+	return reply, nil
+}
+
+// maxRelativeExpiration is the longest expiration memcached accepts in
+// seconds. Longer ones are read as unix timestamps.
+const maxRelativeExpiration = 30 * 24 * 60 * 60
+
+// exptime converts the expiration to whole seconds, rounding up. Expirations
+// longer than 30 days are converted to a unix timestamp.
+func exptime(expiration time.Duration, now time.Time) int64 {
+	if expiration <= 0 {
+		return 0
+	}
+
+	seconds := int64((expiration + time.Second - 1) / time.Second)
+	if seconds > maxRelativeExpiration {
+		return now.Unix() + seconds
+	}
+
+	return seconds
+}
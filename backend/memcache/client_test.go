@@ -0,0 +1,111 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package memcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testClient(t *testing.T) (*fakeServer, *Client) {
+	fs := newFakeServer(t)
+	client := NewClient("tcp", fs.addr())
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return fs, client
+}
+
+func TestClient_Store(t *testing.T) {
+	_, client := testClient(t)
+	ctx := context.Background()
+
+	reply, err := client.store(ctx, "add", "key", []byte("1"), 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "STORED", reply)
+
+	reply, err = client.store(ctx, "add", "key", []byte("2"), 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "NOT_STORED", reply)
+
+	items, err := client.gets(ctx, "key", "missing")
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, []byte("1"), items["key"].value)
+
+	reply, err = client.store(ctx, "cas", "key", []byte("3"), 1, items["key"].cas+1)
+	require.NoError(t, err)
+	require.Equal(t, "EXISTS", reply)
+
+	reply, err = client.store(ctx, "cas", "key", []byte("3"), 1, items["key"].cas)
+	require.NoError(t, err)
+	require.Equal(t, "STORED", reply)
+}
+
+func TestClient_Incr(t *testing.T) {
+	fs, client := testClient(t)
+	ctx := context.Background()
+
+	_, found, err := client.incr(ctx, "incr", "counter", 1)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	_, err = client.store(ctx, "add", "counter", []byte("5"), 1, 0)
+	require.NoError(t, err)
+
+	value, found, err := client.incr(ctx, "incr", "counter", 2)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(7), value)
+
+	value, _, err = client.incr(ctx, "decr", "counter", 10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), value)
+
+	fs.advance(time.Second)
+	_, found, err = client.incr(ctx, "incr", "counter", 1)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestClient_Error(t *testing.T) {
+	_, client := testClient(t)
+	ctx := context.Background()
+
+	_, err := client.store(ctx, "add", "text", []byte("text"), 0, 0)
+	require.NoError(t, err)
+
+	_, _, err = client.incr(ctx, "incr", "text", 1)
+	require.IsType(t, Error(""), err)
+
+	// The connection is still usable after an error reply.
+	items, err := client.gets(ctx, "text")
+	require.NoError(t, err)
+	require.Equal(t, []byte("text"), items["text"].value)
+}
+
+func TestClient_Close(t *testing.T) {
+	_, client := testClient(t)
+
+	require.NoError(t, client.Close())
+	_, err := client.gets(context.Background(), "key")
+	require.Equal(t, ErrClosed, err)
+}
@@ -0,0 +1,260 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer is a small in-process server speaking the memcached text
+// protocol.
+type fakeServer struct {
+	listener net.Listener
+
+	mtx     sync.Mutex
+	entries map[string]*fakeEntry
+	cas     uint64
+	now     time.Time
+}
+
+type fakeEntry struct {
+	value   []byte
+	cas     uint64
+	expires time.Time
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	fs := &fakeServer{
+		listener: listener,
+		entries:  make(map[string]*fakeEntry),
+		now:      time.Unix(1600000000, 0),
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go fs.serve()
+
+	return fs
+}
+
+func (fs *fakeServer) addr() string {
+	return fs.listener.Addr().String()
+}
+
+// clock returns the time of the server, which is also used by the backends in
+// the tests.
+func (fs *fakeServer) clock() time.Time {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	return fs.now
+}
+
+func (fs *fakeServer) advance(d time.Duration) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	fs.now = fs.now.Add(d)
+}
+
+// evict removes every entry, like memcached does under memory pressure.
+func (fs *fakeServer) evict() {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	fs.entries = make(map[string]*fakeEntry)
+}
+
+func (fs *fakeServer) serve() {
+	for {
+		conn, err := fs.listener.Accept()
+		if err != nil {
+			return
+		}
+		go fs.handle(conn)
+	}
+}
+
+func (fs *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+			_ = w.Flush()
+			continue
+		}
+
+		switch fields[0] {
+		case "get", "gets":
+			fs.get(w, fields[1:])
+		case "set", "add", "cas":
+			if err := fs.store(r, w, fields); err != nil {
+				return
+			}
+		case "incr", "decr":
+			fs.incr(w, fields)
+		default:
+			fmt.Fprint(w, "ERROR\r\n")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// entry returns a live entry. The caller must hold the lock.
+func (fs *fakeServer) entry(key string) *fakeEntry {
+	e, ok := fs.entries[key]
+	if !ok {
+		return nil
+	}
+	if !e.expires.IsZero() && !fs.now.Before(e.expires) {
+		delete(fs.entries, key)
+		return nil
+	}
+
+	return e
+}
+
+func (fs *fakeServer) get(w io.Writer, keys []string) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	for _, key := range keys {
+		if e := fs.entry(key); e != nil {
+			fmt.Fprintf(w, "VALUE %s 0 %d %d\r\n%s\r\n", key, len(e.value), e.cas, e.value)
+		}
+	}
+	fmt.Fprint(w, "END\r\n")
+}
+
+func (fs *fakeServer) store(r *bufio.Reader, w io.Writer, fields []string) error {
+	if len(fields) < 5 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return nil
+	}
+	exptime, _ := strconv.Atoi(fields[3])
+	size, err := strconv.Atoi(fields[4])
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR bad data chunk\r\n")
+		return nil
+	}
+	value := make([]byte, size+2)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return err
+	}
+
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	key := fields[1]
+	e := fs.entry(key)
+	switch fields[0] {
+	case "add":
+		if e != nil {
+			fmt.Fprint(w, "NOT_STORED\r\n")
+			return nil
+		}
+	case "cas":
+		cas, _ := strconv.ParseUint(fields[5], 10, 64)
+		if e == nil {
+			fmt.Fprint(w, "NOT_FOUND\r\n")
+			return nil
+		}
+		if e.cas != cas {
+			fmt.Fprint(w, "EXISTS\r\n")
+			return nil
+		}
+	}
+
+	fs.cas++
+	e = &fakeEntry{
+		value: value[:size],
+		cas:   fs.cas,
+	}
+	switch {
+	case exptime > maxRelativeExpiration:
+		e.expires = time.Unix(int64(exptime), 0)
+	case exptime > 0:
+		e.expires = fs.now.Add(time.Duration(exptime) * time.Second)
+	}
+	fs.entries[key] = e
+	fmt.Fprint(w, "STORED\r\n")
+
+	return nil
+}
+
+func (fs *fakeServer) incr(w io.Writer, fields []string) {
+	if len(fields) != 3 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+	delta, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	e := fs.entry(fields[1])
+	if e == nil {
+		fmt.Fprint(w, "NOT_FOUND\r\n")
+		return
+	}
+	value, err := strconv.ParseUint(string(e.value), 10, 64)
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+		return
+	}
+
+	if fields[0] == "incr" {
+		value += delta
+	} else if value > delta {
+		value -= delta
+	} else {
+		value = 0
+	}
+
+	fs.cas++
+	e.value = []byte(strconv.FormatUint(value, 10))
+	e.cas = fs.cas
+	fmt.Fprintf(w, "%d\r\n", value)
+}
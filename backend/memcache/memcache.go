@@ -0,0 +1,318 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package memcache is a distributed bucket backend on top of memcached.
+//
+// The buckets are window counters stored in memcached, so the replicas of a
+// service share the same limits:
+//
+//	client := memcache.NewClient("tcp", "localhost:11211")
+//	backend := memcache.New(client, memcache.CreateConfig(100, time.Second))
+//	middleware := ratelimiter.NewWithBucketFactory(config, backend.Factory())
+//
+// Memcached may evict the counters at any time. A missing counter is counted as
+// zero, so the limiter lets more requests through instead of failing.
+package memcache
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/tamasd/ratelimiter/bucket"
+	"github.com/tamasd/ratelimiter/internal/remote"
+)
+
+// casRetries is the number of times a sliding window input is retried when
+// the counter is updated concurrently.
+const casRetries = 10
+
+// ErrContention is returned when a counter could not be updated because of
+// concurrent updates. The buckets reject the input in this case, regardless
+// of the fail open setting.
+var ErrContention = errors.New("memcache: too many concurrent updates")
+
+// Algorithm selects how the counters are updated.
+type Algorithm int
+
+const (
+	// FixedWindow counts the inputs of the current window with incr.
+	FixedWindow Algorithm = iota
+
+	// SlidingWindow weighs the counter of the previous window by its overlap
+	// with the sliding window, and updates the counter of the current window
+	// with cas.
+	SlidingWindow
+)
+
+// Config holds the configuration of the Backend type.
+type Config struct {
+	limit     uint
+	window    time.Duration
+	algorithm Algorithm
+	prefix    string
+	timeout   time.Duration
+	failOpen  bool
+	errorFunc remote.ErrorFunc
+}
+
+// CreateConfig creates a configuration that accepts limit units per window.
+//
+// By default the counters of fixed windows are kept under the "ratelimiter:"
+// prefix, and memcached has a second to answer the commands of an input.
+// Inputs are allowed while memcached does not answer, see SetFailOpen().
+func CreateConfig(limit uint, window time.Duration) Config {
+	return Config{
+		limit:     limit,
+		window:    window,
+		algorithm: FixedWindow,
+		prefix:    "ratelimiter:",
+		timeout:   time.Second,
+		failOpen:  true,
+	}
+}
+
+// SetAlgorithm sets the algorithm of the buckets.
+func (c *Config) SetAlgorithm(algorithm Algorithm) {
+	c.algorithm = algorithm
+}
+
+// SetPrefix sets the prefix of the memcached keys.
+func (c *Config) SetPrefix(prefix string) {
+	c.prefix = prefix
+}
+
+// SetTimeout sets how long memcached has to answer the commands of an input
+// or a refund.
+func (c *Config) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SetFailOpen sets whether the inputs are allowed when their counter cannot
+// be read or incremented. Inputs that give up with ErrContention are never
+// allowed.
+func (c *Config) SetFailOpen(failOpen bool) {
+	c.failOpen = failOpen
+}
+
+// SetErrorFunc sets a function that receives the errors of the memcached
+// commands, with the key of the bucket.
+func (c *Config) SetErrorFunc(errorFunc func(key string, err error)) {
+	c.errorFunc = errorFunc
+}
+
+// Result is the outcome of an input.
+type Result struct {
+	// Allowed is true, if the bucket accepted the input.
+	Allowed bool
+
+	// Level is the number of units counted in the window after the input.
+	Level uint
+}
+
+// Backend stores buckets in memcached.
+type Backend struct {
+	client *Client
+	config Config
+	now    func() time.Time
+}
+
+// New creates a backend.
+func New(client *Client, config Config) *Backend {
+	return &Backend{
+		client: client,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+// Bucket returns the bucket of the given key.
+func (b *Backend) Bucket(key string) *Bucket {
+	return &Bucket{
+		backend: b,
+		key:     key,
+	}
+}
+
+// Factory returns a bucket factory for ratelimiter.NewWithBucketFactory().
+func (b *Backend) Factory() func(key string) bucket.Bucket {
+	return func(key string) bucket.Bucket {
+		return b.Bucket(key)
+	}
+}
+
+// InputN counts n units in the window of the given key.
+func (b *Backend) InputN(ctx context.Context, key string, n uint) (Result, error) {
+	if b.config.algorithm == SlidingWindow {
+		return b.inputSliding(ctx, key, n)
+	}
+
+	return b.inputFixed(ctx, key, n)
+}
+
+// Refund removes n units from the current window of the given key.
+func (b *Backend) Refund(ctx context.Context, key string, n uint) error {
+	window, _ := b.window()
+	_, _, err := b.client.incr(ctx, "decr", b.cacheKey(key, window), uint64(n))
+	return err
+}
+
+// inputFixed increments the counter of the current window, and decrements it
+// again if the limit is exceeded.
+func (b *Backend) inputFixed(ctx context.Context, key string, n uint) (Result, error) {
+	window, _ := b.window()
+	cacheKey := b.cacheKey(key, window)
+	count, err := b.increment(ctx, cacheKey, uint64(n))
+	if err != nil {
+		return Result{}, err
+	}
+
+	if count > uint64(b.config.limit) {
+		// The input is rejected even if the decrement fails, the counter
+		// expires with the window anyway.
+		_, _, _ = b.client.incr(ctx, "decr", cacheKey, uint64(n))
+		return Result{Level: uint(count) - n}, nil
+	}
+
+	return Result{
+		Allowed: true,
+		Level:   uint(count),
+	}, nil
+}
+
+// increment increments a counter, creating it if it is missing.
+func (b *Backend) increment(ctx context.Context, cacheKey string, n uint64) (uint64, error) {
+	for i := 0; i < casRetries; i++ {
+		count, found, err := b.client.incr(ctx, "incr", cacheKey, n)
+		if err != nil || found {
+			return count, err
+		}
+
+		reply, err := b.client.store(ctx, "add", cacheKey, []byte(strconv.FormatUint(n, 10)), b.expiration(), 0)
+		if err != nil {
+			return 0, err
+		}
+		if reply == "STORED" {
+			return n, nil
+		}
+
+		// Another client created the counter in the meantime.
+	}
+
+	return 0, ErrContention
+}
+
+// inputSliding estimates the number of units in the sliding window from the
+// counters of the current and the previous window, and updates the counter of
+// the current window with cas, if the units fit.
+func (b *Backend) inputSliding(ctx context.Context, key string, n uint) (Result, error) {
+	window, elapsed := b.window()
+	current := b.cacheKey(key, window)
+	previous := b.cacheKey(key, window-1)
+
+	for i := 0; i < casRetries; i++ {
+		items, err := b.client.gets(ctx, current, previous)
+		if err != nil {
+			return Result{}, err
+		}
+
+		count := counter(items[current])
+		level := slidingLevel(counter(items[previous]), count, elapsed)
+		if level+float64(n) > float64(b.config.limit) {
+			return Result{Level: uint(math.Ceil(level))}, nil
+		}
+
+		value := []byte(strconv.FormatUint(count+uint64(n), 10))
+		var reply string
+		if it, ok := items[current]; ok {
+			reply, err = b.client.store(ctx, "cas", current, value, b.expiration(), it.cas)
+		} else {
+			reply, err = b.client.store(ctx, "add", current, value, b.expiration(), 0)
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		if reply == "STORED" {
+			return Result{
+				Allowed: true,
+				Level:   uint(math.Ceil(level + float64(n))),
+			}, nil
+		}
+
+		// The counter was updated, created or evicted in the meantime.
+	}
+
+	return Result{}, ErrContention
+}
+
+// window returns the index of the current window, and the fraction of the
+// window that has already elapsed.
+func (b *Backend) window() (int64, float64) {
+	now := b.now().UnixNano()
+	size := int64(b.config.window)
+
+	return now / size, float64(now%size) / float64(size)
+}
+
+// expiration keeps the counters for two windows, so the previous window is
+// available for the sliding window.
+func (b *Backend) expiration() int64 {
+	return exptime(2*b.config.window, b.now())
+}
+
+// cacheKey returns the memcached key of the counter of a window.
+//
+// Keys that memcached does not accept are hashed.
+func (b *Backend) cacheKey(key string, window int64) string {
+	cacheKey := b.config.prefix + key + ":" + strconv.FormatInt(window, 10)
+	if validKey(cacheKey) {
+		return cacheKey
+	}
+
+	hash := sha1.Sum([]byte(key))
+	return b.config.prefix + hex.EncodeToString(hash[:]) + ":" + strconv.FormatInt(window, 10)
+}
+
+// validKey reports whether memcached accepts the key.
+func validKey(key string) bool {
+	if len(key) > 250 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// counter parses the value of a counter. Missing and invalid counters are
+// counted as zero.
+func counter(it item) uint64 {
+	count, _ := strconv.ParseUint(string(it.value), 10, 64)
+	return count
+}
+
+// slidingLevel weighs the previous window by its overlap with the sliding
+// window.
+func slidingLevel(previous, current uint64, elapsed float64) float64 {
+	return float64(previous)*(1-elapsed) + float64(current)
+}
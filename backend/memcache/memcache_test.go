@@ -0,0 +1,189 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package memcache
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/internal/backendtest"
+)
+
+func testBackend(t *testing.T, config Config) (*fakeServer, *Backend) {
+	fs, client := testClient(t)
+	backend := New(client, config)
+	backend.now = fs.clock
+
+	return fs, backend
+}
+
+func TestBucket_FixedWindow(t *testing.T) {
+	fs, backend := testBackend(t, CreateConfig(3, time.Second))
+
+	b := backend.Bucket("a")
+	require.True(t, b.Input())
+	require.True(t, b.InputN(2))
+	require.False(t, b.Input())
+	require.False(t, b.InputN(4))
+	level, limit := b.Level()
+	require.Equal(t, uint(3), level)
+	require.Equal(t, uint(3), limit)
+
+	require.True(t, backend.Bucket("b").Input())
+
+	b.Refund(1)
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+
+	fs.advance(time.Second)
+	level, _ = b.Level()
+	require.Zero(t, level)
+	require.True(t, b.InputN(3))
+}
+
+func TestBucket_LongWindow(t *testing.T) {
+	fs, backend := testBackend(t, CreateConfig(3, 30*24*time.Hour))
+
+	b := backend.Bucket("a")
+	require.True(t, b.InputN(3))
+	require.False(t, b.Input())
+
+	// The counter is kept for two windows, which memcached only accepts as
+	// a unix timestamp.
+	fs.advance(time.Hour)
+	require.False(t, b.Input())
+}
+
+func TestExptime(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	require.Zero(t, exptime(0, now))
+	require.Equal(t, int64(2), exptime(1500*time.Millisecond, now))
+	require.Equal(t, int64(maxRelativeExpiration), exptime(30*24*time.Hour, now))
+	require.Equal(t, int64(1600000000+maxRelativeExpiration+1), exptime(30*24*time.Hour+time.Second, now))
+}
+
+func TestBucket_SlidingWindow(t *testing.T) {
+	config := CreateConfig(4, time.Second)
+	(&config).SetAlgorithm(SlidingWindow)
+	fs, backend := testBackend(t, config)
+
+	b := backend.Bucket("a")
+	require.True(t, b.InputN(4))
+	require.False(t, b.Input())
+
+	// Half of the previous window overlaps with the sliding window.
+	fs.advance(time.Second + time.Second/2)
+	level, _ := b.Level()
+	require.Equal(t, uint(2), level)
+	require.True(t, b.InputN(2))
+	require.False(t, b.Input())
+
+	fs.advance(time.Second / 4)
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+}
+
+func TestBucket_SlidingWindow_Concurrent(t *testing.T) {
+	config := CreateConfig(50, time.Second)
+	(&config).SetAlgorithm(SlidingWindow)
+	_, backend := testBackend(t, config)
+
+	var (
+		wg      sync.WaitGroup
+		allowed int32
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			b := backend.Bucket("a")
+			for j := 0; j < 10; j++ {
+				if b.Input() {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Some of the inputs may be rejected because of contention, but the limit
+	// is never exceeded.
+	require.LessOrEqual(t, allowed, int32(50))
+	require.Greater(t, allowed, int32(0))
+}
+
+func TestBucket_Eviction(t *testing.T) {
+	for _, algorithm := range []Algorithm{FixedWindow, SlidingWindow} {
+		config := CreateConfig(2, time.Second)
+		(&config).SetAlgorithm(algorithm)
+		fs, backend := testBackend(t, config)
+
+		b := backend.Bucket("a")
+		require.True(t, b.InputN(2))
+		require.False(t, b.Input())
+
+		fs.evict()
+		require.True(t, b.InputN(2))
+		require.False(t, b.Input())
+	}
+}
+
+func TestBucket_InvalidKey(t *testing.T) {
+	_, backend := testBackend(t, CreateConfig(1, time.Second))
+
+	require.True(t, backend.Bucket("john doe").Input())
+	require.False(t, backend.Bucket("john doe").Input())
+	require.True(t, backend.Bucket("john\tdoe").Input())
+}
+
+func TestBucket_Unavailable(t *testing.T) {
+	var errs []string
+	config := CreateConfig(1, time.Second)
+	(&config).SetErrorFunc(func(key string, err error) {
+		errs = append(errs, key)
+	})
+	fs, backend := testBackend(t, config)
+	require.NoError(t, fs.listener.Close())
+
+	require.True(t, backend.Bucket("a").Input())
+
+	backend.config.failOpen = false
+	require.False(t, backend.Bucket("b").Input())
+	require.Equal(t, []string{"a", "b"}, errs)
+}
+
+func TestMiddleware_SharedLimit(t *testing.T) {
+	_, backend := testBackend(t, CreateConfig(2, time.Second))
+	config := ratelimiter.CreateMiddlewareConfig(2)
+
+	replicas := []*ratelimiter.Middleware{
+		ratelimiter.NewWithBucketFactory(config, backend.Factory()),
+		ratelimiter.NewWithBucketFactory(config, backend.Factory()),
+	}
+
+	require.Equal(t, http.StatusOK, backendtest.ResponseCode(replicas[0]))
+	require.Equal(t, http.StatusOK, backendtest.ResponseCode(replicas[1]))
+	require.Equal(t, http.StatusTooManyRequests, backendtest.ResponseCode(replicas[0]))
+	require.Equal(t, http.StatusTooManyRequests, backendtest.ResponseCode(replicas[1]))
+}
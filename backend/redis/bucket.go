@@ -0,0 +1,125 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package redis
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tamasd/ratelimiter/internal/remote"
+)
+
+// Bucket is a bucket stored in Redis.
+//
+// The bucket is leaked by the scripts based on the time of the server, so
+// Leak() does nothing. Use Refund() to give back units.
+type Bucket struct {
+	backend *Backend
+	key     string
+
+	mtx   sync.Mutex
+	level uint
+	at    time.Time
+}
+
+// Input fills the bucket with one unit.
+func (b *Bucket) Input() bool {
+	return b.InputN(1)
+}
+
+// InputN fills the bucket with n units.
+//
+// If Redis is not available, the input is accepted or rejected depending on
+// the fail open setting of the backend.
+func (b *Bucket) InputN(n uint) bool {
+	ctx, cancel := remote.Context(b.backend.config.timeout)
+	defer cancel()
+
+	allowed, err := b.InputContext(ctx, n)
+	if err != nil {
+		b.backend.config.errorFunc.Report(b.key, err)
+		return b.backend.config.failOpen
+	}
+
+	return allowed
+}
+
+// InputContext fills the bucket with n units, and returns the errors.
+func (b *Bucket) InputContext(ctx context.Context, n uint) (bool, error) {
+	result, err := b.backend.InputN(ctx, b.key, n)
+	if err != nil {
+		return false, err
+	}
+
+	b.observe(result.Level)
+	return result.Allowed, nil
+}
+
+// Refund gives back n units.
+func (b *Bucket) Refund(n uint) {
+	ctx, cancel := remote.Context(b.backend.config.timeout)
+	defer cancel()
+
+	if err := b.RefundContext(ctx, n); err != nil {
+		b.backend.config.errorFunc.Report(b.key, err)
+	}
+}
+
+// RefundContext gives back n units, and returns the errors.
+func (b *Bucket) RefundContext(ctx context.Context, n uint) error {
+	results, err := b.backend.run(ctx, []string{b.key}, "-"+strconv.FormatUint(uint64(n), 10))
+	if err != nil {
+		return err
+	}
+
+	b.observe(results[0].Level)
+	return nil
+}
+
+// Persistent returns true, the buckets are stored in Redis.
+func (b *Bucket) Persistent() bool {
+	return true
+}
+
+// Leak does nothing, the server leaks the bucket.
+func (b *Bucket) Leak() {}
+
+// Level returns the estimated level of the bucket.
+//
+// The level is estimated from the level returned by the last input and the
+// time passed since, so it does not need a round trip.
+func (b *Bucket) Level() (level, limit uint) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	leaked := uint(time.Since(b.at) / b.backend.config.interval())
+	if leaked < b.level {
+		level = b.level - leaked
+	}
+
+	return level, b.backend.config.limit
+}
+
+func (b *Bucket) observe(level uint) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.level = level
+	b.at = time.Now()
+}
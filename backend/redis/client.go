@@ -0,0 +1,284 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrClosed is returned for commands sent through a closed client.
+var ErrClosed = errors.New("redis: client closed")
+
+// pendingCalls is the number of calls that can be in flight on a connection
+// before the writer waits for the replies.
+const pendingCalls = 1024
+
+// Client is a minimal Redis client that pipelines the commands.
+//
+// The commands of concurrent callers are written to a single connection in
+// batches, without waiting for the replies of the previous commands, so many
+// keyed lookups share a round trip. The connection is dialed on first use,
+// and redialed after a failure.
+type Client struct {
+	network string
+	address string
+	dialer  net.Dialer
+
+	mu     sync.Mutex
+	conn   *conn
+	closed bool
+}
+
+// NewClient creates a client for the server at the given address.
+//
+// The network is "tcp" or "unix", see net.Dial.
+func NewClient(network, address string) *Client {
+	return &Client{
+		network: network,
+		address: address,
+	}
+}
+
+// Do sends a command to the server, and returns the reply.
+//
+// Error replies are returned as an Error.
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := c.Pipeline(ctx, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(Error); ok {
+		return nil, e
+	}
+
+	return replies[0], nil
+}
+
+// Pipeline sends the commands in one batch, and returns the replies in the
+// same order.
+//
+// The error replies are returned as Error values in the reply slice. The
+// returned error is only set when the commands could not be executed.
+func (c *Client) Pipeline(ctx context.Context, commands [][]string) ([]interface{}, error) {
+	cn, err := c.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	calls := make([]*call, len(commands))
+	for i, args := range commands {
+		calls[i] = &call{
+			args:   args,
+			result: make(chan result, 1),
+		}
+	}
+
+	select {
+	case cn.requests <- calls:
+	case <-cn.done:
+		return nil, cn.err
+	case <-ctx.Done():
+		return nil, cn.abandon(ctx)
+	}
+
+	replies := make([]interface{}, len(calls))
+	for i, cl := range calls {
+		select {
+		case res := <-cl.result:
+			if res.err != nil {
+				return nil, res.err
+			}
+			replies[i] = res.reply
+		case <-ctx.Done():
+			return nil, cn.abandon(ctx)
+		}
+	}
+
+	return replies, nil
+}
+
+// Close closes the connection of the client.
+//
+// The pending commands fail, and the client is not usable anymore.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.conn != nil {
+		c.conn.fail(ErrClosed)
+	}
+
+	return nil
+}
+
+// connection returns the active connection, dialing a new one if needed.
+func (c *Client) connection(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.conn != nil && !c.conn.failed() {
+		return c.conn, nil
+	}
+
+	netConn, err := c.dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+
+	c.conn = newConn(netConn)
+	return c.conn, nil
+}
+
+type result struct {
+	reply interface{}
+	err   error
+}
+
+type call struct {
+	args   []string
+	result chan result
+}
+
+// conn is a pipelined connection.
+//
+// The writer goroutine writes the batches of calls, and hands them over to
+// the reader goroutine, which matches them with the replies in order.
+type conn struct {
+	netConn  net.Conn
+	requests chan []*call
+	pending  chan *call
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newConn(netConn net.Conn) *conn {
+	cn := &conn{
+		netConn:  netConn,
+		requests: make(chan []*call),
+		pending:  make(chan *call, pendingCalls),
+		done:     make(chan struct{}),
+	}
+
+	go cn.write()
+	go cn.read()
+
+	return cn
+}
+
+// fail closes the connection, and fails the pending calls with err.
+func (cn *conn) fail(err error) {
+	cn.once.Do(func() {
+		cn.err = err
+		close(cn.done)
+		_ = cn.netConn.Close()
+	})
+}
+
+// abandon is called when a caller stops waiting for its replies. If the
+// deadline is exceeded, the server or the network is considered stuck, because
+// the replies arrive in order, so every later call would wait behind this one.
+// The connection is closed, and the next call dials a new one.
+func (cn *conn) abandon(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		cn.fail(err)
+	}
+
+	return err
+}
+
+func (cn *conn) failed() bool {
+	select {
+	case <-cn.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cn *conn) write() {
+	defer close(cn.pending)
+
+	w := bufio.NewWriter(cn.netConn)
+	for {
+		var calls []*call
+		select {
+		case calls = <-cn.requests:
+		case <-cn.done:
+			return
+		}
+
+		// Collect the batches of the other callers, so they are flushed
+		// together.
+	collect:
+		for {
+			select {
+			case more := <-cn.requests:
+				calls = append(calls, more...)
+			default:
+				break collect
+			}
+		}
+
+		for i, cl := range calls {
+			cn.pending <- cl
+			if err := writeCommand(w, cl.args); err != nil {
+				cn.fail(err)
+				failCalls(calls[i+1:], cn.err)
+				return
+			}
+		}
+		if err := w.Flush(); err != nil {
+			cn.fail(err)
+			return
+		}
+	}
+}
+
+func failCalls(calls []*call, err error) {
+	for _, cl := range calls {
+		cl.result <- result{err: err}
+	}
+}
+
+func (cn *conn) read() {
+	r := bufio.NewReader(cn.netConn)
+	for cl := range cn.pending {
+		reply, err := readReply(r)
+		if err != nil {
+			cn.fail(err)
+			cl.result <- result{err: cn.err}
+			break
+		}
+		cl.result <- result{reply: reply}
+	}
+
+	// The writer closes the pending channel after the connection failed.
+	for cl := range cn.pending {
+		cl.result <- result{err: cn.err}
+	}
+}
@@ -0,0 +1,155 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package redis
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func testServer(t *testing.T) (*miniredis.Miniredis, *Client) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+
+	client := NewClient("tcp", server.Addr())
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return server, client
+}
+
+func TestClient_Do(t *testing.T) {
+	_, client := testServer(t)
+	ctx := context.Background()
+
+	reply, err := client.Do(ctx, "SET", "key", "value")
+	require.NoError(t, err)
+	require.Equal(t, "OK", reply)
+
+	reply, err = client.Do(ctx, "GET", "key")
+	require.NoError(t, err)
+	require.Equal(t, "value", reply)
+
+	reply, err = client.Do(ctx, "GET", "missing")
+	require.NoError(t, err)
+	require.Nil(t, reply)
+
+	_, err = client.Do(ctx, "INCR", "key")
+	require.IsType(t, Error(""), err)
+}
+
+func TestClient_Pipeline(t *testing.T) {
+	_, client := testServer(t)
+
+	replies, err := client.Pipeline(context.Background(), [][]string{
+		{"INCR", "counter"},
+		{"SET", "counter", "x"},
+		{"INCR", "counter"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), replies[0])
+	require.Equal(t, "OK", replies[1])
+	require.IsType(t, Error(""), replies[2])
+}
+
+func TestClient_Concurrent(t *testing.T) {
+	_, client := testServer(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			key := fmt.Sprintf("key%d", i)
+			for j := 1; j <= 20; j++ {
+				reply, err := client.Do(ctx, "INCR", key)
+				require.NoError(t, err)
+				require.Equal(t, int64(j), reply)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	server, client := testServer(t)
+	ctx := context.Background()
+
+	_, err := client.Do(ctx, "PING")
+	require.NoError(t, err)
+
+	server.Close()
+	_, err = client.Do(ctx, "PING")
+	require.Error(t, err)
+
+	require.NoError(t, server.Restart())
+	_, err = client.Do(ctx, "PING")
+	require.NoError(t, err)
+}
+
+func TestClient_Timeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// The server accepts the connections, and never replies.
+	var accepted int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			defer c.Close()
+		}
+	}()
+
+	client := NewClient("tcp", l.Addr().String())
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err = client.Do(ctx, "PING")
+		cancel()
+		require.Equal(t, context.DeadlineExceeded, err)
+	}
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&accepted) == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestClient_Close(t *testing.T) {
+	_, client := testServer(t)
+
+	require.NoError(t, client.Close())
+	_, err := client.Do(context.Background(), "PING")
+	require.Equal(t, ErrClosed, err)
+}
@@ -0,0 +1,267 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package redis is a distributed bucket backend on top of Redis.
+//
+// The state of the buckets is stored in Redis, and updated atomically by Lua
+// scripts, so the replicas of a service share the same limits:
+//
+//	client := redis.NewClient("tcp", "localhost:6379")
+//	backend := redis.New(client, redis.CreateConfig(100, time.Second))
+//	middleware := ratelimiter.NewWithBucketFactory(config, backend.Factory())
+//
+// The buckets leak based on the time of the Redis server, so they don't need
+// the leaking loop of the middleware.
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tamasd/ratelimiter/bucket"
+	"github.com/tamasd/ratelimiter/internal/remote"
+)
+
+// Algorithm selects the script that updates the buckets.
+type Algorithm int
+
+const (
+	// Leaky is the meter variant of the leaky bucket algorithm, the same
+	// algorithm the in-memory buckets use.
+	Leaky Algorithm = iota
+
+	// Token is the token bucket algorithm.
+	Token
+
+	// GCRA is the generic cell rate algorithm. It stores a single timestamp
+	// per bucket.
+	GCRA
+)
+
+var scripts = map[Algorithm]script{
+	Leaky: newScript(leakyScript),
+	Token: newScript(tokenScript),
+	GCRA:  newScript(gcraScript),
+}
+
+// Config holds the configuration of the Backend type.
+type Config struct {
+	limit     uint
+	window    time.Duration
+	algorithm Algorithm
+	prefix    string
+	timeout   time.Duration
+	failOpen  bool
+	errorFunc remote.ErrorFunc
+}
+
+// CreateConfig creates a configuration that accepts limit units per window.
+//
+// The defaults are the Leaky algorithm, the "ratelimiter:" key prefix, and a
+// one second timeout, after which the buckets let the requests through.
+func CreateConfig(limit uint, window time.Duration) Config {
+	return Config{
+		limit:     limit,
+		window:    window,
+		algorithm: Leaky,
+		prefix:    "ratelimiter:",
+		timeout:   time.Second,
+		failOpen:  true,
+	}
+}
+
+// SetAlgorithm sets the algorithm of the buckets.
+func (c *Config) SetAlgorithm(algorithm Algorithm) {
+	c.algorithm = algorithm
+}
+
+// SetPrefix sets the prefix of the Redis keys.
+func (c *Config) SetPrefix(prefix string) {
+	c.prefix = prefix
+}
+
+// SetTimeout sets the timeout of the Input() calls of the buckets.
+func (c *Config) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SetFailOpen sets whether the buckets accept the inputs when Redis is not
+// available.
+func (c *Config) SetFailOpen(failOpen bool) {
+	c.failOpen = failOpen
+}
+
+// SetErrorFunc sets a function that is called with the errors of the Input()
+// calls of the buckets.
+func (c *Config) SetErrorFunc(errorFunc func(key string, err error)) {
+	c.errorFunc = errorFunc
+}
+
+// interval returns the time it takes to leak one unit.
+//
+// The scripts count in microseconds, so the interval is at least a
+// microsecond, even if the window is zero or shorter than the limit.
+func (c Config) interval() time.Duration {
+	interval := c.window
+	if c.limit > 0 {
+		interval /= time.Duration(c.limit)
+	}
+	if interval < time.Microsecond {
+		interval = time.Microsecond
+	}
+
+	return interval
+}
+
+// Result is the outcome of an input.
+type Result struct {
+	// Allowed is true, if the bucket accepted the input.
+	Allowed bool
+
+	// Level is the level of the bucket after the input.
+	Level uint
+}
+
+// Backend stores buckets in Redis.
+type Backend struct {
+	client *Client
+	config Config
+	script script
+}
+
+// New creates a backend.
+func New(client *Client, config Config) *Backend {
+	return &Backend{
+		client: client,
+		config: config,
+		script: scripts[config.algorithm],
+	}
+}
+
+// Bucket returns the bucket of the given key.
+func (b *Backend) Bucket(key string) *Bucket {
+	return &Bucket{
+		backend: b,
+		key:     key,
+	}
+}
+
+// Factory returns a bucket factory for ratelimiter.NewWithBucketFactory().
+func (b *Backend) Factory() func(key string) bucket.Bucket {
+	return func(key string) bucket.Bucket {
+		return b.Bucket(key)
+	}
+}
+
+// InputN fills the bucket of the given key with n units.
+func (b *Backend) InputN(ctx context.Context, key string, n uint) (Result, error) {
+	results, err := b.InputMany(ctx, []string{key}, n)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return results[0], nil
+}
+
+// InputMany fills the buckets of the given keys with n units each.
+//
+// The scripts are sent in a single pipeline, so this takes one round trip.
+func (b *Backend) InputMany(ctx context.Context, keys []string, n uint) ([]Result, error) {
+	return b.run(ctx, keys, strconv.FormatUint(uint64(n), 10))
+}
+
+// Refund gives back n units to the bucket of the given key.
+func (b *Backend) Refund(ctx context.Context, key string, n uint) error {
+	_, err := b.run(ctx, []string{key}, "-"+strconv.FormatUint(uint64(n), 10))
+	return err
+}
+
+// run runs the script for every key.
+//
+// The scripts are called by their hash. The ones missing from the script cache
+// of the server are sent again in full.
+func (b *Backend) run(ctx context.Context, keys []string, n string) ([]Result, error) {
+	args := []string{
+		strconv.FormatUint(uint64(b.config.limit), 10),
+		strconv.FormatInt(b.config.interval().Microseconds(), 10),
+		n,
+	}
+
+	commands := make([][]string, len(keys))
+	for i, key := range keys {
+		commands[i] = b.script.evalSha([]string{b.config.prefix + key}, args...)
+	}
+	replies, err := b.client.Pipeline(ctx, commands)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []int
+	for i, reply := range replies {
+		if e, ok := reply.(Error); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		commands = commands[:0]
+		for _, i := range missing {
+			commands = append(commands, b.script.eval([]string{b.config.prefix + keys[i]}, args...))
+		}
+		retried, err := b.client.Pipeline(ctx, commands)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range missing {
+			replies[i] = retried[j]
+		}
+	}
+
+	results := make([]Result, len(replies))
+	for i, reply := range replies {
+		if results[i], err = parseResult(reply); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+func parseResult(reply interface{}) (Result, error) {
+	if e, ok := reply.(Error); ok {
+		return Result{}, e
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return Result{}, fmt.Errorf("%w: unexpected script result %v", errProtocol, reply)
+	}
+	allowed, ok := values[0].(int64)
+	if !ok {
+		return Result{}, fmt.Errorf("%w: unexpected script result %v", errProtocol, reply)
+	}
+	level, ok := values[1].(int64)
+	if !ok || level < 0 {
+		return Result{}, fmt.Errorf("%w: unexpected script result %v", errProtocol, reply)
+	}
+
+	return Result{
+		Allowed: allowed == 1,
+		Level:   uint(level),
+	}, nil
+}
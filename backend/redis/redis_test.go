@@ -0,0 +1,186 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package redis_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/backend/redis"
+	"github.com/tamasd/ratelimiter/internal/backendtest"
+)
+
+var algorithms = map[string]redis.Algorithm{
+	"leaky": redis.Leaky,
+	"token": redis.Token,
+	"gcra":  redis.GCRA,
+}
+
+func testBackend(t *testing.T, config redis.Config) (*miniredis.Miniredis, *redis.Backend) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	server.SetTime(time.Unix(1600000000, 0))
+
+	client := redis.NewClient("tcp", server.Addr())
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return server, redis.New(client, config)
+}
+
+func TestBucket_Algorithms(t *testing.T) {
+	for name, algorithm := range algorithms {
+		t.Run(name, func(t *testing.T) {
+			config := redis.CreateConfig(3, time.Second)
+			(&config).SetAlgorithm(algorithm)
+			server, backend := testBackend(t, config)
+			now := time.Unix(1600000000, 0)
+
+			b := backend.Bucket("a")
+			require.True(t, b.Input())
+			require.True(t, b.InputN(2))
+			require.False(t, b.Input())
+			level, limit := b.Level()
+			require.Equal(t, uint(3), level)
+			require.Equal(t, uint(3), limit)
+
+			require.True(t, backend.Bucket("b").Input())
+
+			now = now.Add(time.Second / 3)
+			server.SetTime(now)
+			require.True(t, b.Input())
+			require.False(t, b.Input())
+
+			b.Refund(2)
+			require.True(t, b.InputN(2))
+			require.False(t, b.Input())
+
+			now = now.Add(time.Second)
+			server.SetTime(now)
+			require.True(t, b.InputN(3))
+			require.False(t, b.InputN(4))
+		})
+	}
+}
+
+func TestBucket_Expiry(t *testing.T) {
+	for name, algorithm := range algorithms {
+		t.Run(name, func(t *testing.T) {
+			config := redis.CreateConfig(2, time.Second)
+			(&config).SetAlgorithm(algorithm)
+			(&config).SetPrefix("test:")
+			server, backend := testBackend(t, config)
+
+			require.True(t, backend.Bucket("a").InputN(2))
+			require.True(t, server.Exists("test:a"))
+			require.Equal(t, time.Second, server.TTL("test:a"))
+
+			backend.Bucket("a").Refund(2)
+			require.False(t, server.Exists("test:a"))
+		})
+	}
+}
+
+func TestBucket_ZeroWindow(t *testing.T) {
+	for name, algorithm := range algorithms {
+		t.Run(name, func(t *testing.T) {
+			for _, window := range []time.Duration{0, time.Nanosecond} {
+				config := redis.CreateConfig(1000, window)
+				(&config).SetAlgorithm(algorithm)
+				_, backend := testBackend(t, config)
+
+				b := backend.Bucket("a")
+				require.True(t, b.Input())
+				level, limit := b.Level()
+				require.LessOrEqual(t, level, uint(1))
+				require.Equal(t, uint(1000), limit)
+			}
+		})
+	}
+}
+
+func TestBackend_InputMany(t *testing.T) {
+	_, backend := testBackend(t, redis.CreateConfig(1, time.Second))
+	ctx := context.Background()
+
+	results, err := backend.InputMany(ctx, []string{"a", "b", "a"}, 1)
+	require.NoError(t, err)
+	require.Equal(t, []redis.Result{
+		{Allowed: true, Level: 1},
+		{Allowed: true, Level: 1},
+		{Allowed: false, Level: 1},
+	}, results)
+}
+
+func TestBackend_ScriptFlush(t *testing.T) {
+	server, backend := testBackend(t, redis.CreateConfig(2, time.Second))
+	ctx := context.Background()
+
+	_, err := backend.InputN(ctx, "a", 1)
+	require.NoError(t, err)
+
+	client := redis.NewClient("tcp", server.Addr())
+	defer client.Close()
+	_, err = client.Do(ctx, "SCRIPT", "FLUSH")
+	require.NoError(t, err)
+
+	result, err := backend.InputN(ctx, "a", 1)
+	require.NoError(t, err)
+	require.Equal(t, redis.Result{Allowed: true, Level: 2}, result)
+}
+
+func TestBucket_Unavailable(t *testing.T) {
+	var errs []string
+	config := redis.CreateConfig(1, time.Second)
+	(&config).SetErrorFunc(func(key string, err error) {
+		errs = append(errs, key)
+	})
+	server, backend := testBackend(t, config)
+	server.Close()
+
+	require.True(t, backend.Bucket("a").Input())
+	require.Equal(t, []string{"a"}, errs)
+
+	(&config).SetFailOpen(false)
+	server, backend = testBackend(t, config)
+	server.Close()
+
+	require.False(t, backend.Bucket("b").Input())
+	require.Equal(t, []string{"a", "b"}, errs)
+}
+
+func TestMiddleware_SharedLimit(t *testing.T) {
+	_, backend := testBackend(t, redis.CreateConfig(2, time.Second))
+	config := ratelimiter.CreateMiddlewareConfig(2)
+
+	replicas := []*ratelimiter.Middleware{
+		ratelimiter.NewWithBucketFactory(config, backend.Factory()),
+		ratelimiter.NewWithBucketFactory(config, backend.Factory()),
+	}
+
+	require.Equal(t, http.StatusOK, backendtest.ResponseCode(replicas[0]))
+	require.Equal(t, http.StatusOK, backendtest.ResponseCode(replicas[1]))
+	require.Equal(t, http.StatusTooManyRequests, backendtest.ResponseCode(replicas[0]))
+	require.Equal(t, http.StatusTooManyRequests, backendtest.ResponseCode(replicas[1]))
+}
@@ -0,0 +1,60 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCommand(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := bufio.NewWriter(buf)
+	require.NoError(t, writeCommand(w, []string{"SET", "key", ""}))
+	require.NoError(t, w.Flush())
+
+	require.Equal(t, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$0\r\n\r\n", buf.String())
+}
+
+func TestReadReply(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("+OK\r\n-ERR wrong\r\n:42\r\n$5\r\nhe\r\nl\r\n$-1\r\n*2\r\n:1\r\n*1\r\n$1\r\na\r\n*-1\r\n"))
+
+	for _, expected := range []interface{}{
+		"OK",
+		Error("ERR wrong"),
+		int64(42),
+		"he\r\nl",
+		nil,
+		[]interface{}{int64(1), []interface{}{"a"}},
+		nil,
+	} {
+		reply, err := readReply(r)
+		require.NoError(t, err)
+		require.Equal(t, expected, reply)
+	}
+}
+
+func TestReadReply_Invalid(t *testing.T) {
+	for _, input := range []string{"\r\n", "?\r\n", "+OK\n", "$x\r\n", "*x\r\n", ":x\r\n", "$5\r\nab"} {
+		_, err := readReply(bufio.NewReader(strings.NewReader(input)))
+		require.Error(t, err, input)
+	}
+}
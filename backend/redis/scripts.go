@@ -0,0 +1,171 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package redis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+)
+
+// The scripts take the key of the bucket, and the limit, the interval in
+// microseconds and the number of units as arguments. A negative number of
+// units refunds the units. The scripts return whether the units were
+// accepted, and the level of the bucket.
+//
+// The time is read from the server, so the clocks of the clients don't have to
+// be in sync. The timestamps are formatted with string.format, because the
+// default number formatting of Lua loses precision.
+
+// leakyScript is the meter variant of the leaky bucket algorithm.
+const leakyScript = `
+local limit = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local state = redis.call('HMGET', KEYS[1], 'level', 'ts')
+local level = tonumber(state[1]) or 0
+local ts = tonumber(state[2]) or now
+
+local leaked = math.max(math.floor((now - ts) / interval), 0)
+if leaked >= level then
+	level = 0
+	ts = now
+else
+	level = level - leaked
+	ts = ts + leaked * interval
+end
+
+local allowed = 1
+if n < 0 then
+	level = math.max(level + n, 0)
+elseif level + n <= limit then
+	level = level + n
+else
+	allowed = 0
+end
+
+if level == 0 then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('HSET', KEYS[1], 'level', level, 'ts', string.format('%.0f', ts))
+	redis.call('PEXPIRE', KEYS[1], math.ceil(level * interval / 1000))
+end
+
+return {allowed, level}
+`
+
+// tokenScript is the token bucket algorithm.
+//
+// The level of the bucket is the number of missing tokens.
+const tokenScript = `
+local limit = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or limit
+local ts = tonumber(state[2]) or now
+
+local refill = math.max(math.floor((now - ts) / interval), 0)
+if tokens + refill >= limit then
+	tokens = limit
+	ts = now
+else
+	tokens = tokens + refill
+	ts = ts + refill * interval
+end
+
+local allowed = 1
+if n < 0 then
+	tokens = math.min(tokens - n, limit)
+elseif tokens >= n then
+	tokens = tokens - n
+else
+	allowed = 0
+end
+
+local level = limit - tokens
+if level == 0 then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', string.format('%.0f', ts))
+	redis.call('PEXPIRE', KEYS[1], math.ceil(level * interval / 1000))
+end
+
+return {allowed, level}
+`
+
+// gcraScript is the generic cell rate algorithm.
+//
+// The bucket only stores the theoretical arrival time of the next unit.
+const gcraScript = `
+local limit = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local tat = math.max(tonumber(redis.call('GET', KEYS[1])) or now, now)
+
+local allowed = 1
+if n < 0 then
+	tat = math.max(tat + n * interval, now)
+elseif tat + n * interval - now <= limit * interval then
+	tat = tat + n * interval
+else
+	allowed = 0
+end
+
+local level = math.ceil((tat - now) / interval)
+if level == 0 then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('SET', KEYS[1], string.format('%.0f', tat), 'PX', math.ceil((tat - now) / 1000))
+end
+
+return {allowed, level}
+`
+
+// script is a Lua script, which is called by its hash when possible.
+type script struct {
+	source string
+	hash   string
+}
+
+func newScript(source string) script {
+	hash := sha1.Sum([]byte(source))
+
+	return script{
+		source: source,
+		hash:   hex.EncodeToString(hash[:]),
+	}
+}
+
+// evalSha returns the arguments of EVALSHA.
+func (s script) evalSha(keys []string, args ...string) []string {
+	return append(append([]string{"EVALSHA", s.hash, strconv.Itoa(len(keys))}, keys...), args...)
+}
+
+// eval returns the arguments of EVAL.
+func (s script) eval(keys []string, args ...string) []string {
+	return append(append([]string{"EVAL", s.source, strconv.Itoa(len(keys))}, keys...), args...)
+}
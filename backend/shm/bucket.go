@@ -0,0 +1,63 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package shm
+
+// Bucket is a bucket stored in a shared memory Table.
+//
+// The bucket leaks based on the time passed since its last use, so Leak()
+// does nothing. Use Refund() to give back units.
+type Bucket struct {
+	table *Table
+	key   string
+}
+
+// Input fills the bucket with one unit.
+func (b *Bucket) Input() bool {
+	return b.InputN(1)
+}
+
+// InputN fills the bucket with n units.
+//
+// If the table is full, the input is accepted or rejected depending on the
+// fail open setting of the table.
+func (b *Bucket) InputN(n uint) bool {
+	result, err := b.table.InputN(b.key, n)
+	if err != nil {
+		b.table.config.errorFunc.Report(b.key, err)
+		return b.table.config.failOpen
+	}
+
+	return result.Allowed
+}
+
+// Refund gives back n units.
+func (b *Bucket) Refund(n uint) {
+	b.table.Refund(b.key, n)
+}
+
+// Persistent returns true, the buckets are stored in shared memory.
+func (b *Bucket) Persistent() bool {
+	return true
+}
+
+// Leak does nothing, the bucket leaks based on the time.
+func (b *Bucket) Leak() {}
+
+// Level returns the level and the capacity of the bucket.
+func (b *Bucket) Level() (level, limit uint) {
+	return b.table.Level(b.key), b.table.config.limit
+}
@@ -0,0 +1,115 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+
+package shm
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Open maps the table stored in the file at path, and creates the file, if
+// it does not exist. Every process of the host must open the same path with
+// the same configuration.
+//
+// Files under /dev/shm are kept in memory. The table survives the restarts of
+// the processes; remove the file to reset it.
+func Open(path string, config Config) (*Table, error) {
+	if config.slots == 0 {
+		return nil, errors.New("shm: the table must have at least one slot")
+	}
+
+	size := tableSize(config.slots)
+	create := true
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		create = false
+		f, err = os.OpenFile(path, os.O_RDWR, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if create {
+		if err = f.Truncate(int64(size)); err != nil {
+			_ = os.Remove(path)
+			return nil, err
+		}
+	} else if err = waitSize(f, size); err != nil {
+		return nil, err
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	if create {
+		initHeader(data, config, time.Now().Add(-epochMargin))
+	} else if err = waitInitialized(data); err != nil {
+		_ = syscall.Munmap(data)
+		return nil, err
+	}
+
+	t, err := newTable(data, syscall.Munmap, config)
+	if err != nil {
+		_ = syscall.Munmap(data)
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// epochMargin keeps the timestamps positive when the clock of the host is
+// set back a little after the table is created.
+const epochMargin = 24 * time.Hour
+
+// initTimeout is the time a process waits for another process to create the
+// table.
+const initTimeout = time.Second
+
+// waitSize waits until the file is resized by the process that created it.
+func waitSize(f *os.File, size int) error {
+	for deadline := time.Now().Add(initTimeout); ; time.Sleep(time.Millisecond) {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() == int64(size) {
+			return nil
+		}
+		if info.Size() > 0 || time.Now().After(deadline) {
+			return ErrMismatch
+		}
+	}
+}
+
+// waitInitialized waits until the header is written by the process that
+// created the table.
+func waitInitialized(data []byte) error {
+	for deadline := time.Now().Add(initTimeout); !initialized(data); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			return ErrMismatch
+		}
+	}
+
+	return nil
+}
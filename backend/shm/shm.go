@@ -0,0 +1,136 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package shm is a bucket backend shared between the processes of a host.
+//
+// The buckets are stored in a memory-mapped file, and updated with atomic
+// operations, so the limits hold per host, no matter how many worker
+// processes run:
+//
+//	table, err := shm.Open("/dev/shm/myservice-ratelimiter", shm.CreateConfig(100, time.Second))
+//	if err != nil {
+//		return err
+//	}
+//	defer table.Close()
+//
+//	middleware := ratelimiter.NewWithBucketFactory(config, table.Factory())
+//
+// The table is a fixed-size, open-addressed hash table. Every slot holds the
+// hash of a key and the state of its bucket, which is updated with the
+// generic cell rate algorithm, so it fits into a single word together with a
+// 16-bit tag of the hash. The keys are not stored, so keys with the same
+// 64-bit hash share a bucket. The states are stored in microseconds since the
+// creation of the table, in 48 bits, so a table has to be recreated every
+// eight years.
+//
+// Shared memory is only supported on Linux.
+package shm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tamasd/ratelimiter/bucket"
+	"github.com/tamasd/ratelimiter/internal/remote"
+)
+
+var (
+	// ErrUnsupported is returned by Open() on platforms without shared memory
+	// support.
+	ErrUnsupported = errors.New("shm: shared memory is not supported on this platform")
+
+	// ErrMismatch is returned by Open() when the table was created with a
+	// different configuration.
+	ErrMismatch = errors.New("shm: the table was created with a different configuration")
+
+	// ErrFull is returned when there is no free slot for a new key.
+	ErrFull = errors.New("shm: table is full")
+)
+
+// Config holds the configuration of the Table type.
+type Config struct {
+	limit     uint
+	window    time.Duration
+	slots     uint
+	failOpen  bool
+	errorFunc remote.ErrorFunc
+}
+
+// CreateConfig creates a configuration that accepts limit units per window.
+//
+// The default table has 65536 slots, and the keys that find no free slot are
+// not limited.
+func CreateConfig(limit uint, window time.Duration) Config {
+	return Config{
+		limit:    limit,
+		window:   window,
+		slots:    1 << 16,
+		failOpen: true,
+	}
+}
+
+// SetSlots sets the number of slots of the table.
+//
+// The table should have a lot more slots than the number of keys that are
+// active during a window.
+func (c *Config) SetSlots(slots uint) {
+	c.slots = slots
+}
+
+// SetFailOpen sets whether the buckets accept the inputs when the table is
+// full.
+func (c *Config) SetFailOpen(failOpen bool) {
+	c.failOpen = failOpen
+}
+
+// SetErrorFunc sets a function that is called with the keys that find no free
+// slot.
+func (c *Config) SetErrorFunc(errorFunc func(key string, err error)) {
+	c.errorFunc = errorFunc
+}
+
+// interval returns the time it takes to leak one unit.
+func (c Config) interval() time.Duration {
+	if c.limit == 0 {
+		return c.window
+	}
+
+	return c.window / time.Duration(c.limit)
+}
+
+// Result is the outcome of an input.
+type Result struct {
+	// Allowed is true, if the bucket accepted the input.
+	Allowed bool
+
+	// Level is the level of the bucket after the input.
+	Level uint
+}
+
+// Factory returns a bucket factory for ratelimiter.NewWithBucketFactory().
+func (t *Table) Factory() func(key string) bucket.Bucket {
+	return func(key string) bucket.Bucket {
+		return t.Bucket(key)
+	}
+}
+
+// Bucket returns the bucket of the given key.
+func (t *Table) Bucket(key string) *Bucket {
+	return &Bucket{
+		table: t,
+		key:   key,
+	}
+}
@@ -0,0 +1,260 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+
+package shm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/internal/backendtest"
+)
+
+func testTable(t *testing.T, path string, clock *backendtest.Clock, config Config) *Table {
+	table, err := Open(path, config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, table.Close())
+	})
+	if clock != nil {
+		table.now = clock.Now
+	}
+
+	return table
+}
+
+func TestBucket(t *testing.T) {
+	clock := backendtest.NewClock(time.Now())
+	table := testTable(t, filepath.Join(t.TempDir(), "table"), clock, CreateConfig(3, time.Second))
+
+	b := table.Bucket("a")
+	require.True(t, b.Input())
+	require.True(t, b.InputN(2))
+	require.False(t, b.Input())
+	level, limit := b.Level()
+	require.Equal(t, uint(3), level)
+	require.Equal(t, uint(3), limit)
+	require.Equal(t, 1, table.Len())
+
+	clock.Add(time.Second / 3)
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+
+	b.Refund(3)
+	level, _ = b.Level()
+	require.Zero(t, level)
+	require.Zero(t, table.Len())
+
+	level, _ = table.Bucket("missing").Level()
+	require.Zero(t, level)
+}
+
+func TestTable_Shared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table")
+	clock := backendtest.NewClock(time.Now())
+	first := testTable(t, path, clock, CreateConfig(2, time.Second))
+	second := testTable(t, path, clock, CreateConfig(2, time.Second))
+
+	require.True(t, first.Bucket("a").Input())
+	require.True(t, second.Bucket("a").Input())
+	require.False(t, first.Bucket("a").Input())
+	require.True(t, second.Bucket("b").Input())
+
+	level, _ := first.Bucket("b").Level()
+	require.Equal(t, uint(1), level)
+}
+
+func TestOpen_Mismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table")
+	testTable(t, path, nil, CreateConfig(2, time.Second))
+
+	_, err := Open(path, CreateConfig(3, time.Second))
+	require.Equal(t, ErrMismatch, err)
+
+	config := CreateConfig(2, time.Second)
+	config.SetSlots(16)
+	_, err = Open(path, config)
+	require.Equal(t, ErrMismatch, err)
+}
+
+func TestTable_Full(t *testing.T) {
+	clock := backendtest.NewClock(time.Now())
+	config := CreateConfig(1, time.Second)
+	config.SetSlots(4)
+	var errs []error
+	config.SetErrorFunc(func(key string, err error) {
+		errs = append(errs, err)
+	})
+	table := testTable(t, filepath.Join(t.TempDir(), "table"), clock, config)
+
+	for i := 0; i < 4; i++ {
+		require.True(t, table.Bucket(strconv.Itoa(i)).Input())
+	}
+
+	_, err := table.InputN("4", 1)
+	require.Equal(t, ErrFull, err)
+	require.True(t, table.Bucket("4").Input())
+	require.Equal(t, []error{ErrFull}, errs)
+
+	table.config.SetFailOpen(false)
+	require.False(t, table.Bucket("4").Input())
+
+	// The drained slots are reused.
+	clock.Add(time.Second)
+	require.True(t, table.Bucket("4").Input())
+	require.False(t, table.Bucket("4").Input())
+	require.Equal(t, 1, table.Len())
+}
+
+func TestTable_Takeover(t *testing.T) {
+	clock := backendtest.NewClock(time.Now())
+	config := CreateConfig(1, time.Second)
+	config.SetSlots(1)
+	table := testTable(t, filepath.Join(t.TempDir(), "table"), clock, config)
+	require.False(t, owns(pack(keyHash("a"), 0), keyHash("b")))
+
+	require.True(t, table.Bucket("a").Input())
+	clock.Add(time.Second)
+
+	// A process taking over the drained slot for "b" stops after tagging the
+	// state word. The slot does not belong to "a" anymore.
+	state := table.state(0)
+	atomic.StoreUint64(state, pack(keyHash("b"), int64(atomic.LoadUint64(state)&tatMask)))
+	require.Equal(t, uint(0), table.Level("a"))
+	table.Refund("a", 1)
+	require.Equal(t, 0, table.Len())
+
+	// The slot is drained, so it can be claimed again.
+	require.True(t, table.Bucket("a").Input())
+	require.False(t, table.Bucket("a").Input())
+	_, err := table.InputN("b", 1)
+	require.Equal(t, ErrFull, err)
+
+	clock.Add(time.Second)
+	require.True(t, table.Bucket("b").Input())
+	require.Equal(t, uint(0), table.Level("a"))
+	require.Equal(t, uint(1), table.Level("b"))
+}
+
+func TestTable_Concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table")
+	config := CreateConfig(100, time.Hour)
+	tables := []*Table{
+		testTable(t, path, nil, config),
+		testTable(t, path, nil, config),
+	}
+
+	var allowed int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(table *Table) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if table.Bucket("a").Input() {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}(tables[i%2])
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(100), allowed)
+}
+
+const helperEnv = "SHM_TEST_HELPER_TABLE"
+
+// TestHelperProcess is run as a separate process by TestTable_Processes.
+func TestHelperProcess(t *testing.T) {
+	path := os.Getenv(helperEnv)
+	if path == "" {
+		t.Skip("helper process")
+	}
+
+	table, err := Open(path, CreateConfig(60, time.Hour))
+	require.NoError(t, err)
+	defer table.Close()
+
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		if table.Bucket("a").Input() {
+			allowed++
+		}
+	}
+	fmt.Printf("allowed=%d\n", allowed)
+}
+
+func TestTable_Processes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table")
+
+	outputs := make([][]byte, 3)
+	errs := make([]error, 3)
+	wg := sync.WaitGroup{}
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+			cmd.Env = append(os.Environ(), helperEnv+"="+path)
+			outputs[i], errs[i] = cmd.Output()
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for i, output := range outputs {
+		require.NoError(t, errs[i])
+		var allowed int
+		for _, line := range strings.Split(string(output), "\n") {
+			if strings.HasPrefix(line, "allowed=") {
+				allowed, _ = strconv.Atoi(strings.TrimPrefix(line, "allowed="))
+			}
+		}
+		total += allowed
+	}
+
+	require.Equal(t, 60, total)
+}
+
+func TestMiddleware_Shm(t *testing.T) {
+	table := testTable(t, filepath.Join(t.TempDir(), "table"), nil, CreateConfig(1, time.Minute))
+	mw := ratelimiter.NewWithBucketFactory(ratelimiter.CreateMiddlewareConfig(1), table.Factory())
+
+	code := func() int {
+		w := httptest.NewRecorder()
+		mw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		return w.Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, code())
+	require.Equal(t, http.StatusTooManyRequests, code())
+}
@@ -0,0 +1,325 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package shm
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	// magic marks an initialized table. It is written last, when the table
+	// is created.
+	magic uint64 = 0x524c53484d000001
+
+	headerSize = 64
+	slotSize   = 16
+
+	// maxProbe is the number of slots checked for a key.
+	maxProbe = 32
+
+	// The state word of a slot holds the tag of the key in its upper bits,
+	// and the theoretical arrival time of the bucket in the lower bits.
+	tagShift = 48
+	tatMask  = 1<<tagShift - 1
+)
+
+// The header consists of the magic number, the number of slots, the limit,
+// the interval in nanoseconds, and the epoch of the timestamps in unix
+// microseconds.
+const (
+	offsetMagic    = 0
+	offsetSlots    = 8
+	offsetLimit    = 16
+	offsetInterval = 24
+	offsetEpoch    = 32
+)
+
+// Table is a bucket table in shared memory.
+type Table struct {
+	data     []byte
+	unmap    func(data []byte) error
+	config   Config
+	slots    uint64
+	interval int64
+	epoch    int64
+	now      func() time.Time
+}
+
+// tableSize returns the size of the mapped memory.
+func tableSize(slots uint) int {
+	return headerSize + int(slots)*slotSize
+}
+
+// initHeader writes the header of a new table.
+func initHeader(data []byte, config Config, epoch time.Time) {
+	binary.LittleEndian.PutUint64(data[offsetSlots:], uint64(config.slots))
+	binary.LittleEndian.PutUint64(data[offsetLimit:], uint64(config.limit))
+	binary.LittleEndian.PutUint64(data[offsetInterval:], uint64(config.interval()))
+	binary.LittleEndian.PutUint64(data[offsetEpoch:], uint64(epoch.UnixMicro()))
+	atomic.StoreUint64(word(data, offsetMagic), magic)
+}
+
+// initialized reports whether the header of the table is written.
+func initialized(data []byte) bool {
+	return atomic.LoadUint64(word(data, offsetMagic)) == magic
+}
+
+// newTable creates a table on an initialized memory region.
+func newTable(data []byte, unmap func(data []byte) error, config Config) (*Table, error) {
+	if binary.LittleEndian.Uint64(data[offsetSlots:]) != uint64(config.slots) ||
+		binary.LittleEndian.Uint64(data[offsetLimit:]) != uint64(config.limit) ||
+		binary.LittleEndian.Uint64(data[offsetInterval:]) != uint64(config.interval()) {
+		return nil, ErrMismatch
+	}
+
+	interval := int64(config.interval() / time.Microsecond)
+	if interval < 1 {
+		interval = 1
+	}
+
+	return &Table{
+		data:     data,
+		unmap:    unmap,
+		config:   config,
+		slots:    uint64(config.slots),
+		interval: interval,
+		epoch:    int64(binary.LittleEndian.Uint64(data[offsetEpoch:])),
+		now:      time.Now,
+	}, nil
+}
+
+// Close unmaps the table. The buckets of the table are not usable anymore.
+func (t *Table) Close() error {
+	return t.unmap(t.data)
+}
+
+// InputN fills the bucket of the given key with n units.
+func (t *Table) InputN(key string, n uint) (Result, error) {
+	now := t.timestamp()
+	burst := int64(t.config.limit) * t.interval
+	var result Result
+	_, err := t.update(keyHash(key), now, true, func(tat int64) (int64, bool) {
+		next := tat + int64(n)*t.interval
+		if next-now > burst {
+			result = Result{Level: t.level(tat, now)}
+			return 0, false
+		}
+
+		result = Result{
+			Allowed: true,
+			Level:   t.level(next, now),
+		}
+		return next, true
+	})
+
+	return result, err
+}
+
+// Refund gives back n units to the bucket of the given key.
+func (t *Table) Refund(key string, n uint) {
+	now := t.timestamp()
+	_, _ = t.update(keyHash(key), now, false, func(tat int64) (int64, bool) {
+		next := tat - int64(n)*t.interval
+		if next < now {
+			next = now
+		}
+
+		return next, true
+	})
+}
+
+// Level returns the level of the bucket of the given key.
+func (t *Table) Level(key string) uint {
+	now := t.timestamp()
+	var level uint
+	_, _ = t.update(keyHash(key), now, false, func(tat int64) (int64, bool) {
+		level = t.level(tat, now)
+		return 0, false
+	})
+
+	return level
+}
+
+// update calls f with the theoretical arrival time of the key's bucket, and
+// stores the returned value if f reports so.
+//
+// The state word is only changed while it carries the tag of the key. If the
+// slot is taken over by another key in the meantime, it is looked up again.
+// It returns false if the key has no slot and claim is false.
+func (t *Table) update(hash uint64, now int64, claim bool, f func(tat int64) (int64, bool)) (bool, error) {
+	for {
+		index, err := t.slot(hash, now, claim)
+		if index < 0 {
+			return false, err
+		}
+
+		state := t.state(uint64(index))
+		for {
+			old := atomic.LoadUint64(state)
+			if !owns(old, hash) {
+				break
+			}
+
+			next, store := f(t.tat(old, now))
+			if !store || atomic.CompareAndSwapUint64(state, old, pack(hash, next)) {
+				return true, nil
+			}
+		}
+	}
+}
+
+// Len returns the number of non-empty buckets.
+func (t *Table) Len() int {
+	now := t.timestamp()
+	count := 0
+	for i := uint64(0); i < t.slots; i++ {
+		if atomic.LoadUint64(t.state(i))&tatMask > uint64(now) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// slot returns the index of the key's slot, or -1 if the key has no slot and
+// claim is false.
+//
+// The slots are probed linearly from the position of the hash. If the key is
+// not found, the first empty slot is claimed, or if there is none, the first
+// drained slot is taken over.
+//
+// A slot belongs to a key when both its hash word and the tag in its state word
+// match the key. A slot is claimed by tagging its state first, and then
+// setting its hash, so the processes still updating the bucket of the previous
+// key fail on the tag, and a process dying in between leaves behind a drained
+// slot that belongs to no key.
+func (t *Table) slot(hash uint64, now int64, claim bool) (int, error) {
+	start := hash % t.slots
+
+	for {
+		free := -1
+		drained := -1
+		for i := uint64(0); i < maxProbe && i < t.slots; i++ {
+			index := (start + i) % t.slots
+			h := atomic.LoadUint64(t.hash(index))
+			state := atomic.LoadUint64(t.state(index))
+			if h == hash && owns(state, hash) {
+				return int(index), nil
+			}
+			if h == 0 && free < 0 {
+				free = int(index)
+			}
+			if h != 0 && drained < 0 && int64(state&tatMask) <= now {
+				drained = int(index)
+			}
+		}
+
+		if !claim {
+			return -1, nil
+		}
+
+		index := free
+		if index < 0 {
+			index = drained
+		}
+		if index < 0 {
+			return -1, ErrFull
+		}
+
+		// A drained bucket is equivalent to an empty one, so the slot can be
+		// reused without resetting the theoretical arrival time.
+		h := atomic.LoadUint64(t.hash(uint64(index)))
+		old := atomic.LoadUint64(t.state(uint64(index)))
+		if int64(old&tatMask) <= now &&
+			atomic.CompareAndSwapUint64(t.state(uint64(index)), old, pack(hash, int64(old&tatMask))) &&
+			atomic.CompareAndSwapUint64(t.hash(uint64(index)), h, hash) {
+			return index, nil
+		}
+
+		// Another process claimed the slot in the meantime, look again.
+	}
+}
+
+// tat returns the theoretical arrival time of the next unit, which is never
+// earlier than now.
+func (t *Table) tat(state uint64, now int64) int64 {
+	if tat := int64(state & tatMask); tat > now {
+		return tat
+	}
+
+	return now
+}
+
+// level converts the theoretical arrival time to the level of the bucket.
+func (t *Table) level(tat, now int64) uint {
+	if tat <= now || t.interval <= 0 {
+		return 0
+	}
+
+	return uint((tat - now + t.interval - 1) / t.interval)
+}
+
+// timestamp returns the current time in microseconds since the epoch of the
+// table.
+func (t *Table) timestamp() int64 {
+	return t.now().UnixMicro() - t.epoch
+}
+
+func (t *Table) hash(index uint64) *uint64 {
+	return word(t.data, headerSize+int(index)*slotSize)
+}
+
+func (t *Table) state(index uint64) *uint64 {
+	return word(t.data, headerSize+int(index)*slotSize+8)
+}
+
+// word returns a pointer to an aligned word of the mapped memory.
+func word(data []byte, offset int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&data[offset]))
+}
+
+// pack returns the state word of a bucket of the key.
+func pack(hash uint64, tat int64) uint64 {
+	return tag(hash)<<tagShift | uint64(tat)&tatMask
+}
+
+// owns reports whether the state word carries the tag of the key.
+func owns(state, hash uint64) bool {
+	return state>>tagShift == tag(hash)
+}
+
+// tag returns the tag of a key. The upper bits of FNV hashes of short keys
+// are often the same, so the bits of the hash are mixed first.
+func tag(hash uint64) uint64 {
+	return hash * 0x9e3779b97f4a7c15 >> tagShift
+}
+
+// keyHash returns the hash of a key. Zero marks the empty slots, so it is
+// never returned.
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	if sum := h.Sum64(); sum != 0 {
+		return sum
+	}
+
+	return 1
+}
@@ -0,0 +1,112 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect describes the differences between the supported databases.
+type Dialect struct {
+	name        string
+	placeholder func(n int) string
+	greatest    string
+}
+
+var (
+	// SQLite is the dialect of SQLite 3.35 or newer.
+	SQLite = Dialect{
+		name: "sqlite",
+		placeholder: func(n int) string {
+			return "?" + strconv.Itoa(n)
+		},
+		greatest: "MAX",
+	}
+
+	// PostgreSQL is the dialect of PostgreSQL 9.5 or newer.
+	PostgreSQL = Dialect{
+		name: "postgres",
+		placeholder: func(n int) string {
+			return "$" + strconv.Itoa(n)
+		},
+		greatest: "GREATEST",
+	}
+)
+
+func (d Dialect) String() string {
+	return d.name
+}
+
+// statements are the SQL statements of a table.
+type statements struct {
+	createTable string
+	createIndex string
+
+	// upsert adds a delta to a counter, and returns the new value. The
+	// parameters are the key, the window start, the value of a new counter,
+	// the expiry and the delta.
+	upsert string
+
+	// conditionalUpsert only adds the units to a counter, if the result does
+	// not exceed the limit. It does not return a row otherwise. The
+	// parameters are the key, the window start, the units, the expiry and the
+	// limit.
+	conditionalUpsert string
+
+	// selectUnits returns the value of a counter. The parameters are the key
+	// and the window start.
+	selectUnits string
+
+	// deleteExpired deletes the counters expired before the given time.
+	deleteExpired string
+}
+
+// statements expands the statements of the dialect for the given table.
+//
+// The statements are written with $n placeholders, which are replaced with
+// the placeholders of the dialect.
+func (d Dialect) statements(table string) statements {
+	expand := func(statement string) string {
+		statement = strings.ReplaceAll(statement, "{table}", table)
+		statement = strings.ReplaceAll(statement, "{greatest}", d.greatest)
+		for i := 5; i > 0; i-- {
+			statement = strings.ReplaceAll(statement, "$"+strconv.Itoa(i), d.placeholder(i))
+		}
+		return statement
+	}
+
+	return statements{
+		createTable: expand(`CREATE TABLE IF NOT EXISTS {table} (
+	bucket_key TEXT NOT NULL,
+	window_start BIGINT NOT NULL,
+	units BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	PRIMARY KEY (bucket_key, window_start)
+)`),
+		createIndex: expand(`CREATE INDEX IF NOT EXISTS {table}_expires_at ON {table} (expires_at)`),
+		upsert: expand(`INSERT INTO {table} (bucket_key, window_start, units, expires_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (bucket_key, window_start) DO UPDATE SET units = {greatest}(0, {table}.units + $5)
+RETURNING units`),
+		conditionalUpsert: expand(`INSERT INTO {table} (bucket_key, window_start, units, expires_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (bucket_key, window_start) DO UPDATE SET units = {table}.units + excluded.units
+WHERE {table}.units + excluded.units <= $5
+RETURNING units`),
+		selectUnits:   expand(`SELECT units FROM {table} WHERE bucket_key = $1 AND window_start = $2`),
+		deleteExpired: expand(`DELETE FROM {table} WHERE expires_at <= $1`),
+	}
+}
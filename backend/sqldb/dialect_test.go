@@ -0,0 +1,35 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialect_Statements(t *testing.T) {
+	postgres := PostgreSQL.statements("quotas")
+	require.Equal(t, "SELECT units FROM quotas WHERE bucket_key = $1 AND window_start = $2", postgres.selectUnits)
+	require.Contains(t, postgres.upsert, "GREATEST(0, quotas.units + $5)")
+
+	sqlite := SQLite.statements("quotas")
+	require.Equal(t, "SELECT units FROM quotas WHERE bucket_key = ?1 AND window_start = ?2", sqlite.selectUnits)
+	require.Contains(t, sqlite.upsert, "MAX(0, quotas.units + ?5)")
+	require.False(t, strings.Contains(sqlite.conditionalUpsert, "$"))
+}
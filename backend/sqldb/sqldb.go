@@ -0,0 +1,477 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package sqldb is a durable bucket backend on top of database/sql.
+//
+// The buckets are window counters stored in a table, which makes them
+// suitable for long windows, like monthly quotas:
+//
+//	config := sqldb.CreateConfig(10000, 0)
+//	config.SetWindowFunc(sqldb.CalendarMonth(time.UTC))
+//	config.SetFlushInterval(time.Second)
+//	backend := sqldb.New(db, sqldb.PostgreSQL, config)
+//	if err := backend.CreateTable(ctx); err != nil {
+//		return err
+//	}
+//	go backend.Start()
+//	defer backend.Stop()
+//
+//	middleware := ratelimiter.NewWithBucketFactory(middlewareConfig, backend.Factory())
+//
+// By default every input is an atomic upsert. With a flush interval, the
+// inputs are counted locally, and written in batches, which limits the write
+// load at the cost of accuracy: the increments of the other instances are
+// only seen after the next flush.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tamasd/ratelimiter/bucket"
+	"github.com/tamasd/ratelimiter/internal/remote"
+)
+
+// WindowFunc returns the start and the end of the window that contains t.
+type WindowFunc func(t time.Time) (start, end time.Time)
+
+// FixedWindow returns windows with the given size.
+func FixedWindow(size time.Duration) WindowFunc {
+	return func(t time.Time) (time.Time, time.Time) {
+		start := t.Truncate(size)
+		return start, start.Add(size)
+	}
+}
+
+// CalendarMonth returns the calendar months in the given location.
+func CalendarMonth(loc *time.Location) WindowFunc {
+	return func(t time.Time) (time.Time, time.Time) {
+		t = t.In(loc)
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+}
+
+// Config holds the configuration of the Backend type.
+type Config struct {
+	limit         uint
+	window        WindowFunc
+	table         string
+	flushInterval time.Duration
+	timeout       time.Duration
+	failOpen      bool
+	errorFunc     remote.ErrorFunc
+}
+
+// CreateConfig creates a configuration that accepts limit units per window.
+//
+// The windows should be at least a second long, as the counters are stored by
+// the unix time of the start of their window. By default every input is
+// written through to the "ratelimiter_counters" table, the queries time out
+// after a second, and the inputs are allowed while the database cannot be
+// queried.
+func CreateConfig(limit uint, window time.Duration) Config {
+	return Config{
+		limit:    limit,
+		window:   FixedWindow(window),
+		table:    "ratelimiter_counters",
+		timeout:  time.Second,
+		failOpen: true,
+	}
+}
+
+// SetWindowFunc sets the function that determines the windows, e.g.
+// CalendarMonth().
+func (c *Config) SetWindowFunc(window WindowFunc) {
+	c.window = window
+}
+
+// SetTable sets the name of the table.
+func (c *Config) SetTable(table string) {
+	c.table = table
+}
+
+// SetFlushInterval turns on batching: the inputs are counted locally, and
+// written to the database in every interval by Start().
+func (c *Config) SetFlushInterval(interval time.Duration) {
+	c.flushInterval = interval
+}
+
+// SetTimeout sets the deadline of the queries of an input, and of the
+// transaction of a flush.
+func (c *Config) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SetFailOpen sets whether the inputs are allowed when their counter cannot be
+// loaded or updated.
+func (c *Config) SetFailOpen(failOpen bool) {
+	c.failOpen = failOpen
+}
+
+// SetErrorFunc sets a function that receives the errors of the queries, with
+// the key of the counter, or with an empty key for Flush() and Cleanup().
+func (c *Config) SetErrorFunc(errorFunc func(key string, err error)) {
+	c.errorFunc = errorFunc
+}
+
+// Result is the outcome of an input.
+type Result struct {
+	// Allowed is true, if the bucket accepted the input.
+	Allowed bool
+
+	// Level is the number of units counted in the window after the input.
+	Level uint
+}
+
+type counterKey struct {
+	key   string
+	start int64
+}
+
+// counter is the local state of a counter in batching mode.
+type counter struct {
+	// stored is the value of the counter in the database at the last flush.
+	stored int64
+
+	// pending is the number of units not flushed yet.
+	pending int64
+
+	// used is true, if the counter was used since the last flush.
+	used bool
+
+	expires int64
+}
+
+// Backend stores buckets in a database.
+type Backend struct {
+	db         *sql.DB
+	config     Config
+	statements statements
+	now        func() time.Time
+
+	mtx      sync.Mutex
+	counters map[counterKey]*counter
+
+	quitch chan struct{}
+	once   sync.Once
+}
+
+// New creates a backend.
+func New(db *sql.DB, dialect Dialect, config Config) *Backend {
+	return &Backend{
+		db:         db,
+		config:     config,
+		statements: dialect.statements(config.table),
+		now:        time.Now,
+		counters:   make(map[counterKey]*counter),
+		quitch:     make(chan struct{}),
+	}
+}
+
+// CreateTable creates the table of the counters, if it does not exist.
+func (b *Backend) CreateTable(ctx context.Context) error {
+	if _, err := b.db.ExecContext(ctx, b.statements.createTable); err != nil {
+		return err
+	}
+
+	_, err := b.db.ExecContext(ctx, b.statements.createIndex)
+	return err
+}
+
+// Bucket returns the bucket of the given key.
+func (b *Backend) Bucket(key string) *Bucket {
+	return &Bucket{
+		backend: b,
+		key:     key,
+	}
+}
+
+// Factory returns a bucket factory for ratelimiter.NewWithBucketFactory().
+func (b *Backend) Factory() func(key string) bucket.Bucket {
+	return func(key string) bucket.Bucket {
+		return b.Bucket(key)
+	}
+}
+
+// InputN counts n units in the window of the given key.
+func (b *Backend) InputN(ctx context.Context, key string, n uint) (Result, error) {
+	start, end := b.config.window(b.now())
+	ck := counterKey{
+		key:   key,
+		start: start.Unix(),
+	}
+
+	if b.config.flushInterval <= 0 {
+		return b.inputThrough(ctx, ck, end.Unix(), n)
+	}
+
+	return b.inputBatched(ctx, ck, end.Unix(), n)
+}
+
+// Refund removes n units from the current window of the given key.
+func (b *Backend) Refund(ctx context.Context, key string, n uint) error {
+	start, end := b.config.window(b.now())
+	ck := counterKey{
+		key:   key,
+		start: start.Unix(),
+	}
+
+	if b.config.flushInterval > 0 {
+		b.mtx.Lock()
+		c, ok := b.counters[ck]
+		if ok {
+			c.pending -= int64(n)
+		}
+		b.mtx.Unlock()
+		if ok {
+			return nil
+		}
+	}
+
+	var units int64
+	return b.db.QueryRowContext(ctx, b.statements.upsert, key, ck.start, 0, end.Unix(), -int64(n)).Scan(&units)
+}
+
+// inputThrough adds the units to the counter with a conditional upsert.
+func (b *Backend) inputThrough(ctx context.Context, ck counterKey, expires int64, n uint) (Result, error) {
+	if n <= b.config.limit {
+		var units int64
+		err := b.db.QueryRowContext(ctx, b.statements.conditionalUpsert, ck.key, ck.start, n, expires, b.config.limit).Scan(&units)
+		if err == nil {
+			return Result{
+				Allowed: true,
+				Level:   uint(units),
+			}, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return Result{}, err
+		}
+	}
+
+	units, err := b.load(ctx, ck)
+	return Result{Level: uint(units)}, err
+}
+
+// inputBatched counts the units locally.
+func (b *Backend) inputBatched(ctx context.Context, ck counterKey, expires int64, n uint) (Result, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	c, ok := b.counters[ck]
+	if !ok {
+		// The lock is not held while the database is queried, so the counter
+		// is looked up again afterwards: another request might have created
+		// it in the meantime.
+		b.mtx.Unlock()
+		stored, err := b.load(ctx, ck)
+		b.mtx.Lock()
+		if err != nil {
+			return Result{}, err
+		}
+
+		if c, ok = b.counters[ck]; !ok {
+			c = &counter{
+				stored:  stored,
+				expires: expires,
+			}
+			b.counters[ck] = c
+		}
+	}
+
+	c.used = true
+	level := c.stored + c.pending
+	if level+int64(n) > int64(b.config.limit) {
+		return Result{Level: uint(level)}, nil
+	}
+
+	c.pending += int64(n)
+	return Result{
+		Allowed: true,
+		Level:   uint(level + int64(n)),
+	}, nil
+}
+
+// load returns the value of a counter from the database.
+func (b *Backend) load(ctx context.Context, ck counterKey) (int64, error) {
+	var units int64
+	err := b.db.QueryRowContext(ctx, b.statements.selectUnits, ck.key, ck.start).Scan(&units)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+
+	return units, err
+}
+
+// Flush writes the pending units to the database in a single transaction, and
+// refreshes the counters used since the last flush.
+//
+// The counters not used since the last flush are dropped from the memory.
+func (b *Backend) Flush(ctx context.Context) error {
+	type update struct {
+		ck      counterKey
+		c       *counter
+		pending int64
+	}
+
+	b.mtx.Lock()
+	var updates []update
+	for ck, c := range b.counters {
+		if !c.used && c.pending == 0 {
+			delete(b.counters, ck)
+			continue
+		}
+
+		updates = append(updates, update{
+			ck:      ck,
+			c:       c,
+			pending: c.pending,
+		})
+		c.pending = 0
+		c.used = false
+	}
+	b.mtx.Unlock()
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	stored := make([]int64, len(updates))
+	err := b.transaction(ctx, func(tx *sql.Tx) error {
+		upsert, err := tx.PrepareContext(ctx, b.statements.upsert)
+		if err != nil {
+			return err
+		}
+		defer upsert.Close()
+		load, err := tx.PrepareContext(ctx, b.statements.selectUnits)
+		if err != nil {
+			return err
+		}
+		defer load.Close()
+
+		for i, u := range updates {
+			if u.pending == 0 {
+				err = load.QueryRowContext(ctx, u.ck.key, u.ck.start).Scan(&stored[i])
+				if errors.Is(err, sql.ErrNoRows) {
+					err = nil
+				}
+			} else {
+				initial := u.pending
+				if initial < 0 {
+					initial = 0
+				}
+				err = upsert.QueryRowContext(ctx, u.ck.key, u.ck.start, initial, u.c.expires, u.pending).Scan(&stored[i])
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for i, u := range updates {
+		if err != nil {
+			// Keep the units for the next flush.
+			u.c.pending += u.pending
+			u.c.used = true
+			b.counters[u.ck] = u.c
+			continue
+		}
+		u.c.stored = stored[i]
+	}
+
+	return err
+}
+
+// Cleanup deletes the expired counters from the database.
+func (b *Backend) Cleanup(ctx context.Context) error {
+	_, err := b.db.ExecContext(ctx, b.statements.deleteExpired, b.now().Unix())
+	return err
+}
+
+// Start deletes the expired counters periodically, until Stop() is called.
+//
+// With batching turned on, the counters are flushed and the expired ones are
+// deleted in every flush interval. Otherwise the expired counters are deleted
+// once in every window.
+func (b *Backend) Start() {
+	ticker := time.NewTicker(b.cleanupInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.report(b.Flush)
+			b.report(b.Cleanup)
+		case <-b.quitch:
+			return
+		}
+	}
+}
+
+// Stop stops the flushing loop, and flushes the pending units.
+func (b *Backend) Stop() {
+	b.once.Do(func() {
+		close(b.quitch)
+	})
+
+	b.report(b.Flush)
+}
+
+// cleanupInterval returns the time between two runs of the loop of Start().
+func (b *Backend) cleanupInterval() time.Duration {
+	if b.config.flushInterval > 0 {
+		return b.config.flushInterval
+	}
+
+	start, end := b.config.window(b.now())
+	if interval := end.Sub(start); interval > 0 {
+		return interval
+	}
+
+	return time.Second
+}
+
+// report calls f with a timeout, and reports its error.
+func (b *Backend) report(f func(ctx context.Context) error) {
+	ctx, cancel := remote.Context(b.config.timeout)
+	defer cancel()
+
+	if err := f(ctx); err != nil {
+		b.config.errorFunc.Report("", err)
+	}
+}
+
+func (b *Backend) transaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
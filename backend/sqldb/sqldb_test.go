@@ -0,0 +1,207 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/internal/backendtest"
+	_ "modernc.org/sqlite"
+)
+
+func testDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "counters.db"))
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	return db
+}
+
+func testBackend(t *testing.T, db *sql.DB, clock *backendtest.Clock, config Config) *Backend {
+	backend := New(db, SQLite, config)
+	backend.now = clock.Now
+	require.NoError(t, backend.CreateTable(context.Background()))
+
+	return backend
+}
+
+func newTestClock() *backendtest.Clock {
+	return backendtest.NewClock(time.Date(2020, time.March, 10, 12, 0, 0, 0, time.UTC))
+}
+
+func testUnits(t *testing.T, db *sql.DB) int64 {
+	var units sql.NullInt64
+	require.NoError(t, db.QueryRow("SELECT SUM(units) FROM ratelimiter_counters").Scan(&units))
+	return units.Int64
+}
+
+func TestCalendarMonth(t *testing.T) {
+	start, end := CalendarMonth(time.UTC)(time.Date(2020, time.December, 31, 23, 0, 0, 0, time.UTC))
+	require.Equal(t, time.Date(2020, time.December, 1, 0, 0, 0, 0, time.UTC), start)
+	require.Equal(t, time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC), end)
+}
+
+func TestBucket_WriteThrough(t *testing.T) {
+	db := testDB(t)
+	clock := newTestClock()
+	backend := testBackend(t, db, clock, CreateConfig(3, time.Hour))
+
+	b := backend.Bucket("a")
+	require.True(t, b.InputN(2))
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+	require.False(t, b.InputN(4))
+	level, limit := b.Level()
+	require.Equal(t, uint(3), level)
+	require.Equal(t, uint(3), limit)
+
+	require.True(t, backend.Bucket("b").Input())
+	require.Equal(t, int64(4), testUnits(t, db))
+
+	b.Refund(1)
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+
+	clock.Add(time.Hour)
+	level, _ = b.Level()
+	require.Zero(t, level)
+	require.True(t, b.InputN(3))
+
+	require.NoError(t, backend.Cleanup(context.Background()))
+	require.Equal(t, int64(3), testUnits(t, db))
+}
+
+func TestBackend_Start_WriteThrough(t *testing.T) {
+	db := testDB(t)
+	clock := newTestClock()
+	backend := testBackend(t, db, clock, CreateConfig(3, time.Second))
+	require.Equal(t, time.Second, backend.cleanupInterval())
+
+	require.True(t, backend.Bucket("a").Input())
+	require.Equal(t, int64(1), testUnits(t, db))
+
+	clock.Add(time.Minute)
+	go backend.Start()
+	t.Cleanup(backend.Stop)
+	require.Eventually(t, func() bool {
+		return testUnits(t, db) == 0
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestBucket_CalendarMonth(t *testing.T) {
+	config := CreateConfig(2, 0)
+	(&config).SetWindowFunc(CalendarMonth(time.UTC))
+	clock := newTestClock()
+	backend := testBackend(t, testDB(t), clock, config)
+
+	b := backend.Bucket("a")
+	require.True(t, b.InputN(2))
+
+	clock.Add(24 * time.Hour * 20)
+	require.False(t, b.Input())
+
+	clock.Add(24 * time.Hour * 2)
+	require.True(t, b.Input())
+}
+
+func TestBucket_Batched(t *testing.T) {
+	db := testDB(t)
+	clock := newTestClock()
+	config := CreateConfig(5, time.Hour)
+	(&config).SetFlushInterval(time.Minute)
+	replicas := []*Backend{
+		testBackend(t, db, clock, config),
+		testBackend(t, db, clock, config),
+	}
+	ctx := context.Background()
+
+	require.True(t, replicas[0].Bucket("a").InputN(3))
+	require.True(t, replicas[1].Bucket("a").InputN(2))
+	require.Zero(t, testUnits(t, db))
+
+	require.NoError(t, replicas[0].Flush(ctx))
+	require.NoError(t, replicas[1].Flush(ctx))
+	require.Equal(t, int64(5), testUnits(t, db))
+
+	// The first replica only sees the units of the other one after a flush.
+	require.NoError(t, replicas[0].Flush(ctx))
+	require.False(t, replicas[0].Bucket("a").Input())
+	require.False(t, replicas[1].Bucket("a").Input())
+
+	replicas[1].Bucket("a").Refund(2)
+	replicas[1].Stop()
+	require.Equal(t, int64(3), testUnits(t, db))
+}
+
+func TestBackend_FlushError(t *testing.T) {
+	db := testDB(t)
+	config := CreateConfig(5, time.Hour)
+	(&config).SetFlushInterval(time.Minute)
+	backend := testBackend(t, db, newTestClock(), config)
+	ctx := context.Background()
+
+	require.True(t, backend.Bucket("a").InputN(2))
+	_, err := db.Exec("DROP TABLE ratelimiter_counters")
+	require.NoError(t, err)
+	require.Error(t, backend.Flush(ctx))
+
+	require.NoError(t, backend.CreateTable(ctx))
+	require.NoError(t, backend.Flush(ctx))
+	require.Equal(t, int64(2), testUnits(t, db))
+}
+
+func TestBucket_Unavailable(t *testing.T) {
+	var errs []string
+	config := CreateConfig(1, time.Hour)
+	(&config).SetErrorFunc(func(key string, err error) {
+		errs = append(errs, key)
+	})
+	db := testDB(t)
+	backend := testBackend(t, db, newTestClock(), config)
+	require.NoError(t, db.Close())
+
+	require.True(t, backend.Bucket("a").Input())
+
+	backend.config.failOpen = false
+	require.False(t, backend.Bucket("b").Input())
+	require.Equal(t, []string{"a", "b"}, errs)
+}
+
+func TestMiddleware_SharedLimit(t *testing.T) {
+	backend := testBackend(t, testDB(t), newTestClock(), CreateConfig(2, time.Hour))
+	config := ratelimiter.CreateMiddlewareConfig(2)
+
+	replicas := []*ratelimiter.Middleware{
+		ratelimiter.NewWithBucketFactory(config, backend.Factory()),
+		ratelimiter.NewWithBucketFactory(config, backend.Factory()),
+	}
+
+	require.Equal(t, http.StatusOK, backendtest.ResponseCode(replicas[0]))
+	require.Equal(t, http.StatusOK, backendtest.ResponseCode(replicas[1]))
+	require.Equal(t, http.StatusTooManyRequests, backendtest.ResponseCode(replicas[0]))
+	require.Equal(t, http.StatusTooManyRequests, backendtest.ResponseCode(replicas[1]))
+}
@@ -0,0 +1,177 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/tamasd/ratelimiter/internal/penalty"
+)
+
+// BruteForceConfig holds the configuration for the BruteForce type.
+type BruteForceConfig struct {
+	attempts   uint
+	window     time.Duration
+	lockout    time.Duration
+	maxLockout time.Duration
+	keyFunc    KeyFunc
+	failure    func(status int) bool
+}
+
+// CreateBruteForceConfig creates the configuration for the brute-force
+// protection.
+//
+// The attempts parameter is the number of failed attempts allowed in the
+// window. By default the attempts are counted for the "username" form value
+// and the client IP together, and a 401 Unauthorized response counts as a
+// failed attempt. A key running out of attempts is locked out for the length
+// of the window, and every further lockout is twice as long, up to a day.
+func CreateBruteForceConfig(attempts uint, window time.Duration) BruteForceConfig {
+	return BruteForceConfig{
+		attempts:   attempts,
+		window:     window,
+		lockout:    window,
+		maxLockout: 24 * time.Hour,
+		keyFunc:    CombineKeys(FormValueKey("username"), ClientIP),
+		failure: func(status int) bool {
+			return status == http.StatusUnauthorized
+		},
+	}
+}
+
+// SetKeyFunc sets how the attempts are grouped.
+func (bc *BruteForceConfig) SetKeyFunc(keyFunc KeyFunc) {
+	bc.keyFunc = keyFunc
+}
+
+// SetFailure sets which response status codes count as failed attempts.
+func (bc *BruteForceConfig) SetFailure(failure func(status int) bool) {
+	bc.failure = failure
+}
+
+// SetLockout sets the duration of the first and the longest lockout.
+func (bc *BruteForceConfig) SetLockout(lockout, maxLockout time.Duration) {
+	bc.lockout = lockout
+	bc.maxLockout = maxLockout
+}
+
+// BruteForce protects login and password reset endpoints from brute-force
+// attacks.
+//
+// Unlike the Middleware, only the failed attempts are counted. When a key
+// runs out of attempts, it is locked out, and all of its requests are
+// rejected with 429 Too Many Requests until the lockout is over.
+//
+// When using this middleware, make sure that you call Start() before starting
+// the http server.
+type BruteForce struct {
+	config     BruteForceConfig
+	middleware *Middleware
+	lockouts   *penalty.Box
+}
+
+// NewBruteForce creates a brute-force protection middleware.
+func NewBruteForce(config BruteForceConfig) *BruteForce {
+	bf := &BruteForce{
+		config:   config,
+		lockouts: penalty.New(config.lockout, config.maxLockout),
+	}
+
+	middlewareConfig := CreateMiddlewareConfig(config.attempts)
+	middlewareConfig.SetWindow(config.window)
+	middlewareConfig.SetKeyFunc(config.keyFunc)
+	middlewareConfig.SetChargeFunc(bf.charge)
+	bf.middleware = New(middlewareConfig)
+
+	return bf
+}
+
+// charge only counts the failed attempts, and locks out the key that used
+// its last attempt.
+func (bf *BruteForce) charge(r *http.Request, outcome Outcome) uint {
+	if !bf.config.failure(outcome.Status) {
+		return 0
+	}
+
+	if decision, ok := GetDecision(r); ok && decision.Remaining == 0 {
+		bf.lockouts.Ban(decision.Key)
+	}
+
+	return outcome.Cost
+}
+
+// ServeHTTP implements negroni.Handler interface.
+func (bf *BruteForce) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	bf.serve(w, r, next)
+}
+
+// Handler wraps a http.Handler with the middleware.
+func (bf *BruteForce) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bf.serve(w, r, next)
+	})
+}
+
+func (bf *BruteForce) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	key := bf.config.keyFunc(r)
+	if remaining, banned := bf.lockouts.Banned(key); banned {
+		reject(w, remaining)
+		return
+	}
+
+	bf.middleware.serve(w, r, next)
+}
+
+// Reset forgets the failed attempts and the lockouts of a key.
+//
+// Call this after a successful login. The key of the request can be found in
+// the Decision attached to the request context.
+func (bf *BruteForce) Reset(key string) {
+	bf.middleware.Reset(key)
+	bf.lockouts.Forget(key)
+}
+
+// Start starts the middleware's "leak" logic.
+//
+// The expired lockouts are removed every lockout duration, or every second if
+// the lockout duration is not positive.
+func (bf *BruteForce) Start() {
+	go bf.middleware.Start()
+
+	interval := bf.config.lockout
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			bf.lockouts.Cleanup()
+		case <-bf.middleware.quitch:
+			return
+		}
+	}
+}
+
+// Stop stops the middleware's internal loop.
+func (bf *BruteForce) Stop() {
+	bf.middleware.Stop()
+}
@@ -0,0 +1,120 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func createLoginHandler(bf *ratelimiter.BruteForce) http.Handler {
+	return bf.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		decision, _ := ratelimiter.GetDecision(r)
+		bf.Reset(decision.Key)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func testLogin(handler http.Handler, username, password string) int {
+	form := url.Values{"username": {username}, "password": {password}}
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w.Result().StatusCode
+}
+
+func TestBruteForce(t *testing.T) {
+	handler := createLoginHandler(ratelimiter.NewBruteForce(ratelimiter.CreateBruteForceConfig(3, time.Minute)))
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusUnauthorized, testLogin(handler, "alice", "guess"))
+	}
+	require.Equal(t, http.StatusTooManyRequests, testLogin(handler, "alice", "secret"))
+	require.Equal(t, http.StatusOK, testLogin(handler, "bob", "secret"))
+}
+
+func TestBruteForce_SuccessNotCounted(t *testing.T) {
+	handler := createLoginHandler(ratelimiter.NewBruteForce(ratelimiter.CreateBruteForceConfig(2, time.Minute)))
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, http.StatusOK, testLogin(handler, "alice", "secret"))
+	}
+}
+
+func TestBruteForce_Reset(t *testing.T) {
+	handler := createLoginHandler(ratelimiter.NewBruteForce(ratelimiter.CreateBruteForceConfig(2, time.Minute)))
+
+	require.Equal(t, http.StatusUnauthorized, testLogin(handler, "alice", "guess"))
+	require.Equal(t, http.StatusOK, testLogin(handler, "alice", "secret"))
+	require.Equal(t, http.StatusUnauthorized, testLogin(handler, "alice", "guess"))
+	require.Equal(t, http.StatusUnauthorized, testLogin(handler, "alice", "guess"))
+	require.Equal(t, http.StatusTooManyRequests, testLogin(handler, "alice", "guess"))
+}
+
+func TestBruteForce_EscalatingLockout(t *testing.T) {
+	config := ratelimiter.CreateBruteForceConfig(1, time.Millisecond*10)
+	(&config).SetLockout(time.Millisecond*50, time.Second)
+	bf := ratelimiter.NewBruteForce(config)
+	go bf.Start()
+	t.Cleanup(bf.Stop)
+	handler := createLoginHandler(bf)
+
+	require.Equal(t, http.StatusUnauthorized, testLogin(handler, "alice", "guess"))
+	require.Equal(t, http.StatusTooManyRequests, testLogin(handler, "alice", "guess"))
+
+	<-time.After(time.Millisecond * 70)
+	require.Equal(t, http.StatusUnauthorized, testLogin(handler, "alice", "guess"))
+
+	// The second lockout is twice as long as the first one.
+	<-time.After(time.Millisecond * 70)
+	require.Equal(t, http.StatusTooManyRequests, testLogin(handler, "alice", "guess"))
+	<-time.After(time.Millisecond * 50)
+	require.Equal(t, http.StatusUnauthorized, testLogin(handler, "alice", "guess"))
+}
+
+func TestBruteForce_Start_ZeroLockout(t *testing.T) {
+	config := ratelimiter.CreateBruteForceConfig(3, time.Minute)
+	(&config).SetLockout(0, 0)
+	bf := ratelimiter.NewBruteForce(config)
+
+	done := make(chan struct{})
+	go func() {
+		bf.Start()
+		close(done)
+	}()
+	bf.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the cleanup loop does not stop")
+	}
+}
@@ -0,0 +1,113 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package bucket contains the public interface of the rate limiter buckets,
+// and the implementations shipped with the module.
+//
+// Custom algorithms and backends can be plugged into the middleware by
+// implementing the Bucket interface, and passing the bucket to
+// ratelimiter.NewWithBucket() or ratelimiter.NewWithBucketFactory().
+package bucket
+
+import (
+	"time"
+
+	"github.com/tamasd/ratelimiter/internal/bucket"
+	"github.com/tamasd/ratelimiter/internal/bucket/channel"
+	"github.com/tamasd/ratelimiter/internal/bucket/leaky"
+	"github.com/tamasd/ratelimiter/internal/bucket/mutex"
+	"github.com/tamasd/ratelimiter/internal/bucket/timed"
+)
+
+// Bucket interface representing the basic operations of the leaky bucket algo.
+//
+// Input() "fills" the bucket. It returns true, if the bucket can accept the
+// request, and false, if the bucket is overflowing. Leak() lowers the "water
+// level" inside the bucket.
+//
+// Buckets with Start() and Stop() methods are started and stopped by the
+// middleware.
+type Bucket = bucket.Bucket
+
+// Meter is implemented by buckets that can report how full they are.
+//
+// Level() returns the current "water level" and the capacity of the bucket.
+// The middleware uses this to fill the Remaining and Reset fields of the
+// decision.
+type Meter = bucket.Meter
+
+// Weighted is implemented by buckets that can accept multiple units at once.
+//
+// InputN() "fills" the bucket with n units. Either all units are accepted, or
+// none of them.
+type Weighted = bucket.Weighted
+
+// Persistent is implemented by buckets that keep their state outside of the
+// process, e.g. in Redis or in a database.
+//
+// The middleware does not include these buckets in its snapshots, because
+// their state survives the restarts of the process anyway.
+type Persistent = bucket.Persistent
+
+// InputN fills the bucket with n units.
+//
+// If the bucket does not implement Weighted, Input() is called n times, until
+// it fails. In this case the units accepted before the failure stay in the
+// bucket.
+func InputN(b Bucket, n uint) bool {
+	return bucket.InputN(b, n)
+}
+
+// Leaky is the implementation of the leaky bucket algorithm.
+//
+// This implementation is not thread-safe.
+type Leaky = leaky.Bucket
+
+// NewLeaky creates a new leaky bucket with the given capacity.
+func NewLeaky(limit uint) *Leaky {
+	return leaky.New(limit)
+}
+
+// Mutex decorates a bucket with a mutex, making it thread-safe.
+type Mutex = mutex.Bucket
+
+// NewMutex creates a new mutex bucket.
+func NewMutex(b Bucket) *Mutex {
+	return mutex.New(b)
+}
+
+// Channel decorates a bucket with channels, making it thread-safe.
+//
+// The channel bucket only works after Start() is called.
+type Channel = channel.Bucket
+
+// NewChannel creates a new channel bucket.
+func NewChannel(b Bucket) *Channel {
+	return channel.New(b)
+}
+
+// Timed decorates a bucket with a clock, making it thread-safe.
+//
+// The decorated bucket is leaked based on the time passed since the last
+// leak, so it does not need a background process.
+type Timed = timed.Bucket
+
+// NewTimed creates a new timed bucket.
+//
+// The interval parameter is the time between two leaks.
+func NewTimed(b Bucket, interval time.Duration) *Timed {
+	return timed.New(b, interval)
+}
@@ -0,0 +1,60 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bucket_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter/bucket"
+)
+
+func TestMutex(t *testing.T) {
+	var b bucket.Bucket = bucket.NewMutex(bucket.NewLeaky(1))
+
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+	b.Leak()
+	require.True(t, b.Input())
+}
+
+func TestChannel(t *testing.T) {
+	b := bucket.NewChannel(bucket.NewLeaky(1))
+	go b.Start()
+	t.Cleanup(b.Stop)
+
+	require.True(t, b.Input())
+	level, limit := b.Level()
+	require.Equal(t, uint(1), level)
+	require.Equal(t, uint(1), limit)
+}
+
+func TestTimed(t *testing.T) {
+	b := bucket.NewTimed(bucket.NewLeaky(1), time.Hour)
+
+	require.True(t, b.Input())
+	require.False(t, b.Input())
+	require.NotZero(t, b.Delay())
+}
+
+func TestInputN(t *testing.T) {
+	b := bucket.NewMutex(bucket.NewLeaky(3))
+
+	require.True(t, bucket.InputN(b, 2))
+	require.False(t, bucket.InputN(b, 2))
+}
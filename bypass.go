@@ -0,0 +1,129 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBypassHeader is the default request header of the bypass tokens.
+const DefaultBypassHeader = "X-RateLimit-Bypass"
+
+var (
+	// ErrInvalidToken is returned for malformed bypass tokens, and for tokens
+	// with an invalid signature.
+	ErrInvalidToken = errors.New("ratelimiter: invalid bypass token")
+
+	// ErrExpiredToken is returned for bypass tokens past their expiry.
+	ErrExpiredToken = errors.New("ratelimiter: expired bypass token")
+)
+
+// BypassSigner mints and verifies signed bypass tokens.
+//
+// Bypass tokens let trusted clients, like load tests and automation, bypass
+// the limiter or use a separate, higher limit. A token has the
+// "expiry.label.signature" format, where expiry is a unix timestamp, label is
+// a base64 encoded free-form description, and signature is the base64
+// encoded HMAC-SHA256 of the first two parts.
+type BypassSigner struct {
+	secret []byte
+}
+
+// NewBypassSigner creates a signer with the given secret.
+func NewBypassSigner(secret []byte) *BypassSigner {
+	return &BypassSigner{
+		secret: secret,
+	}
+}
+
+// Mint creates a token that is valid for the given duration.
+func (bs *BypassSigner) Mint(label string, ttl time.Duration) string {
+	return bs.MintUntil(label, time.Now().Add(ttl))
+}
+
+// MintUntil creates a token that is valid until the given time.
+func (bs *BypassSigner) MintUntil(label string, expires time.Time) string {
+	payload := strconv.FormatInt(expires.Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString([]byte(label))
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(bs.sign(payload))
+}
+
+// Verify checks the signature and the expiry of a token, and returns its
+// label.
+//
+// The signature is compared in constant time.
+func (bs *BypassSigner) Verify(token string) (string, error) {
+	separator := strings.LastIndexByte(token, '.')
+	if separator < 0 {
+		return "", ErrInvalidToken
+	}
+	payload := token[:separator]
+
+	signature, err := base64.RawURLEncoding.DecodeString(token[separator+1:])
+	if err != nil || !hmac.Equal(signature, bs.sign(payload)) {
+		return "", ErrInvalidToken
+	}
+
+	parts := strings.SplitN(payload, ".", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	label, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= expires {
+		return "", ErrExpiredToken
+	}
+
+	return string(label), nil
+}
+
+func (bs *BypassSigner) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, bs.secret)
+	_, _ = mac.Write([]byte(payload))
+
+	return mac.Sum(nil)
+}
+
+// bypassConfig holds the bypass token settings of the middleware.
+type bypassConfig struct {
+	signer           *BypassSigner
+	header           string
+	requestPerSecond uint
+}
+
+// valid reports whether the request has a valid bypass token.
+func (bc bypassConfig) valid(token string) bool {
+	if bc.signer == nil || token == "" {
+		return false
+	}
+
+	_, err := bc.signer.Verify(token)
+	return err == nil
+}
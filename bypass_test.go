@@ -0,0 +1,102 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func TestBypassSigner(t *testing.T) {
+	signer := ratelimiter.NewBypassSigner([]byte("secret"))
+
+	token := signer.Mint("load.test", time.Hour)
+	label, err := signer.Verify(token)
+	require.NoError(t, err)
+	require.Equal(t, "load.test", label)
+
+	_, err = signer.Verify(signer.Mint("expired", -time.Second))
+	require.Equal(t, ratelimiter.ErrExpiredToken, err)
+
+	_, err = ratelimiter.NewBypassSigner([]byte("other")).Verify(token)
+	require.Equal(t, ratelimiter.ErrInvalidToken, err)
+
+	parts := strings.Split(token, ".")
+	parts[0] = "99999999999"
+	_, err = signer.Verify(strings.Join(parts, "."))
+	require.Equal(t, ratelimiter.ErrInvalidToken, err)
+
+	for _, invalid := range []string{"", "garbage", "1.2", "a.b.c"} {
+		_, err = signer.Verify(invalid)
+		require.Equal(t, ratelimiter.ErrInvalidToken, err, invalid)
+	}
+}
+
+func testBypassResponseCode(mw *ratelimiter.Middleware, token string) int {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(ratelimiter.DefaultBypassHeader, token)
+	mw.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+		decision, _ := ratelimiter.GetDecision(r)
+		if decision.Exempt {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return w.Result().StatusCode
+}
+
+func TestMiddleware_Bypass(t *testing.T) {
+	signer := ratelimiter.NewBypassSigner([]byte("secret"))
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetBypass(signer, "")
+	mw := ratelimiter.New(config)
+
+	token := signer.Mint("loadtest", time.Hour)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusAccepted, testBypassResponseCode(mw, token))
+	}
+
+	require.Equal(t, http.StatusOK, testBypassResponseCode(mw, "invalid"))
+	require.Equal(t, http.StatusTooManyRequests, testBypassResponseCode(mw, signer.Mint("expired", -time.Second)))
+}
+
+func TestMiddleware_BypassLimit(t *testing.T) {
+	signer := ratelimiter.NewBypassSigner([]byte("secret"))
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetBypass(signer, "")
+	(&config).SetBypassLimit(3)
+	mw := ratelimiter.New(config)
+	defer mw.Stop()
+
+	token := signer.Mint("loadtest", time.Hour)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, testBypassResponseCode(mw, token))
+	}
+	require.Equal(t, http.StatusTooManyRequests, testBypassResponseCode(mw, token))
+
+	require.Equal(t, http.StatusOK, testBypassResponseCode(mw, ""))
+	require.Equal(t, http.StatusTooManyRequests, testBypassResponseCode(mw, ""))
+}
@@ -0,0 +1,167 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Outcome describes how the next handler responded to a request.
+type Outcome struct {
+	// Cost is the number of units the request was charged before calling the
+	// next handler.
+	Cost uint
+
+	// Status is the status code of the response.
+	Status int
+
+	// Size is the number of bytes written to the response body.
+	Size int64
+
+	// Duration is the time the next handler took.
+	Duration time.Duration
+}
+
+// ChargeFunc returns the real cost of a request, after it has been handled.
+//
+// The middleware charges the bucket with the difference, if the real cost is
+// higher than the cost charged before calling the next handler, and gives
+// back the difference, if it is lower.
+type ChargeFunc func(r *http.Request, outcome Outcome) uint
+
+// ServerError reports whether the status code is a 5xx server error.
+func ServerError(status int) bool {
+	return status >= 500 && status < 600
+}
+
+// StatusCharge creates a charge function that only counts the responses with
+// matching status codes.
+//
+// For example, StatusCharge(ServerError) only counts the failing requests.
+func StatusCharge(match func(status int) bool) ChargeFunc {
+	return func(r *http.Request, outcome Outcome) uint {
+		if match(outcome.Status) {
+			return outcome.Cost
+		}
+
+		return 0
+	}
+}
+
+// LatencyCharge creates a charge function that charges 1 for every started
+// unit of time the next handler took.
+//
+// For example, LatencyCharge(100 * time.Millisecond) charges per 100 ms of
+// handler time.
+func LatencyCharge(unit time.Duration) ChargeFunc {
+	return func(r *http.Request, outcome Outcome) uint {
+		if unit <= 0 || outcome.Duration <= 0 {
+			return 1
+		}
+
+		return uint((outcome.Duration + unit - 1) / unit)
+	}
+}
+
+// SizeCharge creates a charge function that charges 1 for every started
+// unitSize bytes of the response body.
+//
+// Every response costs at least 1.
+func SizeCharge(unitSize uint) ChargeFunc {
+	return func(r *http.Request, outcome Outcome) uint {
+		if unitSize == 0 || outcome.Size <= 0 {
+			return 1
+		}
+
+		return uint((uint64(outcome.Size) + uint64(unitSize) - 1) / uint64(unitSize))
+	}
+}
+
+// responseWriter records the status code and the size of the response.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.size += int64(n)
+
+	return n, err
+}
+
+// Flush implements the http.Flusher interface.
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface, so the connection can be
+// taken over, e.g. by a websocket handler.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ratelimiter: the response writer does not support hijacking")
+	}
+	if rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+
+	return hijacker.Hijack()
+}
+
+// Push implements the http.Pusher interface.
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := rw.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the original response writer for http.ResponseController.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Status returns the status code of the response.
+func (rw *responseWriter) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+
+	return rw.status
+}
@@ -0,0 +1,121 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func createChargedMiddleware(requestPerSecond uint, chargeFunc ratelimiter.ChargeFunc) *ratelimiter.Middleware {
+	config := ratelimiter.CreateMiddlewareConfig(requestPerSecond)
+	(&config).SetChargeFunc(chargeFunc)
+
+	return ratelimiter.New(config)
+}
+
+func testStatusResponseCode(mw *ratelimiter.Middleware, status int, body string) int {
+	w := httptest.NewRecorder()
+	mw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	})
+
+	return w.Result().StatusCode
+}
+
+func TestStatusCharge(t *testing.T) {
+	mw := createChargedMiddleware(2, ratelimiter.StatusCharge(ratelimiter.ServerError))
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, http.StatusNotFound, testStatusResponseCode(mw, http.StatusNotFound, ""))
+	}
+	require.Equal(t, http.StatusInternalServerError, testStatusResponseCode(mw, http.StatusInternalServerError, ""))
+	require.Equal(t, http.StatusBadGateway, testStatusResponseCode(mw, http.StatusBadGateway, ""))
+	require.Equal(t, http.StatusTooManyRequests, testStatusResponseCode(mw, http.StatusOK, ""))
+}
+
+func TestSizeCharge(t *testing.T) {
+	mw := createChargedMiddleware(5, ratelimiter.SizeCharge(4))
+
+	require.Equal(t, http.StatusOK, testStatusResponseCode(mw, http.StatusOK, "0123456789"))
+	decision := mw.Check("")
+	require.True(t, decision.Allowed)
+	require.Equal(t, uint(1), decision.Remaining)
+}
+
+func TestLatencyCharge(t *testing.T) {
+	charge := ratelimiter.LatencyCharge(100 * time.Millisecond)
+
+	require.Equal(t, uint(1), charge(nil, ratelimiter.Outcome{Duration: time.Millisecond}))
+	require.Equal(t, uint(3), charge(nil, ratelimiter.Outcome{Duration: 250 * time.Millisecond}))
+}
+
+func TestChargeFunc_Hijack(t *testing.T) {
+	statuses := make(chan int, 1)
+	mw := createChargedMiddleware(5, func(r *http.Request, outcome ratelimiter.Outcome) uint {
+		statuses <- outcome.Status
+		return 1
+	})
+	server := httptest.NewServer(mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		_ = buf.Flush()
+	})))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hijacked", string(body))
+	require.Equal(t, http.StatusSwitchingProtocols, <-statuses)
+}
+
+func TestChargeFunc_NotHijacker(t *testing.T) {
+	mw := createChargedMiddleware(5, ratelimiter.SizeCharge(1))
+	w := httptest.NewRecorder()
+	mw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := w.(http.Hijacker).Hijack()
+		require.Error(t, err)
+		require.Equal(t, http.ErrNotSupported, w.(http.Pusher).Push("/style.css", nil))
+	})
+}
+
+func TestMiddleware_ChargeRefund(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(3))
+
+	mw.Charge("a", 5)
+	require.False(t, mw.Check("a").Allowed)
+
+	mw.Refund("a", 2)
+	decision := mw.Check("a")
+	require.True(t, decision.Allowed)
+	require.Equal(t, uint(1), decision.Remaining)
+}
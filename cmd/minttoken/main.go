@@ -0,0 +1,53 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Command minttoken mints signed bypass tokens for the rate limiter.
+//
+// The secret is read from the BYPASS_SECRET environment variable, so that it
+// does not end up in the shell history:
+//
+//	BYPASS_SECRET=... minttoken -label loadtest -ttl 1h
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tamasd/ratelimiter"
+)
+
+var (
+	label = flag.String("label", "", "free-form description of the token")
+	ttl   = flag.Duration("ttl", time.Hour, "validity of the token")
+)
+
+func main() {
+	flag.Parse()
+
+	secret := os.Getenv("BYPASS_SECRET")
+	if secret == "" {
+		fmt.Fprintln(os.Stderr, "BYPASS_SECRET is not set")
+		os.Exit(1)
+	}
+	if *ttl <= 0 {
+		fmt.Fprintln(os.Stderr, "ttl must be positive")
+		os.Exit(1)
+	}
+
+	fmt.Println(ratelimiter.NewBypassSigner([]byte(secret)).Mint(*label, *ttl))
+}
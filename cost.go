@@ -0,0 +1,69 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CostFunc returns how many units a request fills the bucket with.
+type CostFunc func(r *http.Request) uint
+
+// MethodCost creates a cost function based on the request method.
+//
+// Methods missing from the costs map cost defaultCost.
+func MethodCost(costs map[string]uint, defaultCost uint) CostFunc {
+	return func(r *http.Request) uint {
+		if cost, ok := costs[r.Method]; ok {
+			return cost
+		}
+
+		return defaultCost
+	}
+}
+
+// RouteCost creates a cost function based on the request path.
+//
+// The keys of the costs map are path prefixes, the longest matching prefix
+// wins. Paths without a matching prefix cost defaultCost.
+func RouteCost(costs map[string]uint, defaultCost uint) CostFunc {
+	return func(r *http.Request) uint {
+		cost, longest := defaultCost, -1
+		for prefix, prefixCost := range costs {
+			if len(prefix) > longest && strings.HasPrefix(r.URL.Path, prefix) {
+				cost, longest = prefixCost, len(prefix)
+			}
+		}
+
+		return cost
+	}
+}
+
+// ContentLengthCost creates a cost function based on the request body size.
+//
+// Every started unitSize bytes cost 1, and every request costs at least 1.
+// Requests with unknown body size cost 1 as well.
+func ContentLengthCost(unitSize uint) CostFunc {
+	return func(r *http.Request) uint {
+		if r.ContentLength <= 0 || unitSize == 0 {
+			return 1
+		}
+
+		return uint((uint64(r.ContentLength) + uint64(unitSize) - 1) / uint64(unitSize))
+	}
+}
@@ -0,0 +1,79 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func TestMethodCost(t *testing.T) {
+	cost := ratelimiter.MethodCost(map[string]uint{
+		http.MethodPost: 10,
+	}, 1)
+
+	require.Equal(t, uint(10), cost(httptest.NewRequest(http.MethodPost, "/", nil)))
+	require.Equal(t, uint(1), cost(httptest.NewRequest(http.MethodGet, "/", nil)))
+}
+
+func TestRouteCost(t *testing.T) {
+	cost := ratelimiter.RouteCost(map[string]uint{
+		"/api/":      2,
+		"/api/bulk/": 100,
+	}, 1)
+
+	require.Equal(t, uint(100), cost(httptest.NewRequest(http.MethodGet, "/api/bulk/import", nil)))
+	require.Equal(t, uint(2), cost(httptest.NewRequest(http.MethodGet, "/api/users", nil)))
+	require.Equal(t, uint(1), cost(httptest.NewRequest(http.MethodGet, "/", nil)))
+}
+
+func TestContentLengthCost(t *testing.T) {
+	cost := ratelimiter.ContentLengthCost(10)
+
+	require.Equal(t, uint(1), cost(httptest.NewRequest(http.MethodGet, "/", nil)))
+	require.Equal(t, uint(1), cost(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789"))))
+	require.Equal(t, uint(2), cost(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789a"))))
+}
+
+func TestMiddleware_CostFunc(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(10)
+	(&config).SetCostFunc(ratelimiter.MethodCost(map[string]uint{
+		http.MethodPost: 6,
+	}, 1))
+	mw := ratelimiter.New(config)
+
+	require.Equal(t, http.StatusOK, testMethodResponseCode(mw, http.MethodPost))
+	require.Equal(t, http.StatusTooManyRequests, testMethodResponseCode(mw, http.MethodPost))
+	for i := 0; i < 4; i++ {
+		require.Equal(t, http.StatusOK, testMethodResponseCode(mw, http.MethodGet))
+	}
+	require.Equal(t, http.StatusTooManyRequests, testMethodResponseCode(mw, http.MethodGet))
+}
+
+func testMethodResponseCode(mw *ratelimiter.Middleware, method string) int {
+	w := httptest.NewRecorder()
+	mw.ServeHTTP(w, httptest.NewRequest(method, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return w.Result().StatusCode
+}
@@ -0,0 +1,110 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type contextKey int
+
+const (
+	decisionContextKey contextKey = iota
+)
+
+// Decision describes what the rate limiter did with a request.
+//
+// The middleware attaches the decision to the request context before calling
+// the next handler, so handlers can check how close the client is to its
+// limit, for example to skip expensive optional work.
+type Decision struct {
+	// Key is the key of the bucket the request was counted against.
+	//
+	// The key is empty when every request shares the same bucket.
+	Key string
+
+	// Policy describes the limit in the format of the RateLimit-Policy
+	// header, e.g. "100;w=1".
+	Policy string
+
+	// Cost is the number of units the request was counted as.
+	Cost uint
+
+	// Allowed is true, if the bucket accepted the request.
+	Allowed bool
+
+	// Exempt is true, if the request bypassed the limiter.
+	Exempt bool
+
+	// Banned is true, if the key is banned for hitting the limit too often.
+	Banned bool
+
+	// DryRun is true, if the limit is not enforced. A request that is not
+	// allowed in dry-run mode is let through anyway.
+	DryRun bool
+
+	// Remaining is the number of requests the bucket can still accept.
+	Remaining uint
+
+	// Reset is the time it takes for the bucket to drain completely.
+	Reset time.Duration
+
+	// RetryAfter is the delay the client is asked to wait before retrying a
+	// rejected request.
+	RetryAfter time.Duration
+
+	// limit is the capacity of the bucket, if the bucket reports its level.
+	limit uint
+}
+
+// Rejected reports whether the request has to be rejected.
+//
+// It is true if the request is not allowed, unless the decision was made in
+// dry-run mode.
+func (d Decision) Rejected() bool {
+	return !d.Allowed && !d.DryRun
+}
+
+// DecisionFunc receives the decisions that would have rejected a request in
+// dry-run mode.
+type DecisionFunc func(decision Decision)
+
+// ShadowFunc receives the decision of the active policy, and the decision of
+// the shadow policy for the same request.
+//
+// The shadow decision is always made in dry-run mode.
+type ShadowFunc func(active, shadow Decision)
+
+// WithDecision returns a copy of the context with the decision attached.
+func WithDecision(ctx context.Context, decision Decision) context.Context {
+	return context.WithValue(ctx, decisionContextKey, decision)
+}
+
+// DecisionFromContext returns the decision attached to the context.
+//
+// The second return value is false, if the context has no decision.
+func DecisionFromContext(ctx context.Context) (Decision, bool) {
+	decision, ok := ctx.Value(decisionContextKey).(Decision)
+	return decision, ok
+}
+
+// GetDecision returns the decision attached to the request context.
+func GetDecision(r *http.Request) (Decision, bool) {
+	return DecisionFromContext(r.Context())
+}
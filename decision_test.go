@@ -0,0 +1,59 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func TestDecision(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(4))
+
+	var decision ratelimiter.Decision
+	var found bool
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+		decision, found = ratelimiter.GetDecision(r)
+	})
+
+	require.True(t, found)
+	require.True(t, decision.Allowed)
+	require.False(t, decision.DryRun)
+	require.Equal(t, "", decision.Key)
+	require.Equal(t, "4;w=1", decision.Policy)
+	require.Equal(t, uint(1), decision.Cost)
+	require.Equal(t, uint(3), decision.Remaining)
+	require.Equal(t, time.Second/4, decision.Reset)
+}
+
+func TestDecisionFromContext_Missing(t *testing.T) {
+	_, found := ratelimiter.DecisionFromContext(context.Background())
+
+	require.False(t, found)
+}
+
+func TestDecision_Rejected(t *testing.T) {
+	require.False(t, ratelimiter.Decision{Allowed: true}.Rejected())
+	require.True(t, ratelimiter.Decision{}.Rejected())
+	require.False(t, ratelimiter.Decision{DryRun: true}.Rejected())
+}
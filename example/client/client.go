@@ -24,6 +24,8 @@ import (
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/tamasd/ratelimiter"
 )
 
 var (
@@ -31,6 +33,8 @@ var (
 	count             = flag.Uint("count", 4096, "number of messages")
 	concurrency       = flag.Uint("concurrency", 4, "concurrency")
 	requestsPerSecond = flag.Uint("reqs", 100, "requests per second")
+	adaptive          = flag.Bool("adaptive", false, "pace the requests with the adaptive rate limited transport")
+	bypassToken       = flag.String("bypass", "", "bypass token to send with the requests")
 )
 
 // worker is a worker thread that sends the requests in a given interval.
@@ -49,8 +53,25 @@ type result struct {
 	duration   time.Duration
 }
 
+// createClient creates the http client of the load test.
+//
+// In adaptive mode the client paces the requests using the limits published
+// by the server.
+func createClient(adaptive bool, requestsPerSecond uint) *http.Client {
+	client := &http.Client{}
+	if adaptive {
+		config := ratelimiter.CreateTransportConfig(requestsPerSecond)
+		(&config).SetAdaptive(true)
+		client.Transport = ratelimiter.NewTransport(config, nil)
+	}
+
+	return client
+}
+
 // loadTest executes the load test.
-func loadTest(url string, count, concurrency, requestsPerSecond uint) {
+//
+// When bypassToken is not empty, it is sent in the bypass header.
+func loadTest(client *http.Client, url, bypassToken string, count, concurrency, requestsPerSecond uint) {
 	var wg sync.WaitGroup
 
 	inputch := make(chan func())
@@ -60,7 +81,6 @@ func loadTest(url string, count, concurrency, requestsPerSecond uint) {
 		go worker(inputch, &wg, requestsPerSecond)
 	}
 
-	client := &http.Client{}
 	var resultmtx sync.Mutex
 	results := make([]result, 0, int(count))
 
@@ -69,6 +89,9 @@ func loadTest(url string, count, concurrency, requestsPerSecond uint) {
 	for i := uint(0); i < count; i++ {
 		inputch <- func() {
 			req, _ := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(""))
+			if bypassToken != "" {
+				req.Header.Set(ratelimiter.DefaultBypassHeader, bypassToken)
+			}
 			start := time.Now()
 			resp, err := client.Do(req)
 			if err != nil {
@@ -134,5 +157,5 @@ func summarize(results []result, duration time.Duration) {
 
 func main() {
 	flag.Parse()
-	loadTest(*url, *count, *concurrency, *requestsPerSecond)
+	loadTest(createClient(*adaptive, *requestsPerSecond), *url, *bypassToken, *count, *concurrency, *requestsPerSecond)
 }
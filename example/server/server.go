@@ -77,7 +77,10 @@ func ProfilerMiddleware(logger logrus.FieldLogger) func(w http.ResponseWriter, r
 }
 
 // CreateHandler creates a http.Handler using negroni.
-func CreateHandler(logger logrus.FieldLogger, requestsPerSecond uint) http.Handler {
+//
+// When bypassSecret is not empty, the requests with a valid bypass token skip
+// the rate limiter.
+func CreateHandler(logger logrus.FieldLogger, requestsPerSecond uint, bypassSecret string) http.Handler {
 	middleware := negroni.New()
 
 	recovery := negroni.NewRecovery()
@@ -85,7 +88,12 @@ func CreateHandler(logger logrus.FieldLogger, requestsPerSecond uint) http.Handl
 	middleware.Use(recovery)
 	middleware.UseFunc(ProfilerMiddleware(logger))
 
-	ratelimiterMiddleware := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(requestsPerSecond))
+	config := ratelimiter.CreateMiddlewareConfig(requestsPerSecond)
+	if bypassSecret != "" {
+		config.SetBypass(ratelimiter.NewBypassSigner([]byte(bypassSecret)), "")
+	}
+
+	ratelimiterMiddleware := ratelimiter.New(config)
 	middleware.Use(ratelimiterMiddleware)
 	go ratelimiterMiddleware.Start()
 
@@ -136,7 +144,7 @@ func CreateServer(handler http.Handler) *http.Server {
 // This function also creates all the dependencies from the global flags.
 func SetupServer() *http.Server {
 	logger := CreateLogger()
-	handler := CreateHandler(logger, *requestsPerSecond)
+	handler := CreateHandler(logger, *requestsPerSecond, os.Getenv("BYPASS_SECRET"))
 	server := CreateServer(handler)
 
 	return server
@@ -0,0 +1,166 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package grpclimiter applies the rate limiter middleware to gRPC servers.
+package grpclimiter
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/tamasd/ratelimiter"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// KeyFunc returns the key of the bucket a gRPC call is counted against.
+type KeyFunc func(ctx context.Context, fullMethod string) string
+
+// PeerKey uses the address of the peer as the key, without the port.
+func PeerKey(ctx context.Context, fullMethod string) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	addr := p.Addr.String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// MethodKey uses the full method name as the key, e.g. "/package.Service/Method".
+func MethodKey(ctx context.Context, fullMethod string) string {
+	return fullMethod
+}
+
+// MetadataKey uses the values of the given incoming metadata as the key.
+//
+// This is useful for API keys or tenant identifiers.
+func MetadataKey(name string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		return strings.Join(md.Get(name), ",")
+	}
+}
+
+// CombineKeys joins the keys of multiple key functions.
+func CombineKeys(keyFuncs ...KeyFunc) KeyFunc {
+	return func(ctx context.Context, fullMethod string) string {
+		keys := make([]string, len(keyFuncs))
+		for i, keyFunc := range keyFuncs {
+			keys[i] = keyFunc(ctx, fullMethod)
+		}
+
+		return strings.Join(keys, "|")
+	}
+}
+
+// UnaryServerInterceptor limits unary calls.
+//
+// Rejected calls fail with codes.ResourceExhausted, and the status details
+// contain an errdetails.RetryInfo. The decision is attached to the context of
+// the allowed calls.
+func UnaryServerInterceptor(m *ratelimiter.Middleware, keyFunc KeyFunc) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		decision := m.Check(keyFunc(ctx, info.FullMethod))
+		if decision.Rejected() {
+			return nil, exhausted(decision)
+		}
+
+		return handler(ratelimiter.WithDecision(ctx, decision), req)
+	}
+}
+
+// StreamServerInterceptor limits the number of opened streams.
+//
+// The stream is counted once, when it is opened.
+func StreamServerInterceptor(m *ratelimiter.Middleware, keyFunc KeyFunc) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		decision := m.Check(keyFunc(ss.Context(), info.FullMethod))
+		if decision.Rejected() {
+			return exhausted(decision)
+		}
+
+		return handler(srv, &serverStream{
+			ServerStream: ss,
+			ctx:          ratelimiter.WithDecision(ss.Context(), decision),
+		})
+	}
+}
+
+// MessageStreamServerInterceptor limits the messages received on streams.
+//
+// Every received message is counted. When a message is rejected, RecvMsg()
+// returns the codes.ResourceExhausted error, which ends the stream when the
+// handler returns it.
+func MessageStreamServerInterceptor(m *ratelimiter.Middleware, keyFunc KeyFunc) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &serverStream{
+			ServerStream: ss,
+			ctx:          ss.Context(),
+			middleware:   m,
+			key:          keyFunc(ss.Context(), info.FullMethod),
+		})
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx        context.Context
+	middleware *ratelimiter.Middleware
+	key        string
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) RecvMsg(msg interface{}) error {
+	if err := s.ServerStream.RecvMsg(msg); err != nil {
+		return err
+	}
+
+	if s.middleware != nil {
+		if decision := s.middleware.Check(s.key); decision.Rejected() {
+			return exhausted(decision)
+		}
+	}
+
+	return nil
+}
+
+// exhausted creates the error returned for rejected calls.
+func exhausted(decision ratelimiter.Decision) error {
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(decision.RetryAfter),
+	})
+	if err != nil {
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
@@ -0,0 +1,148 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package grpclimiter_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/grpclimiter"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func startServer(t *testing.T, opts ...grpc.ServerOption) healthpb.HealthClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return healthpb.NewHealthClient(conn)
+}
+
+func requireExhausted(t *testing.T, err error) {
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 1)
+	retryInfo, ok := st.Details()[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	require.NotZero(t, retryInfo.RetryDelay.AsDuration())
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(1))
+	client := startServer(t, grpc.UnaryInterceptor(grpclimiter.UnaryServerInterceptor(mw, grpclimiter.PeerKey)))
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	requireExhausted(t, err)
+}
+
+func TestUnaryServerInterceptor_MetadataKey(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(1))
+	client := startServer(t, grpc.UnaryInterceptor(grpclimiter.UnaryServerInterceptor(mw, grpclimiter.MetadataKey("api-key"))))
+
+	ctxA := metadata.AppendToOutgoingContext(context.Background(), "api-key", "a")
+	ctxB := metadata.AppendToOutgoingContext(context.Background(), "api-key", "b")
+
+	_, err := client.Check(ctxA, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = client.Check(ctxB, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = client.Check(ctxA, &healthpb.HealthCheckRequest{})
+	requireExhausted(t, err)
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(1))
+	client := startServer(t, grpc.StreamInterceptor(grpclimiter.StreamServerInterceptor(mw, grpclimiter.MethodKey)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	stream, err = client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	requireExhausted(t, err)
+}
+
+type mockServerStream struct {
+	mock.Mock
+	grpc.ServerStream
+}
+
+func (ms *mockServerStream) Context() context.Context {
+	return context.Background()
+}
+
+func (ms *mockServerStream) RecvMsg(m interface{}) error {
+	return ms.Called(m).Error(0)
+}
+
+func TestMessageStreamServerInterceptor(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(2))
+	interceptor := grpclimiter.MessageStreamServerInterceptor(mw, grpclimiter.MethodKey)
+	ss := new(mockServerStream)
+	ss.On("RecvMsg", mock.Anything).Return(nil)
+
+	err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: "/test/Stream"}, func(srv interface{}, stream grpc.ServerStream) error {
+		for i := 0; i < 2; i++ {
+			require.NoError(t, stream.RecvMsg(nil))
+		}
+		return stream.RecvMsg(nil)
+	})
+
+	requireExhausted(t, err)
+	ss.AssertNumberOfCalls(t, "RecvMsg", 3)
+}
+
+func TestCombineKeys(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("tenant", "acme"))
+	key := grpclimiter.CombineKeys(grpclimiter.MetadataKey("tenant"), grpclimiter.MethodKey)
+
+	require.Equal(t, "acme|/test/Method", key(ctx, "/test/Method"))
+}
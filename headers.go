@@ -0,0 +1,191 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// epochThreshold separates the reset values given in seconds from the ones
+// given as a unix timestamp in the X-RateLimit-Reset header.
+const epochThreshold = 1000000000
+
+// setRateLimitHeaders publishes the limit and the state of the bucket of a
+// decision in the RateLimit-Policy and RateLimit headers.
+//
+// The RateLimit header is only set if the bucket reports its level.
+func setRateLimitHeaders(header http.Header, decision Decision) {
+	header.Set("RateLimit-Policy", decision.Policy)
+	if decision.limit == 0 {
+		return
+	}
+
+	reset := (decision.Reset + time.Second - 1) / time.Second
+	header.Set("RateLimit", fmt.Sprintf("limit=%d, remaining=%d, reset=%d", decision.limit, decision.Remaining, reset))
+}
+
+// retryAfter parses the Retry-After header of a response.
+//
+// The header can be either a number of seconds or a HTTP date. The second
+// return value is false, if the header is missing or invalid.
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+
+	return 0, true
+}
+
+// leadingNumber parses the number at the beginning of a header value.
+//
+// Some header formats list policies after the number, e.g. "10, 10;w=1".
+func leadingNumber(value string) (uint64, bool) {
+	value = strings.TrimSpace(value)
+	end := strings.IndexAny(value, ",;")
+	if end >= 0 {
+		value = strings.TrimSpace(value[:end])
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	return parsed, err == nil
+}
+
+// rateLimitFields parses the rate limit headers of a response.
+//
+// The RateLimit header has the "limit=10, remaining=0, reset=5" format. The
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers of the
+// earlier drafts, and the X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset headers are supported as well. The reset field is always
+// returned in seconds from now, even if the server sent a unix timestamp.
+func rateLimitFields(header http.Header, now time.Time) map[string]uint64 {
+	fields := make(map[string]uint64)
+
+	for _, item := range strings.Split(header.Get("RateLimit"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64); err == nil {
+			fields[strings.ToLower(strings.TrimSpace(parts[0]))] = value
+		}
+	}
+
+	for _, prefix := range []string{"X-RateLimit-", "RateLimit-"} {
+		for _, name := range []string{"limit", "remaining", "reset"} {
+			if value, ok := leadingNumber(header.Get(prefix + name)); ok {
+				fields[name] = value
+			}
+		}
+	}
+
+	if reset, ok := fields["reset"]; ok && reset > epochThreshold {
+		if reset > uint64(now.Unix()) {
+			fields["reset"] = reset - uint64(now.Unix())
+		} else {
+			fields["reset"] = 0
+		}
+	}
+
+	return fields
+}
+
+// rateLimitPolicy parses the RateLimit-Policy header of a response.
+//
+// The header lists the quota policies of the server, e.g. "10;w=1, 50;w=60"
+// or `"default";q=10;w=1`. The policies are merged into the strictest one: the
+// smallest limit is returned as the burst, and the longest time between two
+// requests as the interval. The second return value is false, if the header
+// is missing or has no valid policies.
+func rateLimitPolicy(header http.Header) (burst uint64, interval time.Duration, ok bool) {
+	for _, item := range strings.Split(header.Get("RateLimit-Policy"), ",") {
+		var limit, window uint64
+		for i, param := range strings.Split(item, ";") {
+			param = strings.TrimSpace(param)
+			if i == 0 {
+				limit, _ = strconv.ParseUint(param, 10, 64)
+				continue
+			}
+
+			parts := strings.SplitN(param, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+			if err != nil {
+				continue
+			}
+			switch strings.TrimSpace(parts[0]) {
+			case "q":
+				limit = value
+			case "w":
+				window = value
+			}
+		}
+
+		if limit == 0 || window == 0 {
+			continue
+		}
+
+		if !ok || limit < burst {
+			burst = limit
+		}
+		if itemInterval := time.Duration(window) * time.Second / time.Duration(limit); itemInterval > interval {
+			interval = itemInterval
+		}
+		ok = true
+	}
+
+	return burst, interval, ok
+}
+
+// backoffDelay returns how long the client should wait before sending the
+// next request to the server that sent the response.
+//
+// The delay comes from the Retry-After header of 429 Too Many Requests and
+// 503 Service Unavailable responses, or from the reset field of the rate
+// limit headers, if no requests remain.
+func backoffDelay(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if delay, ok := retryAfter(resp.Header, now); ok {
+			return delay, true
+		}
+	}
+
+	fields := rateLimitFields(resp.Header, now)
+	if remaining, ok := fields["remaining"]; ok && remaining == 0 {
+		return time.Duration(fields["reset"]) * time.Second, true
+	}
+
+	return 0, false
+}
@@ -28,3 +28,47 @@ type Bucket interface {
 	// Leak lowers the "water level" inside the bucket.
 	Leak()
 }
+
+// Meter is implemented by buckets that can report how full they are.
+type Meter interface {
+
+	// Level returns the current "water level" and the capacity of the bucket.
+	Level() (level, limit uint)
+}
+
+// Weighted is implemented by buckets that can accept multiple units at once.
+type Weighted interface {
+
+	// InputN "fills" the bucket with n units.
+	//
+	// Either all units are accepted, or none of them.
+	InputN(n uint) bool
+}
+
+// Persistent is implemented by buckets that keep their state outside of the
+// process.
+type Persistent interface {
+
+	// Persistent returns true, if the state of the bucket is kept in a store
+	// that outlives the process, e.g. a shared database.
+	Persistent() bool
+}
+
+// InputN fills the bucket with n units.
+//
+// If the bucket does not implement Weighted, Input() is called n times, until
+// it fails. In this case the units accepted before the failure stay in the
+// bucket.
+func InputN(b Bucket, n uint) bool {
+	if weighted, ok := b.(Weighted); ok {
+		return weighted.InputN(n)
+	}
+
+	for i := uint(0); i < n; i++ {
+		if !b.Input() {
+			return false
+		}
+	}
+
+	return true
+}
@@ -19,6 +19,7 @@ package bucket_test
 import (
 	"testing"
 
+	"github.com/stretchr/testify/require"
 	"github.com/tamasd/ratelimiter/internal/bucket"
 	"github.com/tamasd/ratelimiter/internal/bucket/channel"
 	"github.com/tamasd/ratelimiter/internal/bucket/leaky"
@@ -51,3 +52,33 @@ func BenchmarkChannel(b *testing.B) {
 
 	benchBucket(b, channelBucket)
 }
+
+// countingBucket accepts a limited number of inputs, one by one.
+type countingBucket struct {
+	inputs uint
+}
+
+func (cb *countingBucket) Input() bool {
+	if cb.inputs == 0 {
+		return false
+	}
+
+	cb.inputs--
+	return true
+}
+
+func (cb *countingBucket) Leak() {}
+
+func TestInputN_Weighted(t *testing.T) {
+	b := leaky.New(2)
+
+	require.False(t, bucket.InputN(b, 3))
+	require.True(t, bucket.InputN(b, 2))
+}
+
+func TestInputN_NotWeighted(t *testing.T) {
+	b := &countingBucket{inputs: 2}
+
+	require.False(t, bucket.InputN(b, 3))
+	require.Zero(t, b.inputs)
+}
@@ -19,20 +19,33 @@ package channel
 import "github.com/tamasd/ratelimiter/internal/bucket"
 
 type inputMessage struct {
+	n     uint
 	reply chan bool
 }
 
-func newInputMessage() inputMessage {
+func newInputMessage(n uint) inputMessage {
 	return inputMessage{
+		n:     n,
 		reply: make(chan bool),
 	}
 }
 
+type levelMessage struct {
+	reply chan [2]uint
+}
+
+func newLevelMessage() levelMessage {
+	return levelMessage{
+		reply: make(chan [2]uint),
+	}
+}
+
 // Bucket decorates a bucket with channels.
 //
 // This allows multiple goroutines to use the decorated bucket.
 type Bucket struct {
 	inputch chan inputMessage
+	levelch chan levelMessage
 	leakch  chan struct{}
 	quitch  chan struct{}
 	bucket  bucket.Bucket
@@ -42,6 +55,7 @@ type Bucket struct {
 func New(bucket bucket.Bucket) *Bucket {
 	return &Bucket{
 		inputch: make(chan inputMessage),
+		levelch: make(chan levelMessage),
 		leakch:  make(chan struct{}),
 		quitch:  make(chan struct{}),
 		bucket:  bucket,
@@ -50,7 +64,14 @@ func New(bucket bucket.Bucket) *Bucket {
 
 // Input calls the decorated bucket's Input().
 func (cb *Bucket) Input() bool {
-	message := newInputMessage()
+	return cb.InputN(1)
+}
+
+// InputN calls the decorated bucket's InputN().
+//
+// See bucket.InputN() for buckets that do not implement bucket.Weighted.
+func (cb *Bucket) InputN(n uint) bool {
+	message := newInputMessage(n)
 	cb.inputch <- message
 	return <-message.reply
 }
@@ -60,6 +81,17 @@ func (cb *Bucket) Leak() {
 	cb.leakch <- struct{}{}
 }
 
+// Level calls the decorated bucket's Level().
+//
+// If the decorated bucket does not implement bucket.Meter, zeroes are
+// returned.
+func (cb *Bucket) Level() (level, limit uint) {
+	message := newLevelMessage()
+	cb.levelch <- message
+	reply := <-message.reply
+	return reply[0], reply[1]
+}
+
 // Start starts the service.
 func (cb *Bucket) Start() {
 	defer func() {
@@ -68,7 +100,9 @@ func (cb *Bucket) Start() {
 	for {
 		select {
 		case input := <-cb.inputch:
-			input.reply <- cb.bucket.Input()
+			input.reply <- cb.input(input.n)
+		case level := <-cb.levelch:
+			level.reply <- cb.level()
 		case <-cb.leakch:
 			cb.bucket.Leak()
 		case <-cb.quitch:
@@ -81,3 +115,21 @@ func (cb *Bucket) Start() {
 func (cb *Bucket) Stop() {
 	close(cb.quitch)
 }
+
+func (cb *Bucket) input(n uint) bool {
+	if n == 1 {
+		return cb.bucket.Input()
+	}
+
+	return bucket.InputN(cb.bucket, n)
+}
+
+func (cb *Bucket) level() [2]uint {
+	meter, ok := cb.bucket.(bucket.Meter)
+	if !ok {
+		return [2]uint{}
+	}
+
+	level, limit := meter.Level()
+	return [2]uint{level, limit}
+}
@@ -38,6 +38,24 @@ func (mb *mockBucket) Leak() {
 	mb.Called()
 }
 
+type mockWeightedBucket struct {
+	mockBucket
+}
+
+func (mb *mockWeightedBucket) InputN(n uint) bool {
+	args := mb.Called(n)
+	return args.Bool(0)
+}
+
+type mockMeterBucket struct {
+	mockBucket
+}
+
+func (mb *mockMeterBucket) Level() (uint, uint) {
+	args := mb.Called()
+	return args.Get(0).(uint), args.Get(1).(uint)
+}
+
 func TestBucket_Leak(t *testing.T) {
 	mb := new(mockBucket)
 	mb.On("Leak").Return()
@@ -75,3 +93,49 @@ func TestBucket_Input_False(t *testing.T) {
 	mb.AssertCalled(t, "Input")
 	mb.AssertExpectations(t)
 }
+
+func TestBucket_Level(t *testing.T) {
+	mb := new(mockMeterBucket)
+	mb.On("Level").Return(uint(1), uint(2))
+	channelBucket := channel.New(mb)
+	go channelBucket.Start()
+	defer channelBucket.Stop()
+
+	level, limit := channelBucket.Level()
+	require.Equal(t, uint(1), level)
+	require.Equal(t, uint(2), limit)
+	mb.AssertExpectations(t)
+}
+
+func TestBucket_Level_NoMeter(t *testing.T) {
+	mb := new(mockBucket)
+	channelBucket := channel.New(mb)
+	go channelBucket.Start()
+	defer channelBucket.Stop()
+
+	level, limit := channelBucket.Level()
+	require.Zero(t, level)
+	require.Zero(t, limit)
+}
+
+func TestBucket_InputN(t *testing.T) {
+	mb := new(mockWeightedBucket)
+	mb.On("InputN", uint(3)).Return(true)
+	channelBucket := channel.New(mb)
+	go channelBucket.Start()
+	defer channelBucket.Stop()
+
+	require.True(t, channelBucket.InputN(3))
+	mb.AssertExpectations(t)
+}
+
+func TestBucket_InputN_NotWeighted(t *testing.T) {
+	mb := new(mockBucket)
+	mb.On("Input").Return(true)
+	channelBucket := channel.New(mb)
+	go channelBucket.Start()
+	defer channelBucket.Stop()
+
+	require.True(t, channelBucket.InputN(3))
+	mb.AssertNumberOfCalls(t, "Input", 3)
+}
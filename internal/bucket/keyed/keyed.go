@@ -0,0 +1,177 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package keyed
+
+import (
+	"sync"
+
+	"github.com/tamasd/ratelimiter/internal/bucket"
+)
+
+type startStop interface {
+	Start()
+	Stop()
+}
+
+// Set holds a separate bucket for every key.
+//
+// Buckets are created on first use, and removed when they are completely
+// drained. This set is thread-safe, but the buckets it creates must be
+// thread-safe as well.
+type Set struct {
+	mtx     sync.RWMutex
+	factory func(key string) bucket.Bucket
+	buckets map[string]bucket.Bucket
+}
+
+// New creates a new set of buckets.
+//
+// The factory function is called every time a bucket is needed for a new key.
+func New(factory func(key string) bucket.Bucket) *Set {
+	return &Set{
+		factory: factory,
+		buckets: make(map[string]bucket.Bucket),
+	}
+}
+
+// With calls f with the bucket of the given key.
+//
+// The bucket is not removed from the set while f is running, but f must not
+// call any other method of the set.
+func (s *Set) With(key string, f func(bucket bucket.Bucket)) {
+	for {
+		s.mtx.RLock()
+		if b, ok := s.buckets[key]; ok {
+			defer s.mtx.RUnlock()
+			f(b)
+			return
+		}
+		s.mtx.RUnlock()
+
+		s.add(key)
+	}
+}
+
+func (s *Set) add(key string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.buckets[key]; ok {
+		return
+	}
+
+	b := s.factory(key)
+	if ss, ok := b.(startStop); ok {
+		go ss.Start()
+	}
+	s.buckets[key] = b
+}
+
+// Len returns the number of buckets in the set.
+func (s *Set) Len() int {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return len(s.buckets)
+}
+
+// Range calls f for every bucket in the set.
+//
+// f must not call any other method of the set.
+func (s *Set) Range(f func(key string, bucket bucket.Bucket)) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for key, b := range s.buckets {
+		f(key, b)
+	}
+}
+
+// Leak leaks every bucket in the set.
+//
+// Buckets implementing bucket.Meter are removed from the set when they are
+// empty.
+func (s *Set) Leak() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for key, b := range s.buckets {
+		b.Leak()
+		if meter, ok := b.(bucket.Meter); ok {
+			if level, _ := meter.Level(); level == 0 {
+				s.remove(key, b)
+			}
+		}
+	}
+}
+
+// Stop stops and removes every bucket in the set.
+func (s *Set) Stop() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for key, b := range s.buckets {
+		s.remove(key, b)
+	}
+}
+
+func (s *Set) remove(key string, b bucket.Bucket) {
+	delete(s.buckets, key)
+	if ss, ok := b.(startStop); ok {
+		ss.Stop()
+	}
+}
+
+// Shared uses the same bucket for every key.
+type Shared struct {
+	bucket bucket.Bucket
+}
+
+// NewShared creates a set that uses the given bucket for every key.
+//
+// If the bucket needs to be started, it is started immediately.
+func NewShared(b bucket.Bucket) *Shared {
+	if ss, ok := b.(startStop); ok {
+		go ss.Start()
+	}
+
+	return &Shared{
+		bucket: b,
+	}
+}
+
+// With calls f with the shared bucket.
+func (s *Shared) With(key string, f func(bucket bucket.Bucket)) {
+	f(s.bucket)
+}
+
+// Range calls f with the shared bucket and an empty key.
+func (s *Shared) Range(f func(key string, bucket bucket.Bucket)) {
+	f("", s.bucket)
+}
+
+// Leak leaks the shared bucket.
+func (s *Shared) Leak() {
+	s.bucket.Leak()
+}
+
+// Stop stops the shared bucket.
+func (s *Shared) Stop() {
+	if ss, ok := s.bucket.(startStop); ok {
+		ss.Stop()
+	}
+}
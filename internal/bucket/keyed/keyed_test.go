@@ -0,0 +1,116 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package keyed_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter/internal/bucket"
+	"github.com/tamasd/ratelimiter/internal/bucket/channel"
+	"github.com/tamasd/ratelimiter/internal/bucket/keyed"
+	"github.com/tamasd/ratelimiter/internal/bucket/leaky"
+	"github.com/tamasd/ratelimiter/internal/bucket/mutex"
+)
+
+type withBucket interface {
+	With(key string, f func(bucket bucket.Bucket))
+}
+
+func input(set withBucket, key string) bool {
+	var result bool
+	set.With(key, func(b bucket.Bucket) {
+		result = b.Input()
+	})
+
+	return result
+}
+
+func TestSet_SeparateKeys(t *testing.T) {
+	set := keyed.New(func(key string) bucket.Bucket {
+		return mutex.New(leaky.New(1))
+	})
+
+	require.True(t, input(set, "a"))
+	require.False(t, input(set, "a"))
+	require.True(t, input(set, "b"))
+	require.Equal(t, 2, set.Len())
+}
+
+func TestSet_Leak_Evicts(t *testing.T) {
+	set := keyed.New(func(key string) bucket.Bucket {
+		return mutex.New(leaky.New(2))
+	})
+
+	input(set, "a")
+	input(set, "b")
+	input(set, "b")
+	set.Leak()
+
+	require.Equal(t, 1, set.Len())
+	require.True(t, input(set, "b"))
+	require.False(t, input(set, "b"))
+}
+
+func TestSet_Range(t *testing.T) {
+	set := keyed.New(func(key string) bucket.Bucket {
+		return mutex.New(leaky.New(2))
+	})
+
+	input(set, "a")
+	input(set, "b")
+	input(set, "b")
+
+	levels := make(map[string]uint)
+	set.Range(func(key string, b bucket.Bucket) {
+		levels[key], _ = b.(bucket.Meter).Level()
+	})
+	require.Equal(t, map[string]uint{"a": 1, "b": 2}, levels)
+}
+
+func TestSet_Channel(t *testing.T) {
+	set := keyed.New(func(key string) bucket.Bucket {
+		return channel.New(leaky.New(1))
+	})
+	t.Cleanup(set.Stop)
+
+	require.True(t, input(set, "a"))
+	require.False(t, input(set, "a"))
+	set.Leak()
+	require.True(t, input(set, "a"))
+}
+
+func TestSet_Stop(t *testing.T) {
+	set := keyed.New(func(key string) bucket.Bucket {
+		return channel.New(leaky.New(1))
+	})
+
+	input(set, "a")
+	set.Stop()
+
+	require.Zero(t, set.Len())
+}
+
+func TestShared(t *testing.T) {
+	shared := keyed.NewShared(channel.New(leaky.New(1)))
+	t.Cleanup(shared.Stop)
+
+	require.True(t, input(shared, "a"))
+	require.False(t, input(shared, "b"))
+	shared.Leak()
+	require.True(t, input(shared, "b"))
+}
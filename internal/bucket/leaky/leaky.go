@@ -47,9 +47,35 @@ func (lb *Bucket) Input() bool {
 	return false
 }
 
+// InputN tries to increase the internal counter by n.
+//
+// If the counter would go over the limit, this will return false, and the
+// counter is not changed.
+func (lb *Bucket) InputN(n uint) bool {
+	if lb.counter+n <= lb.limit && lb.counter+n >= lb.counter {
+		lb.counter += n
+		return true
+	}
+
+	return false
+}
+
 // Leak decrements the internal counter.
 func (lb *Bucket) Leak() {
 	if lb.counter > 0 {
 		lb.counter--
 	}
 }
+
+// Level returns the internal counter and the limit of the bucket.
+func (lb *Bucket) Level() (level, limit uint) {
+	return lb.counter, lb.limit
+}
+
+// SetLimit changes the maximum capacity of the bucket.
+//
+// If the internal counter is over the new limit, the bucket will not accept
+// inputs until enough leaks bring it below the limit.
+func (lb *Bucket) SetLimit(limit uint) {
+	lb.limit = limit
+}
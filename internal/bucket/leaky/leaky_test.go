@@ -65,3 +65,37 @@ func TestBucket_Leak_OnlyOne(t *testing.T) {
 	require.True(t, bucket.Input())
 	require.False(t, bucket.Input())
 }
+
+func TestBucket_Level(t *testing.T) {
+	bucket := leaky.New(2)
+
+	bucket.Input()
+	level, limit := bucket.Level()
+
+	require.Equal(t, uint(1), level)
+	require.Equal(t, uint(2), limit)
+}
+
+func TestBucket_SetLimit(t *testing.T) {
+	bucket := leaky.New(2)
+	bucket.Input()
+	bucket.Input()
+
+	bucket.SetLimit(1)
+	bucket.Leak()
+	require.False(t, bucket.Input())
+
+	bucket.Leak()
+	require.True(t, bucket.Input())
+}
+
+func TestBucket_InputN(t *testing.T) {
+	bucket := leaky.New(3)
+
+	require.True(t, bucket.InputN(2))
+	require.False(t, bucket.InputN(2))
+	require.True(t, bucket.InputN(1))
+
+	level, _ := bucket.Level()
+	require.Equal(t, uint(3), level)
+}
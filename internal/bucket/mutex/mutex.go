@@ -45,6 +45,16 @@ func (mb *Bucket) Input() bool {
 	return mb.bucket.Input()
 }
 
+// InputN calls the decorated bucket's InputN().
+//
+// See bucket.InputN() for buckets that do not implement bucket.Weighted.
+func (mb *Bucket) InputN(n uint) bool {
+	mb.mtx.Lock()
+	defer mb.mtx.Unlock()
+
+	return bucket.InputN(mb.bucket, n)
+}
+
 // Leak calls the decorated bucket's Leak().
 func (mb *Bucket) Leak() {
 	mb.mtx.Lock()
@@ -52,3 +62,19 @@ func (mb *Bucket) Leak() {
 
 	mb.bucket.Leak()
 }
+
+// Level calls the decorated bucket's Level().
+//
+// If the decorated bucket does not implement bucket.Meter, zeroes are
+// returned.
+func (mb *Bucket) Level() (level, limit uint) {
+	meter, ok := mb.bucket.(bucket.Meter)
+	if !ok {
+		return 0, 0
+	}
+
+	mb.mtx.Lock()
+	defer mb.mtx.Unlock()
+
+	return meter.Level()
+}
@@ -37,6 +37,24 @@ func (mb *mockBucket) Leak() {
 	mb.Called()
 }
 
+type mockWeightedBucket struct {
+	mockBucket
+}
+
+func (mb *mockWeightedBucket) InputN(n uint) bool {
+	args := mb.Called(n)
+	return args.Bool(0)
+}
+
+type mockMeterBucket struct {
+	mockBucket
+}
+
+func (mb *mockMeterBucket) Level() (uint, uint) {
+	args := mb.Called()
+	return args.Get(0).(uint), args.Get(1).(uint)
+}
+
 func TestBucket_Leak(t *testing.T) {
 	mb := new(mockBucket)
 	mb.On("Leak").Return()
@@ -66,3 +84,41 @@ func TestBucket_Input_False(t *testing.T) {
 	mb.AssertCalled(t, "Input")
 	mb.AssertExpectations(t)
 }
+
+func TestBucket_Level(t *testing.T) {
+	mb := new(mockMeterBucket)
+	mb.On("Level").Return(uint(1), uint(2))
+	mutexBucket := mutex.New(mb)
+
+	level, limit := mutexBucket.Level()
+	require.Equal(t, uint(1), level)
+	require.Equal(t, uint(2), limit)
+	mb.AssertExpectations(t)
+}
+
+func TestBucket_Level_NoMeter(t *testing.T) {
+	mb := new(mockBucket)
+	mutexBucket := mutex.New(mb)
+
+	level, limit := mutexBucket.Level()
+	require.Zero(t, level)
+	require.Zero(t, limit)
+}
+
+func TestBucket_InputN(t *testing.T) {
+	mb := new(mockWeightedBucket)
+	mb.On("InputN", uint(3)).Return(true)
+	mutexBucket := mutex.New(mb)
+
+	require.True(t, mutexBucket.InputN(3))
+	mb.AssertExpectations(t)
+}
+
+func TestBucket_InputN_NotWeighted(t *testing.T) {
+	mb := new(mockBucket)
+	mb.On("Input").Return(true)
+	mutexBucket := mutex.New(mb)
+
+	require.True(t, mutexBucket.InputN(3))
+	mb.AssertNumberOfCalls(t, "Input", 3)
+}
@@ -0,0 +1,283 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package timed
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tamasd/ratelimiter/internal/bucket"
+)
+
+type limitSetter interface {
+	SetLimit(limit uint)
+}
+
+// Bucket decorates a bucket with a clock.
+//
+// Instead of relying on a background process, the decorated bucket is leaked
+// every time it is used, based on the time passed since the last leak. This
+// bucket is thread-safe, the decorated bucket does not have to be.
+//
+// Inputs can be reserved in advance when the bucket is full. The reserved
+// inputs are queued up as debt: while there is debt, every leak moves one
+// reserved input into the decorated bucket instead of lowering its level.
+type Bucket struct {
+	mtx      sync.Mutex
+	bucket   bucket.Bucket
+	interval time.Duration
+	last     time.Time
+	debt     uint
+}
+
+// New creates a new timed bucket.
+//
+// The interval parameter is the time between two leaks.
+func New(bucket bucket.Bucket, interval time.Duration) *Bucket {
+	return &Bucket{
+		bucket:   bucket,
+		interval: interval,
+		last:     time.Now(),
+	}
+}
+
+// Input leaks the decorated bucket, and calls its Input().
+//
+// Input fails while there are reserved inputs waiting.
+func (tb *Bucket) Input() bool {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	tb.leak()
+	return tb.debt == 0 && tb.bucket.Input()
+}
+
+// InputN tries to input n units at once.
+//
+// Either all units are accepted, or none of them. This needs a decorated
+// bucket that implements bucket.Meter or bucket.Weighted, otherwise only n = 1
+// can succeed.
+func (tb *Bucket) InputN(n uint) bool {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	tb.leak()
+	if tb.debt > 0 {
+		return false
+	}
+	if _, ok := tb.bucket.(bucket.Weighted); ok {
+		return tb.inputN(n)
+	}
+	if tb.free() < n {
+		return false
+	}
+
+	return tb.inputN(n)
+}
+
+// Reserve reserves n units.
+//
+// If the bucket has enough capacity, the units are accepted immediately, and
+// the returned delay is 0. Otherwise the units that do not fit are queued up,
+// and the returned delay tells when the last one gets into the bucket. The
+// second return value is false, if the units can never fit into the bucket,
+// which is also the case when they do not fit now, and the bucket never leaks.
+func (tb *Bucket) Reserve(n uint) (time.Duration, bool) {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	tb.leak()
+	_, limit := tb.level()
+	if n > limit || (n > 1 && !tb.isMeter()) {
+		return 0, false
+	}
+
+	free := tb.free()
+	if tb.debt == 0 && free >= n {
+		return 0, tb.inputN(n)
+	}
+	if tb.interval <= 0 {
+		return 0, false
+	}
+
+	if tb.debt == 0 {
+		tb.inputN(free)
+		n -= free
+	}
+	tb.debt += n
+
+	return time.Duration(tb.debt)*tb.interval - time.Since(tb.last), true
+}
+
+// Refund gives back n units of earlier inputs or reservations.
+//
+// The reservations waiting in the queue are cancelled first, then the
+// decorated bucket is leaked for the rest.
+func (tb *Bucket) Refund(n uint) {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	tb.leak()
+	if tb.debt >= n {
+		tb.debt -= n
+		return
+	}
+
+	n -= tb.debt
+	tb.debt = 0
+	for i := uint(0); i < n; i++ {
+		tb.bucket.Leak()
+	}
+}
+
+// Leak calls the decorated bucket's Leak().
+func (tb *Bucket) Leak() {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	tb.bucket.Leak()
+}
+
+// Level leaks the decorated bucket, and calls its Level().
+//
+// If the decorated bucket does not implement bucket.Meter, zeroes are
+// returned.
+func (tb *Bucket) Level() (level, limit uint) {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	tb.leak()
+	return tb.level()
+}
+
+// Delay returns the time until the bucket can accept the next input.
+func (tb *Bucket) Delay() time.Duration {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	tb.leak()
+	level, limit := tb.level()
+	if tb.debt == 0 && level < limit {
+		return 0
+	}
+
+	leaks := tb.debt + 1
+	if level > limit {
+		leaks += level - limit
+	}
+
+	return time.Duration(leaks)*tb.interval - time.Since(tb.last)
+}
+
+// SetInterval changes the time between two leaks.
+func (tb *Bucket) SetInterval(interval time.Duration) {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	tb.leak()
+	tb.interval = interval
+}
+
+// SetLimit changes the capacity of the decorated bucket.
+//
+// It does nothing if the decorated bucket's capacity cannot be changed.
+func (tb *Bucket) SetLimit(limit uint) {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	if ls, ok := tb.bucket.(limitSetter); ok {
+		tb.leak()
+		ls.SetLimit(limit)
+	}
+}
+
+// Interval returns the time between two leaks.
+func (tb *Bucket) Interval() time.Duration {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	return tb.interval
+}
+
+func (tb *Bucket) isMeter() bool {
+	_, ok := tb.bucket.(bucket.Meter)
+	return ok
+}
+
+func (tb *Bucket) level() (level, limit uint) {
+	if meter, ok := tb.bucket.(bucket.Meter); ok {
+		return meter.Level()
+	}
+
+	return 0, 0
+}
+
+// free returns the free capacity of the decorated bucket.
+//
+// Buckets without bucket.Meter are assumed to accept one input.
+func (tb *Bucket) free() uint {
+	if !tb.isMeter() {
+		return 1
+	}
+
+	level, limit := tb.level()
+	if level >= limit {
+		return 0
+	}
+
+	return limit - level
+}
+
+// inputN inputs n units into the decorated bucket.
+func (tb *Bucket) inputN(n uint) bool {
+	return bucket.InputN(tb.bucket, n)
+}
+
+// leak leaks the decorated bucket for every interval passed since the last
+// leak.
+//
+// While there is debt, a leak moves a reserved unit into the bucket, so the
+// level does not change.
+func (tb *Bucket) leak() {
+	now := time.Now()
+	if tb.interval <= 0 {
+		tb.debt = 0
+		tb.last = now
+		return
+	}
+
+	leaks := uint(now.Sub(tb.last) / tb.interval)
+	level, _ := tb.level()
+	if tb.isMeter() && leaks >= tb.debt+level {
+		// The bucket drains completely, the remaining time does not matter.
+		for i := uint(0); i < level; i++ {
+			tb.bucket.Leak()
+		}
+		tb.debt = 0
+		tb.last = now
+		return
+	}
+
+	for i := uint(0); i < leaks; i++ {
+		if tb.debt > 0 {
+			tb.debt--
+		} else {
+			tb.bucket.Leak()
+		}
+	}
+	tb.last = tb.last.Add(time.Duration(leaks) * tb.interval)
+}
@@ -0,0 +1,160 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package timed_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter/internal/bucket/leaky"
+	"github.com/tamasd/ratelimiter/internal/bucket/timed"
+)
+
+func TestBucket_Input(t *testing.T) {
+	bucket := timed.New(leaky.New(1), time.Hour)
+
+	require.True(t, bucket.Input())
+	require.False(t, bucket.Input())
+}
+
+func TestBucket_Input_Leaks(t *testing.T) {
+	bucket := timed.New(leaky.New(2), time.Millisecond*20)
+
+	require.True(t, bucket.Input())
+	require.True(t, bucket.Input())
+	require.False(t, bucket.Input())
+
+	<-time.After(time.Millisecond * 50)
+	level, limit := bucket.Level()
+	require.Equal(t, uint(0), level)
+	require.Equal(t, uint(2), limit)
+}
+
+func TestBucket_Delay(t *testing.T) {
+	bucket := timed.New(leaky.New(1), time.Hour)
+
+	require.Zero(t, bucket.Delay())
+	bucket.Input()
+
+	delay := bucket.Delay()
+	require.True(t, delay > 59*time.Minute && delay <= time.Hour)
+}
+
+func TestBucket_Leak(t *testing.T) {
+	bucket := timed.New(leaky.New(1), time.Hour)
+
+	bucket.Input()
+	bucket.Leak()
+
+	require.True(t, bucket.Input())
+}
+
+func TestBucket_SetInterval(t *testing.T) {
+	bucket := timed.New(leaky.New(1), time.Hour)
+	bucket.Input()
+
+	bucket.SetInterval(time.Millisecond)
+	<-time.After(time.Millisecond * 10)
+
+	require.Equal(t, time.Millisecond, bucket.Interval())
+	require.True(t, bucket.Input())
+}
+
+func TestBucket_SetLimit(t *testing.T) {
+	bucket := timed.New(leaky.New(1), time.Hour)
+	bucket.Input()
+
+	bucket.SetLimit(2)
+
+	require.True(t, bucket.Input())
+	require.False(t, bucket.Input())
+}
+
+func TestBucket_InputN(t *testing.T) {
+	bucket := timed.New(leaky.New(3), time.Hour)
+
+	require.True(t, bucket.InputN(2))
+	require.False(t, bucket.InputN(2))
+	require.True(t, bucket.InputN(1))
+}
+
+func TestBucket_Reserve(t *testing.T) {
+	bucket := timed.New(leaky.New(2), time.Hour)
+
+	delay, ok := bucket.Reserve(1)
+	require.True(t, ok)
+	require.Zero(t, delay)
+
+	delay, ok = bucket.Reserve(2)
+	require.True(t, ok)
+	require.True(t, delay > 59*time.Minute && delay <= time.Hour)
+
+	delay, ok = bucket.Reserve(1)
+	require.True(t, ok)
+	require.True(t, delay > 119*time.Minute && delay <= 2*time.Hour)
+
+	require.False(t, bucket.Input())
+}
+
+func TestBucket_Reserve_TooMany(t *testing.T) {
+	bucket := timed.New(leaky.New(2), time.Hour)
+
+	_, ok := bucket.Reserve(3)
+	require.False(t, ok)
+}
+
+func TestBucket_Reserve_NoLeak(t *testing.T) {
+	bucket := timed.New(leaky.New(2), 0)
+
+	_, ok := bucket.Reserve(2)
+	require.True(t, ok)
+
+	_, ok = bucket.Reserve(1)
+	require.False(t, ok)
+	require.False(t, bucket.Input())
+}
+
+func TestBucket_Reserve_Debt(t *testing.T) {
+	bucket := timed.New(leaky.New(1), time.Millisecond*20)
+	bucket.Input()
+
+	delay, ok := bucket.Reserve(1)
+	require.True(t, ok)
+	require.NotZero(t, delay)
+
+	<-time.After(time.Millisecond * 30)
+	level, _ := bucket.Level()
+	require.Equal(t, uint(1), level)
+	require.False(t, bucket.Input())
+
+	<-time.After(time.Millisecond * 30)
+	require.True(t, bucket.Input())
+}
+
+func TestBucket_Refund(t *testing.T) {
+	bucket := timed.New(leaky.New(1), time.Hour)
+	bucket.Input()
+	bucket.Reserve(1)
+
+	bucket.Refund(1)
+	require.False(t, bucket.Input())
+	require.NotZero(t, bucket.Delay())
+
+	bucket.Refund(1)
+	require.True(t, bucket.Input())
+}
@@ -0,0 +1,227 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package penalty
+
+import (
+	"sync"
+	"time"
+)
+
+// Box keeps track of banned keys.
+//
+// Every ban of a key is twice as long as the previous one, until the maximum
+// duration is reached. The offences of a key are forgotten when it has not
+// been banned for the maximum duration. This box is thread-safe.
+type Box struct {
+	mtx     sync.Mutex
+	base    time.Duration
+	max     time.Duration
+	strikes uint
+	window  time.Duration
+	entries map[string]*entry
+}
+
+type entry struct {
+	until       time.Time
+	offences    uint
+	strikes     uint
+	windowStart time.Time
+}
+
+// Ban describes a banned key.
+type Ban struct {
+	Key      string
+	Until    time.Time
+	Offences uint
+}
+
+// New creates a new penalty box.
+//
+// The base parameter is the duration of the first ban, max is the duration of
+// the longest one. If max is shorter than base, every ban lasts for base.
+func New(base, max time.Duration) *Box {
+	if max < base {
+		max = base
+	}
+
+	return &Box{
+		base:    base,
+		max:     max,
+		strikes: 1,
+		entries: make(map[string]*entry),
+	}
+}
+
+// SetStrikes sets how many strikes within the window lead to a ban.
+func (b *Box) SetStrikes(strikes uint, window time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.strikes = strikes
+	b.window = window
+}
+
+// Strike records a strike against a key.
+//
+// If the key collected enough strikes within the window, it is banned, and
+// the duration of the ban is returned. The second return value is true, if
+// the key got banned.
+func (b *Box) Strike(key string) (time.Duration, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	e := b.entry(key, now)
+	if now.Sub(e.windowStart) > b.window {
+		e.strikes = 0
+		e.windowStart = now
+	}
+
+	e.strikes++
+	if e.strikes < b.strikes {
+		return 0, false
+	}
+
+	e.strikes = 0
+	return b.ban(e, now), true
+}
+
+// Ban bans a key, and returns the duration of the ban.
+func (b *Box) Ban(key string) time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	return b.ban(b.entry(key, now), now)
+}
+
+// entry returns the entry of a key, creating a new one if needed.
+func (b *Box) entry(key string, now time.Time) *entry {
+	e, ok := b.entries[key]
+	if !ok || b.expired(e, now) {
+		e = &entry{}
+		b.entries[key] = e
+	}
+
+	return e
+}
+
+func (b *Box) ban(e *entry, now time.Time) time.Duration {
+	duration := b.duration(e.offences)
+	e.until = now.Add(duration)
+	e.offences++
+
+	return duration
+}
+
+// duration returns the length of the ban after the given number of offences.
+func (b *Box) duration(offences uint) time.Duration {
+	duration := b.base
+	for i := uint(0); i < offences && duration < b.max; i++ {
+		duration *= 2
+	}
+	if duration > b.max {
+		duration = b.max
+	}
+
+	return duration
+}
+
+// Banned returns the remaining time of the ban of a key.
+//
+// The second return value is false, if the key is not banned.
+func (b *Box) Banned(key string) (time.Duration, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	e, ok := b.entries[key]
+	if !ok {
+		return 0, false
+	}
+
+	remaining := time.Until(e.until)
+	if remaining <= 0 {
+		return 0, false
+	}
+
+	return remaining, true
+}
+
+// Lift removes the ban of a key.
+//
+// The offences are remembered, so the next ban will be longer.
+func (b *Box) Lift(key string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if e, ok := b.entries[key]; ok {
+		e.until = time.Now()
+	}
+}
+
+// Forget removes the ban and the offences of a key.
+func (b *Box) Forget(key string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	delete(b.entries, key)
+}
+
+// Cleanup removes the keys whose offences are forgotten.
+func (b *Box) Cleanup() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	for key, e := range b.entries {
+		if b.expired(e, now) {
+			delete(b.entries, key)
+		}
+	}
+}
+
+// List returns the keys that are currently banned.
+func (b *Box) List() []Ban {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	bans := []Ban{}
+	for key, e := range b.entries {
+		if e.until.After(now) {
+			bans = append(bans, Ban{
+				Key:      key,
+				Until:    e.until,
+				Offences: e.offences,
+			})
+		}
+	}
+
+	return bans
+}
+
+// Len returns the number of keys in the box.
+func (b *Box) Len() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return len(b.entries)
+}
+
+func (b *Box) expired(e *entry, now time.Time) bool {
+	return now.Sub(e.until) > b.max && now.Sub(e.windowStart) > b.window
+}
@@ -0,0 +1,128 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package penalty_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter/internal/penalty"
+)
+
+func TestBox_Ban(t *testing.T) {
+	box := penalty.New(time.Minute, time.Hour)
+
+	require.Equal(t, time.Minute, box.Ban("a"))
+	remaining, banned := box.Banned("a")
+	require.True(t, banned)
+	require.True(t, remaining > 59*time.Second && remaining <= time.Minute)
+
+	_, banned = box.Banned("b")
+	require.False(t, banned)
+}
+
+func TestBox_Ban_Escalates(t *testing.T) {
+	box := penalty.New(time.Minute, 5*time.Minute)
+
+	require.Equal(t, time.Minute, box.Ban("a"))
+	require.Equal(t, 2*time.Minute, box.Ban("a"))
+	require.Equal(t, 4*time.Minute, box.Ban("a"))
+	require.Equal(t, 5*time.Minute, box.Ban("a"))
+	require.Equal(t, 5*time.Minute, box.Ban("a"))
+}
+
+func TestBox_Ban_NoMax(t *testing.T) {
+	for _, max := range []time.Duration{0, time.Second} {
+		box := penalty.New(time.Minute, max)
+
+		require.Equal(t, time.Minute, box.Ban("a"))
+		require.Equal(t, time.Minute, box.Ban("a"))
+		_, banned := box.Banned("a")
+		require.True(t, banned)
+	}
+}
+
+func TestBox_Lift(t *testing.T) {
+	box := penalty.New(time.Minute, time.Hour)
+	box.Ban("a")
+
+	box.Lift("a")
+	_, banned := box.Banned("a")
+	require.False(t, banned)
+	require.Equal(t, 2*time.Minute, box.Ban("a"))
+}
+
+func TestBox_Forget(t *testing.T) {
+	box := penalty.New(time.Minute, time.Hour)
+	box.Ban("a")
+
+	box.Forget("a")
+	_, banned := box.Banned("a")
+	require.False(t, banned)
+	require.Equal(t, time.Minute, box.Ban("a"))
+}
+
+func TestBox_Cleanup(t *testing.T) {
+	box := penalty.New(time.Millisecond, time.Millisecond*5)
+	box.Ban("a")
+
+	<-time.After(time.Millisecond * 20)
+	box.Cleanup()
+
+	require.Zero(t, box.Len())
+}
+
+func TestBox_Strike(t *testing.T) {
+	box := penalty.New(time.Minute, time.Hour)
+	box.SetStrikes(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		_, banned := box.Strike("a")
+		require.False(t, banned)
+	}
+	duration, banned := box.Strike("a")
+	require.True(t, banned)
+	require.Equal(t, time.Minute, duration)
+
+	_, banned = box.Banned("a")
+	require.True(t, banned)
+}
+
+func TestBox_Strike_Window(t *testing.T) {
+	box := penalty.New(time.Minute, time.Hour)
+	box.SetStrikes(2, time.Millisecond*10)
+
+	box.Strike("a")
+	<-time.After(time.Millisecond * 20)
+	_, banned := box.Strike("a")
+
+	require.False(t, banned)
+}
+
+func TestBox_List(t *testing.T) {
+	box := penalty.New(time.Minute, time.Hour)
+	box.Ban("a")
+	box.Ban("a")
+	box.Ban("b")
+	box.Lift("b")
+
+	bans := box.List()
+	require.Len(t, bans, 1)
+	require.Equal(t, "a", bans[0].Key)
+	require.Equal(t, uint(2), bans[0].Offences)
+}
@@ -0,0 +1,103 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package radix
+
+import (
+	"net/netip"
+)
+
+// Tree is a binary radix tree of IP prefixes.
+//
+// IPv4 prefixes are stored as IPv4-mapped IPv6 prefixes, so a single tree
+// holds both address families. Looking up an address takes at most 128 steps,
+// regardless of the number of prefixes. This tree is not thread-safe.
+type Tree struct {
+	root node
+	size int
+}
+
+type node struct {
+	children [2]*node
+	terminal bool
+}
+
+// New creates an empty tree.
+func New() *Tree {
+	return &Tree{}
+}
+
+// Insert adds a prefix to the tree.
+func (t *Tree) Insert(prefix netip.Prefix) {
+	addr, bits := normalize(prefix.Masked())
+	bytes := addr.As16()
+
+	n := &t.root
+	for i := 0; i < bits; i++ {
+		bit := bitAt(bytes, i)
+		if n.children[bit] == nil {
+			n.children[bit] = &node{}
+		}
+		n = n.children[bit]
+	}
+
+	if !n.terminal {
+		n.terminal = true
+		t.size++
+	}
+}
+
+// Contains reports whether any prefix in the tree contains the address.
+func (t *Tree) Contains(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+
+	bytes := addr.As16()
+	n := &t.root
+	for i := 0; ; i++ {
+		if n.terminal {
+			return true
+		}
+		if i == 128 {
+			return false
+		}
+
+		n = n.children[bitAt(bytes, i)]
+		if n == nil {
+			return false
+		}
+	}
+}
+
+// Len returns the number of prefixes in the tree.
+func (t *Tree) Len() int {
+	return t.size
+}
+
+// normalize maps IPv4 prefixes into the IPv6 address space.
+func normalize(prefix netip.Prefix) (netip.Addr, int) {
+	addr := prefix.Addr()
+	if addr.Is4() {
+		return netip.AddrFrom16(addr.As16()), prefix.Bits() + 96
+	}
+
+	return addr, prefix.Bits()
+}
+
+func bitAt(bytes [16]byte, i int) int {
+	return int(bytes[i/8]>>(7-uint(i%8))) & 1
+}
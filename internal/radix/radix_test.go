@@ -0,0 +1,70 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package radix_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter/internal/radix"
+)
+
+func TestTree_IPv4(t *testing.T) {
+	tree := radix.New()
+	tree.Insert(netip.MustParsePrefix("10.0.0.0/8"))
+	tree.Insert(netip.MustParsePrefix("192.168.1.0/24"))
+
+	require.True(t, tree.Contains(netip.MustParseAddr("10.1.2.3")))
+	require.True(t, tree.Contains(netip.MustParseAddr("192.168.1.200")))
+	require.False(t, tree.Contains(netip.MustParseAddr("192.168.2.1")))
+	require.False(t, tree.Contains(netip.MustParseAddr("11.0.0.1")))
+}
+
+func TestTree_IPv6(t *testing.T) {
+	tree := radix.New()
+	tree.Insert(netip.MustParsePrefix("2001:db8::/32"))
+
+	require.True(t, tree.Contains(netip.MustParseAddr("2001:db8::1")))
+	require.False(t, tree.Contains(netip.MustParseAddr("2001:db9::1")))
+	require.False(t, tree.Contains(netip.MustParseAddr("10.0.0.1")))
+}
+
+func TestTree_MappedIPv4(t *testing.T) {
+	tree := radix.New()
+	tree.Insert(netip.MustParsePrefix("10.0.0.0/8"))
+
+	require.True(t, tree.Contains(netip.MustParseAddr("::ffff:10.0.0.1")))
+}
+
+func TestTree_SingleAddress(t *testing.T) {
+	tree := radix.New()
+	tree.Insert(netip.MustParsePrefix("10.0.0.1/32"))
+	tree.Insert(netip.MustParsePrefix("10.0.0.1/32"))
+
+	require.Equal(t, 1, tree.Len())
+	require.True(t, tree.Contains(netip.MustParseAddr("10.0.0.1")))
+	require.False(t, tree.Contains(netip.MustParseAddr("10.0.0.2")))
+}
+
+func TestTree_Everything(t *testing.T) {
+	tree := radix.New()
+	tree.Insert(netip.MustParsePrefix("::/0"))
+
+	require.True(t, tree.Contains(netip.MustParseAddr("10.0.0.1")))
+	require.False(t, tree.Contains(netip.Addr{}))
+}
@@ -0,0 +1,45 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package remote contains the helpers shared by the backends that store their
+// buckets outside of the process, in another service, a file or shared memory.
+package remote
+
+import (
+	"context"
+	"time"
+)
+
+// ErrorFunc receives the errors of the backend, with the key of the bucket, or
+// an empty key for background operations.
+type ErrorFunc func(key string, err error)
+
+// Report calls the function with the error, if the function is set.
+func (f ErrorFunc) Report(key string, err error) {
+	if f != nil {
+		f(key, err)
+	}
+}
+
+// Context returns the context of a call to the service. The context is
+// cancelled after the timeout, if the timeout is positive.
+func Context(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), timeout)
+}
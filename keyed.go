@@ -0,0 +1,174 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// KeyedLimiter manages a separate Limiter for every key.
+//
+// This is useful for limits that apply to tenants, devices or users, outside
+// of HTTP. The limiters are created on first use, and the ones that have been
+// idle for too long are removed by Evict(). Every key uses the default
+// configuration, unless it is overridden with SetConfig().
+type KeyedLimiter[K comparable] struct {
+	config      LimiterConfig
+	idleTimeout time.Duration
+
+	mtx       sync.Mutex
+	overrides map[K]LimiterConfig
+	limiters  map[K]*keyedLimiterEntry
+
+	quitch chan struct{}
+}
+
+type keyedLimiterEntry struct {
+	limiter  *Limiter
+	lastUsed time.Time
+}
+
+// NewKeyedLimiter creates a new keyed limiter.
+//
+// The config parameter is the default configuration of the limiters. The
+// limiters unused for idleTimeout are removed by Evict(), if they are
+// completely drained.
+func NewKeyedLimiter[K comparable](config LimiterConfig, idleTimeout time.Duration) *KeyedLimiter[K] {
+	return &KeyedLimiter[K]{
+		config:      config,
+		idleTimeout: idleTimeout,
+		overrides:   make(map[K]LimiterConfig),
+		limiters:    make(map[K]*keyedLimiterEntry),
+		quitch:      make(chan struct{}),
+	}
+}
+
+// SetConfig overrides the configuration of a key.
+//
+// If the key already has a limiter, it is replaced with a new one.
+func (kl *KeyedLimiter[K]) SetConfig(key K, config LimiterConfig) {
+	kl.mtx.Lock()
+	defer kl.mtx.Unlock()
+
+	kl.overrides[key] = config
+	delete(kl.limiters, key)
+}
+
+// ResetConfig removes the configuration override of a key.
+func (kl *KeyedLimiter[K]) ResetConfig(key K) {
+	kl.mtx.Lock()
+	defer kl.mtx.Unlock()
+
+	delete(kl.overrides, key)
+	delete(kl.limiters, key)
+}
+
+// Limiter returns the limiter of a key.
+//
+// The limiter is created, if the key does not have one yet.
+func (kl *KeyedLimiter[K]) Limiter(key K) *Limiter {
+	kl.mtx.Lock()
+	defer kl.mtx.Unlock()
+
+	entry, ok := kl.limiters[key]
+	if !ok {
+		config, overridden := kl.overrides[key]
+		if !overridden {
+			config = kl.config
+		}
+		entry = &keyedLimiterEntry{
+			limiter: NewLimiter(config),
+		}
+		kl.limiters[key] = entry
+	}
+	entry.lastUsed = time.Now()
+
+	return entry.limiter
+}
+
+// Allow reports whether an event of the key can happen now.
+func (kl *KeyedLimiter[K]) Allow(key K) bool {
+	return kl.Limiter(key).Allow()
+}
+
+// AllowN reports whether n events of the key can happen now.
+func (kl *KeyedLimiter[K]) AllowN(key K, n uint) bool {
+	return kl.Limiter(key).AllowN(n)
+}
+
+// Wait blocks until an event of the key can happen, or the context is done.
+func (kl *KeyedLimiter[K]) Wait(ctx context.Context, key K) error {
+	return kl.Limiter(key).Wait(ctx)
+}
+
+// Reserve reserves capacity for n events of the key.
+func (kl *KeyedLimiter[K]) Reserve(key K, n uint) *Reservation {
+	return kl.Limiter(key).Reserve(n)
+}
+
+// Len returns the number of keys with a limiter.
+func (kl *KeyedLimiter[K]) Len() int {
+	kl.mtx.Lock()
+	defer kl.mtx.Unlock()
+
+	return len(kl.limiters)
+}
+
+// Evict removes the limiters that are idle.
+//
+// A limiter is removed, if it was not used for the idle timeout, and it is
+// completely drained, so removing it does not reset the limit of the key.
+func (kl *KeyedLimiter[K]) Evict() {
+	kl.mtx.Lock()
+	defer kl.mtx.Unlock()
+
+	for key, entry := range kl.limiters {
+		if time.Since(entry.lastUsed) >= kl.idleTimeout && entry.limiter.idle() {
+			delete(kl.limiters, key)
+		}
+	}
+}
+
+// Start calls Evict() periodically, until Stop() is called.
+//
+// Evict() is called every idle timeout, or every second if the idle timeout
+// is not positive.
+func (kl *KeyedLimiter[K]) Start() {
+	interval := kl.idleTimeout
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			kl.Evict()
+		case <-kl.quitch:
+			return
+		}
+	}
+}
+
+// Stop stops the eviction loop.
+func (kl *KeyedLimiter[K]) Stop() {
+	close(kl.quitch)
+}
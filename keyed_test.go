@@ -0,0 +1,91 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	limiter := ratelimiter.NewKeyedLimiter[int](ratelimiter.CreateLimiterConfig(1), time.Minute)
+
+	require.True(t, limiter.Allow(1))
+	require.False(t, limiter.Allow(1))
+	require.True(t, limiter.Allow(2))
+	require.Equal(t, 2, limiter.Len())
+}
+
+func TestKeyedLimiter_SetConfig(t *testing.T) {
+	limiter := ratelimiter.NewKeyedLimiter[string](ratelimiter.CreateLimiterConfig(1), time.Minute)
+	limiter.SetConfig("premium", ratelimiter.CreateLimiterConfig(3))
+
+	require.True(t, limiter.AllowN("premium", 3))
+	require.False(t, limiter.AllowN("basic", 3))
+
+	limiter.ResetConfig("premium")
+	require.False(t, limiter.AllowN("premium", 3))
+}
+
+func TestKeyedLimiter_Evict(t *testing.T) {
+	limiter := ratelimiter.NewKeyedLimiter[string](ratelimiter.CreateLimiterConfig(100), time.Millisecond*10)
+	limiter.Allow("a")
+	limiter.Allow("b")
+
+	<-time.After(time.Millisecond * 50)
+	limiter.Allow("b")
+	limiter.Evict()
+
+	require.Equal(t, 1, limiter.Len())
+}
+
+func TestKeyedLimiter_Evict_NotDrained(t *testing.T) {
+	limiter := ratelimiter.NewKeyedLimiter[string](ratelimiter.CreateLimiterConfig(1), 0)
+	limiter.Allow("a")
+
+	limiter.Evict()
+
+	require.Equal(t, 1, limiter.Len())
+	require.False(t, limiter.Allow("a"))
+}
+
+func TestKeyedLimiter_Start(t *testing.T) {
+	limiter := ratelimiter.NewKeyedLimiter[string](ratelimiter.CreateLimiterConfig(100), time.Millisecond*10)
+	go limiter.Start()
+	t.Cleanup(limiter.Stop)
+
+	require.NoError(t, limiter.Wait(context.Background(), "a"))
+	require.True(t, limiter.Reserve("a", 1).OK())
+
+	<-time.After(time.Millisecond * 100)
+	require.Zero(t, limiter.Len())
+}
+
+func TestKeyedLimiter_Start_ZeroIdleTimeout(t *testing.T) {
+	limiter := ratelimiter.NewKeyedLimiter[string](ratelimiter.CreateLimiterConfig(100), 0)
+	go limiter.Start()
+	t.Cleanup(limiter.Stop)
+
+	require.NoError(t, limiter.Wait(context.Background(), "a"))
+	require.Eventually(t, func() bool {
+		return limiter.Len() == 0
+	}, time.Second*2, time.Millisecond*10)
+}
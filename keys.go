@@ -0,0 +1,69 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// KeyFunc returns the key of the bucket a request is counted against.
+type KeyFunc func(r *http.Request) string
+
+// ClientIP uses the IP address of the client as the key.
+//
+// The address comes from the connection, so behind a reverse proxy this is
+// the address of the proxy. Use HeaderKey() with the header set by the proxy
+// in that case.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// HeaderKey uses the value of a request header as the key.
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// FormValueKey uses a form value as the key, e.g. the username of a login
+// form.
+//
+// The form is parsed from both the URL and the body of the request.
+func FormValueKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.FormValue(name)
+	}
+}
+
+// CombineKeys joins the keys of multiple key functions.
+func CombineKeys(keyFuncs ...KeyFunc) KeyFunc {
+	return func(r *http.Request) string {
+		keys := make([]string, len(keyFuncs))
+		for i, keyFunc := range keyFuncs {
+			keys[i] = keyFunc(r)
+		}
+
+		return strings.Join(keys, "|")
+	}
+}
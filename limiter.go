@@ -0,0 +1,184 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tamasd/ratelimiter/internal/bucket/leaky"
+	"github.com/tamasd/ratelimiter/internal/bucket/timed"
+)
+
+// ErrRateLimited is returned when the rate limit does not allow an operation.
+//
+// The Transport returns this error in fail fast mode, and the Limiter returns
+// it when more events are waited for than the burst of the limiter.
+var ErrRateLimited = errors.New("ratelimiter: rate limit exceeded")
+
+// LimiterConfig holds the configuration for the Limiter type.
+type LimiterConfig struct {
+	requestPerSecond uint
+	burst            uint
+}
+
+// CreateLimiterConfig creates the configuration for the limiter.
+//
+// The requestPerSecond parameter tells the limiter how many events per second
+// it can let through. By default the limiter lets through the same number of
+// events in a burst.
+func CreateLimiterConfig(requestPerSecond uint) LimiterConfig {
+	return LimiterConfig{
+		requestPerSecond: requestPerSecond,
+		burst:            requestPerSecond,
+	}
+}
+
+// SetBurst sets the capacity of the limiter.
+//
+// This is the number of events that can be let through at once, after the
+// limiter has been idle for long enough.
+func (lc *LimiterConfig) SetBurst(burst uint) {
+	lc.burst = burst
+}
+
+func (lc LimiterConfig) leakInterval() time.Duration {
+	if lc.requestPerSecond == 0 {
+		return 0
+	}
+
+	return time.Second / time.Duration(lc.requestPerSecond)
+}
+
+// Limiter is a general-purpose rate limiter.
+//
+// Unlike the Middleware, the Limiter does not depend on HTTP, so it can be
+// used in workers, queue consumers and command line tools. The Limiter does
+// not need to be started, the bucket is leaked based on the elapsed time.
+type Limiter struct {
+	bucket *timed.Bucket
+}
+
+// NewLimiter creates a new limiter.
+func NewLimiter(config LimiterConfig) *Limiter {
+	return &Limiter{
+		bucket: timed.New(leaky.New(config.burst), config.leakInterval()),
+	}
+}
+
+// Allow reports whether an event can happen now.
+//
+// If it can, the event is counted.
+func (l *Limiter) Allow() bool {
+	return l.AllowN(1)
+}
+
+// AllowN reports whether n events can happen now.
+//
+// Either all n events are counted, or none of them.
+func (l *Limiter) AllowN(n uint) bool {
+	return l.bucket.InputN(n)
+}
+
+// Wait blocks until an event can happen, or the context is done.
+func (l *Limiter) Wait(ctx context.Context) error {
+	return l.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n events can happen, or the context is done.
+//
+// If the context is done first, the reserved capacity is given back. If the
+// events can never happen, because n is larger than the burst, or the limiter
+// does not refill, ErrRateLimited is returned.
+func (l *Limiter) WaitN(ctx context.Context, n uint) error {
+	r := l.Reserve(n)
+	if !r.OK() {
+		return ErrRateLimited
+	}
+
+	if err := sleep(ctx, r.Delay()); err != nil {
+		r.Cancel()
+		return err
+	}
+
+	return nil
+}
+
+// Reserve reserves capacity for n events.
+//
+// The returned reservation tells how long the caller must wait before the
+// events can happen. If the caller decides not to go ahead, Cancel() gives
+// back the reserved capacity. If n is larger than the burst, the reservation
+// is not OK.
+func (l *Limiter) Reserve(n uint) *Reservation {
+	delay, ok := l.bucket.Reserve(n)
+
+	return &Reservation{
+		bucket: l.bucket,
+		ok:     ok,
+		n:      n,
+		at:     time.Now().Add(delay),
+	}
+}
+
+// Reservation holds capacity reserved by Limiter.Reserve().
+type Reservation struct {
+	bucket *timed.Bucket
+	ok     bool
+	n      uint
+	at     time.Time
+
+	cancelOnce sync.Once
+}
+
+// OK reports whether the capacity could be reserved.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns the time until the reserved events can happen.
+func (r *Reservation) Delay() time.Duration {
+	if delay := time.Until(r.at); delay > 0 {
+		return delay
+	}
+
+	return 0
+}
+
+// Cancel gives back the reserved capacity.
+//
+// Cancelling a reservation after its delay is over does nothing, because the
+// events are assumed to have happened.
+func (r *Reservation) Cancel() {
+	if !r.ok || r.Delay() == 0 {
+		return
+	}
+
+	r.cancelOnce.Do(func() {
+		r.bucket.Refund(r.n)
+	})
+}
+
+// idle reports whether the limiter is completely drained.
+//
+// A drained limiter behaves the same way as a new one.
+func (l *Limiter) idle() bool {
+	level, _ := l.bucket.Level()
+	return level == 0
+}
@@ -0,0 +1,103 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	limiter := ratelimiter.NewLimiter(ratelimiter.CreateLimiterConfig(2))
+
+	require.True(t, limiter.Allow())
+	require.True(t, limiter.Allow())
+	require.False(t, limiter.Allow())
+}
+
+func TestLimiter_AllowN(t *testing.T) {
+	config := ratelimiter.CreateLimiterConfig(1)
+	(&config).SetBurst(5)
+	limiter := ratelimiter.NewLimiter(config)
+
+	require.True(t, limiter.AllowN(3))
+	require.False(t, limiter.AllowN(3))
+	require.True(t, limiter.AllowN(2))
+}
+
+func TestLimiter_Wait(t *testing.T) {
+	limiter := ratelimiter.NewLimiter(ratelimiter.CreateLimiterConfig(20))
+	for limiter.Allow() {
+	}
+
+	start := time.Now()
+	require.NoError(t, limiter.Wait(context.Background()))
+	require.True(t, time.Since(start) >= time.Millisecond*10)
+}
+
+func TestLimiter_Wait_Cancel(t *testing.T) {
+	limiter := ratelimiter.NewLimiter(ratelimiter.CreateLimiterConfig(1))
+	require.True(t, limiter.Allow())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	require.True(t, errors.Is(limiter.Wait(ctx), context.DeadlineExceeded))
+
+	// The cancelled wait gave back its reservation.
+	r := limiter.Reserve(1)
+	require.True(t, r.OK())
+	require.True(t, r.Delay() <= time.Second)
+}
+
+func TestLimiter_WaitN_TooMany(t *testing.T) {
+	limiter := ratelimiter.NewLimiter(ratelimiter.CreateLimiterConfig(1))
+
+	require.True(t, errors.Is(limiter.WaitN(context.Background(), 2), ratelimiter.ErrRateLimited))
+}
+
+func TestLimiter_Wait_ZeroRate(t *testing.T) {
+	config := ratelimiter.CreateLimiterConfig(0)
+	(&config).SetBurst(2)
+	limiter := ratelimiter.NewLimiter(config)
+
+	require.NoError(t, limiter.WaitN(context.Background(), 2))
+	require.True(t, errors.Is(limiter.Wait(context.Background()), ratelimiter.ErrRateLimited))
+	require.False(t, limiter.Allow())
+}
+
+func TestLimiter_Reserve(t *testing.T) {
+	limiter := ratelimiter.NewLimiter(ratelimiter.CreateLimiterConfig(1))
+
+	r := limiter.Reserve(1)
+	require.True(t, r.OK())
+	require.Zero(t, r.Delay())
+
+	r = limiter.Reserve(1)
+	require.True(t, r.OK())
+	require.True(t, r.Delay() > 0)
+	require.False(t, limiter.Allow())
+
+	r.Cancel()
+	r.Cancel()
+	r = limiter.Reserve(1)
+	require.True(t, r.Delay() > 0 && r.Delay() <= time.Second)
+}
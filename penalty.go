@@ -0,0 +1,89 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Ban describes a key banned by the penalty box of the middleware.
+type Ban struct {
+	Key      string    `json:"key"`
+	Until    time.Time `json:"until"`
+	Offences uint      `json:"offences"`
+}
+
+// Bans returns the keys that are currently banned, ordered by key.
+//
+// The list is empty, if the penalty box is not turned on.
+func (m *Middleware) Bans() []Ban {
+	bans := []Ban{}
+	if m.penalties == nil {
+		return bans
+	}
+
+	for _, ban := range m.penalties.List() {
+		bans = append(bans, Ban{
+			Key:      ban.Key,
+			Until:    ban.Until,
+			Offences: ban.Offences,
+		})
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Key < bans[j].Key
+	})
+
+	return bans
+}
+
+// Lift removes the ban of a key.
+//
+// The offences of the key are remembered, so its next ban will be longer.
+func (m *Middleware) Lift(key string) {
+	if m.penalties != nil {
+		m.penalties.Lift(key)
+	}
+}
+
+// BansHandler returns an administrative handler for the penalty box.
+//
+// GET requests list the bans as JSON, DELETE requests lift the ban of the key
+// given in the "key" query parameter. Make sure that this handler is not
+// exposed to the public.
+func (m *Middleware) BansHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(m.Bans())
+		case http.MethodDelete:
+			key := r.URL.Query().Get("key")
+			if key == "" {
+				http.Error(w, "missing key", http.StatusBadRequest)
+				return
+			}
+			m.Lift(key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
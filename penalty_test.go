@@ -0,0 +1,155 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func createPenaltyMiddleware() *ratelimiter.Middleware {
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetPenalty(2, time.Minute, time.Minute, time.Hour)
+
+	return ratelimiter.New(config)
+}
+
+func TestPenalty(t *testing.T) {
+	mw := createPenaltyMiddleware()
+
+	require.True(t, mw.Check("a").Allowed)
+	require.False(t, mw.Check("a").Banned)
+	decision := mw.Check("a")
+	require.True(t, decision.Banned)
+	require.Equal(t, time.Minute, decision.RetryAfter)
+
+	mw.Reset("a")
+	decision = mw.Check("a")
+	require.False(t, decision.Allowed)
+	require.True(t, decision.Banned)
+	require.True(t, mw.Check("b").Allowed)
+}
+
+func TestPenalty_Lift(t *testing.T) {
+	mw := createPenaltyMiddleware()
+	for i := 0; i < 3; i++ {
+		mw.Check("a")
+	}
+
+	bans := mw.Bans()
+	require.Len(t, bans, 1)
+	require.Equal(t, "a", bans[0].Key)
+
+	mw.Lift("a")
+	mw.Reset("a")
+	require.Empty(t, mw.Bans())
+	require.True(t, mw.Check("a").Allowed)
+}
+
+func TestPenalty_DryRun(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetPenalty(2, time.Minute, time.Minute, time.Hour)
+	(&config).SetDryRun(true, nil)
+	mw := ratelimiter.New(config)
+
+	for i := 0; i < 10; i++ {
+		require.False(t, mw.Check("a").Banned)
+	}
+	require.Empty(t, mw.Bans())
+}
+
+func TestPenalty_Rollout(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetPenalty(2, time.Minute, time.Minute, time.Hour)
+	(&config).SetRollout(0)
+	mw := ratelimiter.New(config)
+
+	for i := 0; i < 10; i++ {
+		require.False(t, mw.Check("a").Banned)
+	}
+	require.Empty(t, mw.Bans())
+
+	// The rejections outside of the rollout are not counted.
+	mw.SetRollout(100)
+	require.False(t, mw.Check("a").Banned)
+	require.True(t, mw.Check("a").Banned)
+}
+
+func TestPenalty_Disabled(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(1))
+	for i := 0; i < 10; i++ {
+		require.False(t, mw.Check("a").Banned)
+	}
+
+	require.Empty(t, mw.Bans())
+}
+
+func TestPenalty_ZeroBan(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetPenalty(2, time.Minute, 0, time.Hour)
+	mw := ratelimiter.New(config)
+	go mw.Start()
+	defer mw.Stop()
+
+	for i := 0; i < 5; i++ {
+		require.False(t, mw.Check("a").Banned)
+	}
+	require.Empty(t, mw.Bans())
+}
+
+func TestPenalty_NoMaxBan(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetPenalty(2, time.Minute, time.Minute, 0)
+	mw := ratelimiter.New(config)
+
+	for i := 0; i < 3; i++ {
+		mw.Check("a")
+	}
+	decision := mw.Check("a")
+	require.True(t, decision.Banned)
+	require.True(t, decision.RetryAfter > 59*time.Second)
+}
+
+func TestBansHandler(t *testing.T) {
+	mw := createPenaltyMiddleware()
+	for i := 0; i < 3; i++ {
+		mw.Check("a")
+	}
+	handler := mw.BansHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	var bans []ratelimiter.Ban
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&bans))
+	require.Len(t, bans, 1)
+	require.Equal(t, uint(1), bans[0].Offences)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/?key=a", nil))
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	require.Empty(t, mw.Bans())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Result().StatusCode)
+}
@@ -17,27 +17,46 @@
 package ratelimiter
 
 import (
+	"fmt"
 	"math/rand"
 	"net/http"
 	"strconv"
 	"time"
 
-	"github.com/tamasd/ratelimiter/internal/bucket"
+	"github.com/tamasd/ratelimiter/bucket"
 	"github.com/tamasd/ratelimiter/internal/bucket/channel"
+	"github.com/tamasd/ratelimiter/internal/bucket/keyed"
 	"github.com/tamasd/ratelimiter/internal/bucket/leaky"
 	"github.com/tamasd/ratelimiter/internal/bucket/mutex"
+	"github.com/tamasd/ratelimiter/internal/penalty"
 )
 
-type startStop interface {
-	Start()
-	Stop()
-}
-
 // MiddlewareConfig holds the configuration for the Middleware type.
 type MiddlewareConfig struct {
 	requestPerSecond uint
+	window           time.Duration
 	retryDelay       uint
 	random           uint
+	keyFunc          KeyFunc
+	costFunc         CostFunc
+	chargeFunc       ChargeFunc
+	penalty          penaltyConfig
+	access           accessControl
+	bypass           bypassConfig
+	dryRun           bool
+	dryRunFunc       DecisionFunc
+	shadow           *MiddlewareConfig
+	shadowFunc       ShadowFunc
+	rollout          uint
+	rolloutKeyFunc   KeyFunc
+	snapshot         snapshotConfig
+}
+
+type penaltyConfig struct {
+	rejections uint
+	window     time.Duration
+	ban        time.Duration
+	maxBan     time.Duration
 }
 
 // CreateMiddlewareConfig creates the configration for the middleware.
@@ -47,11 +66,30 @@ type MiddlewareConfig struct {
 func CreateMiddlewareConfig(requestPerSecond uint) MiddlewareConfig {
 	return MiddlewareConfig{
 		requestPerSecond: requestPerSecond,
+		window:           time.Second,
 		retryDelay:       1,
 		random:           5,
+		rollout:          100,
 	}
 }
 
+// SetWindow sets the length of the time window of the limit.
+//
+// By default the limit applies to one second. With a longer window, limits
+// like 5 requests per 15 minutes can be configured.
+func (mc *MiddlewareConfig) SetWindow(window time.Duration) {
+	mc.window = window
+}
+
+// SetKeyFunc sets how the requests are grouped into buckets.
+//
+// Every key has its own bucket. By default every request shares the same
+// bucket. See ClientIP(), HeaderKey(), FormValueKey() and CombineKeys() for
+// the built-in key functions.
+func (mc *MiddlewareConfig) SetKeyFunc(keyFunc KeyFunc) {
+	mc.keyFunc = keyFunc
+}
+
 // SetRetryDelay sets the dynamic delay values of the middleware.
 //
 // When the middleware rejects a request, it sends a Retry-After header to ask
@@ -66,17 +104,208 @@ func (mc *MiddlewareConfig) SetRetryDelay(retryDelay, random uint) {
 	mc.random = random
 }
 
+// SetCostFunc sets how much a request fills the bucket.
+//
+// By default every request costs 1. See MethodCost(), RouteCost() and
+// ContentLengthCost() for the built-in cost functions.
+func (mc *MiddlewareConfig) SetCostFunc(costFunc CostFunc) {
+	mc.costFunc = costFunc
+}
+
+// SetChargeFunc sets how the real cost of a request is calculated, after the
+// next handler responded.
+//
+// This is useful when the cost depends on the response, e.g. the status code,
+// the size of the body or the time the handler took. See StatusCharge(),
+// LatencyCharge() and SizeCharge() for the built-in charge functions.
+func (mc *MiddlewareConfig) SetChargeFunc(chargeFunc ChargeFunc) {
+	mc.chargeFunc = chargeFunc
+}
+
+// SetPenalty turns on banning the keys that keep hitting the limit.
+//
+// When a key is rejected the given number of times within the window, it is
+// banned for the ban duration. Every further ban of the key is twice as long,
+// up to maxBan, or every ban is as long as the first one if maxBan is shorter.
+// The requests of banned keys are rejected without consulting
+// the bucket. Only the enforced rejections count, not the ones in dry-run mode
+// or outside of the rollout. Zero rejections or a non-positive ban turns the
+// penalty off.
+func (mc *MiddlewareConfig) SetPenalty(rejections uint, window, ban, maxBan time.Duration) {
+	mc.penalty = penaltyConfig{
+		rejections: rejections,
+		window:     window,
+		ban:        ban,
+		maxBan:     maxBan,
+	}
+}
+
+// SetAllowList sets the requests that bypass the limiter.
+//
+// Requests are allowed, if the client IP is in one of the CIDRs of the list,
+// or the key of the request or the value of the access header is one of the
+// keys of the list.
+func (mc *MiddlewareConfig) SetAllowList(allow AccessListSource) {
+	mc.access.allow = allow
+}
+
+// SetDenyList sets the requests that are blocked with 403 Forbidden.
+//
+// The deny list is matched the same way as the allow list, and it is checked
+// first.
+func (mc *MiddlewareConfig) SetDenyList(deny AccessListSource) {
+	mc.access.deny = deny
+}
+
+// SetAccessHeader sets the request header, whose value is matched against the
+// keys of the access lists, e.g. X-API-Key.
+func (mc *MiddlewareConfig) SetAccessHeader(header string) {
+	mc.access.header = header
+}
+
+// SetBypass lets the requests with a valid bypass token skip the limiter.
+//
+// The token is read from the given header, which defaults to
+// DefaultBypassHeader. See BypassSigner for minting the tokens.
+func (mc *MiddlewareConfig) SetBypass(signer *BypassSigner, header string) {
+	if header == "" {
+		header = DefaultBypassHeader
+	}
+
+	mc.bypass.signer = signer
+	mc.bypass.header = header
+}
+
+// SetBypassLimit moves the requests with a valid bypass token to a separate
+// limit, instead of letting them skip the limiter.
+func (mc *MiddlewareConfig) SetBypassLimit(requestPerSecond uint) {
+	mc.bypass.requestPerSecond = requestPerSecond
+}
+
+// SetDryRun turns the dry-run mode on or off.
+//
+// In dry-run mode the buckets are evaluated as usual, but the requests are
+// never rejected. The decisions that would have rejected a request are passed
+// to report, which may be nil.
+func (mc *MiddlewareConfig) SetDryRun(dryRun bool, report DecisionFunc) {
+	mc.dryRun = dryRun
+	mc.dryRunFunc = report
+}
+
+// SetShadow evaluates a candidate policy next to the active one.
+//
+// The shadow policy has its own buckets, and it never rejects a request. It
+// uses its own key and cost functions, so a candidate with a different key or
+// cost can be tried as well. Both decisions are passed to report, so the
+// policies can be compared before switching to the candidate.
+func (mc *MiddlewareConfig) SetShadow(candidate MiddlewareConfig, report ShadowFunc) {
+	candidate.shadow = nil
+	candidate.dryRun = true
+	candidate.dryRunFunc = nil
+
+	mc.shadow = &candidate
+	mc.shadowFunc = report
+}
+
+// SetRollout sets the initial percentage of the keys the limit is enforced
+// for. See Middleware.SetRollout.
+func (mc *MiddlewareConfig) SetRollout(percent uint) {
+	mc.rollout = percent
+}
+
+// SetRolloutKeyFunc sets how the requests are selected for the rollout.
+//
+// By default the rollout is decided by the key of the request, so the limit
+// is rolled out to the buckets. A different key function, e.g. one that
+// returns the tenant of the request, rolls the limit out to the tenants
+// instead, while the buckets are still kept by the key of the request.
+// The transport-independent Check() and CheckN() use the key of the bucket.
+func (mc *MiddlewareConfig) SetRolloutKeyFunc(keyFunc KeyFunc) {
+	mc.rolloutKeyFunc = keyFunc
+}
+
+// SetSnapshotFile keeps the state of the buckets across restarts.
+//
+// The snapshot file is restored when the middleware is created, and written
+// by Stop(). The errors are passed to errorFunc, which may be nil. A missing
+// snapshot file is not an error.
+//
+// Only the in-memory buckets are saved; the buckets of the backends that keep
+// their state outside of the process are not.
+func (mc *MiddlewareConfig) SetSnapshotFile(path string, errorFunc func(err error)) {
+	mc.snapshot = snapshotConfig{
+		path:      path,
+		errorFunc: errorFunc,
+	}
+}
+
+func (mc MiddlewareConfig) key(r *http.Request) string {
+	if mc.keyFunc == nil {
+		return ""
+	}
+
+	return mc.keyFunc(r)
+}
+
+func (mc MiddlewareConfig) rolloutKey(r *http.Request, key string) string {
+	if mc.rolloutKeyFunc == nil {
+		return key
+	}
+
+	return mc.rolloutKeyFunc(r)
+}
+
+func (mc MiddlewareConfig) cost(r *http.Request) uint {
+	if mc.costFunc == nil {
+		return 1
+	}
+
+	return mc.costFunc(r)
+}
+
 func (mc MiddlewareConfig) delay() uint {
 	return mc.retryDelay + uint(rand.Intn(int(mc.random)))
 }
 
+// leakInterval returns the time between two leaks of the bucket.
+func (mc MiddlewareConfig) leakInterval() time.Duration {
+	if mc.requestPerSecond == 0 {
+		return 0
+	}
+
+	return mc.window / time.Duration(mc.requestPerSecond)
+}
+
+// policy returns the configured limit in the RateLimit-Policy header format.
+func (mc MiddlewareConfig) policy() string {
+	return fmt.Sprintf("%d;w=%d", mc.requestPerSecond, mc.window/time.Second)
+}
+
+// bucketSet holds the buckets of the middleware.
+type bucketSet interface {
+	With(key string, f func(bucket bucket.Bucket))
+	Range(f func(key string, bucket bucket.Bucket))
+	Leak()
+	Stop()
+}
+
+// refunder is implemented by buckets that can give back units directly, like
+// the timed bucket and the remote backends, which don't leak on Leak().
+type refunder interface {
+	Refund(n uint)
+}
+
 // Middleware is the rate limiter middleware.
 //
 // When using this middleware, make sure that you call Start() before starting
 // the http server.
 type Middleware struct {
-	config MiddlewareConfig
-	bucket bucket.Bucket
+	config    MiddlewareConfig
+	buckets   bucketSet
+	penalties *penalty.Box
+	bypass    *Middleware
+	shadow    *Middleware
+	rollout   uint32
 
 	leakch chan struct{}
 	quitch chan struct{}
@@ -106,42 +335,343 @@ func NewChannel(config MiddlewareConfig) *Middleware {
 	})
 }
 
-func newMiddleware(config MiddlewareConfig, bucketFactory func(bucket bucket.Bucket) bucket.Bucket) *Middleware {
-	return &Middleware{
-		config: config,
-		bucket: bucketFactory(leaky.New(config.requestPerSecond)),
-		leakch: make(chan struct{}),
-		quitch: make(chan struct{}),
+// NewWithBucket creates a rate limiter middleware using a custom bucket.
+//
+// Every request is counted against the given bucket, which must be
+// thread-safe. The middleware leaks the bucket at the configured rate, and
+// starts and stops it, if it has Start() and Stop() methods.
+func NewWithBucket(config MiddlewareConfig, b bucket.Bucket) *Middleware {
+	return newMiddlewareWithBuckets(config, keyed.NewShared(b))
+}
+
+// NewWithBucketFactory creates a rate limiter middleware using custom buckets.
+//
+// The factory is called every time a bucket is needed for a new key. The
+// buckets must be thread-safe.
+func NewWithBucketFactory(config MiddlewareConfig, factory func(key string) bucket.Bucket) *Middleware {
+	return newMiddlewareWithBuckets(config, keyed.New(factory))
+}
+
+func newMiddlewareWithBuckets(config MiddlewareConfig, buckets bucketSet) *Middleware {
+	m := &Middleware{
+		config:  config,
+		buckets: buckets,
+		leakch:  make(chan struct{}),
+		quitch:  make(chan struct{}),
 	}
+	m.SetRollout(config.rollout)
+
+	if config.penalty.rejections > 0 && config.penalty.ban > 0 {
+		m.penalties = penalty.New(config.penalty.ban, config.penalty.maxBan)
+		m.penalties.SetStrikes(config.penalty.rejections, config.penalty.window)
+	}
+
+	if config.bypass.signer != nil && config.bypass.requestPerSecond > 0 {
+		bypassConfig := CreateMiddlewareConfig(config.bypass.requestPerSecond)
+		bypassConfig.SetRetryDelay(config.retryDelay, config.random)
+		bypassConfig.SetKeyFunc(config.keyFunc)
+		m.bypass = New(bypassConfig)
+	}
+
+	if config.shadow != nil {
+		m.shadow = New(*config.shadow)
+	}
+
+	config.snapshot.load(m)
+
+	return m
+}
+
+func newMiddleware(config MiddlewareConfig, bucketFactory func(bucket bucket.Bucket) bucket.Bucket) *Middleware {
+	return NewWithBucketFactory(config, func(key string) bucket.Bucket {
+		return bucketFactory(leaky.New(config.requestPerSecond))
+	})
 }
 
 // ServeHTTP implements negroni.Handler interface.
 //
 // If the rate limiter blocks the request, 429 Too Many Requests will be
 // returned with a Retry-After header, asking the client to retry the request
-// later.
+// later. Otherwise the Decision is attached to the request context, and the
+// next handler is called. The limit is published in the RateLimit-Policy and
+// RateLimit headers, unless it is not enforced for the request.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	if m.bucket.Input() {
+	m.serve(w, r, next)
+}
+
+// Handler wraps a http.Handler with the middleware.
+//
+// This makes the middleware usable without negroni, e.g. with plain net/http,
+// chi or gorilla/mux. It behaves the same way as ServeHTTP.
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.serve(w, r, next)
+	})
+}
+
+// Adapter returns the middleware in the func(http.Handler) http.Handler form,
+// which is used by most routers to register middlewares.
+func Adapter(m *Middleware) func(http.Handler) http.Handler {
+	return m.Handler
+}
+
+func (m *Middleware) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	key := m.config.key(r)
+	if m.config.access.denied(r, key) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if m.config.access.allowed(r, key) {
+		next.ServeHTTP(w, r.WithContext(WithDecision(r.Context(), m.exempt(key))))
+		return
+	}
+	if m.config.bypass.valid(r.Header.Get(m.config.bypass.header)) {
+		if m.bypass != nil {
+			m.bypass.serve(w, r, next)
+		} else {
+			next.ServeHTTP(w, r.WithContext(WithDecision(r.Context(), m.exempt(key))))
+		}
+		return
+	}
+
+	decision := m.decide(key, m.config.rolloutKey(r, key), m.config.cost(r))
+	if m.shadow != nil {
+		m.compare(decision, m.shadow.config.key(r), m.shadow.config.cost(r))
+	}
+	if !decision.DryRun {
+		setRateLimitHeaders(w.Header(), decision)
+	}
+	if decision.Rejected() {
+		reject(w, decision.RetryAfter)
+		return
+	}
+
+	r = r.WithContext(WithDecision(r.Context(), decision))
+	if m.config.chargeFunc == nil || !decision.Allowed {
 		next.ServeHTTP(w, r)
-	} else {
-		w.Header().Set("Retry-After", strconv.Itoa(int(m.config.delay())))
-		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	start := time.Now()
+	rw := &responseWriter{ResponseWriter: w}
+	next.ServeHTTP(rw, r)
+
+	m.settle(decision, m.config.chargeFunc(r, Outcome{
+		Cost:     decision.Cost,
+		Status:   rw.Status(),
+		Size:     rw.size,
+		Duration: time.Since(start),
+	}))
+}
+
+// exempt describes a request that bypasses the limiter.
+func (m *Middleware) exempt(key string) Decision {
+	return Decision{
+		Key:     key,
+		Policy:  m.config.policy(),
+		Allowed: true,
+		Exempt:  true,
 	}
 }
 
+// reject sends a 429 Too Many Requests response.
+func reject(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// settle charges or refunds the difference between the real cost of a
+// request and the cost in the decision.
+func (m *Middleware) settle(decision Decision, cost uint) {
+	if cost > decision.Cost {
+		m.Charge(decision.Key, cost-decision.Cost)
+	} else if cost < decision.Cost {
+		m.Refund(decision.Key, decision.Cost-cost)
+	}
+}
+
+// Charge fills the bucket of the given key with n units, regardless of the
+// decision.
+//
+// If the bucket does not have enough capacity, it is filled up completely.
+func (m *Middleware) Charge(key string, n uint) {
+	m.buckets.With(key, func(b bucket.Bucket) {
+		if bucket.InputN(b, n) {
+			return
+		}
+
+		for i := uint(0); i < n; i++ {
+			if !b.Input() {
+				return
+			}
+		}
+	})
+}
+
+// Reset drains the bucket of the given key completely.
+//
+// Buckets that do not implement bucket.Meter are leaked once.
+func (m *Middleware) Reset(key string) {
+	m.buckets.With(key, func(b bucket.Bucket) {
+		meter, ok := b.(bucket.Meter)
+		if !ok {
+			b.Leak()
+			return
+		}
+
+		level, _ := meter.Level()
+		refund(b, level)
+	})
+}
+
+// Refund gives back n units to the bucket of the given key.
+func (m *Middleware) Refund(key string, n uint) {
+	m.buckets.With(key, func(b bucket.Bucket) {
+		refund(b, n)
+	})
+}
+
+// refund gives back n units to the bucket, leaking it n times if it does not
+// implement refunder.
+func refund(b bucket.Bucket, n uint) {
+	if r, ok := b.(refunder); ok {
+		r.Refund(n)
+		return
+	}
+
+	for i := uint(0); i < n; i++ {
+		b.Leak()
+	}
+}
+
+// Check fills the bucket of the given key, and describes the outcome.
+//
+// Every key has its own bucket, which is created on first use. This is the
+// transport-independent part of the middleware, which can be used to apply
+// the same limits to other protocols.
+func (m *Middleware) Check(key string) Decision {
+	return m.CheckN(key, 1)
+}
+
+// CheckN fills the bucket of the given key with n units, and describes the
+// outcome.
+//
+// In dry-run mode the decision is not enforced, so use Decision.Rejected to
+// decide whether to reject the request.
+//
+// The shadow policy is evaluated with the same key and cost. The HTTP
+// middleware evaluates it with the key and cost functions of the candidate.
+func (m *Middleware) CheckN(key string, n uint) Decision {
+	decision := m.decide(key, key, n)
+	if m.shadow != nil {
+		m.compare(decision, key, n)
+	}
+
+	return decision
+}
+
+// decide checks the bucket, and applies the dry-run mode and the rollout.
+//
+// The rollout is decided by rolloutKey. Only the enforced rejections are
+// counted by the penalty.
+func (m *Middleware) decide(key, rolloutKey string, n uint) Decision {
+	decision := m.check(key, n)
+
+	if m.config.dryRun || !m.enforced(rolloutKey) {
+		decision.DryRun = true
+		if !decision.Allowed && m.config.dryRunFunc != nil {
+			m.config.dryRunFunc(decision)
+		}
+
+		return decision
+	}
+
+	if !decision.Allowed && !decision.Banned && m.penalties != nil {
+		if duration, banned := m.penalties.Strike(key); banned {
+			decision.Banned = true
+			decision.RetryAfter = duration
+		}
+	}
+
+	return decision
+}
+
+// compare evaluates the shadow policy, and reports it next to the active
+// decision.
+func (m *Middleware) compare(active Decision, key string, n uint) {
+	shadow := m.shadow.CheckN(key, n)
+	if m.config.shadowFunc != nil {
+		m.config.shadowFunc(active, shadow)
+	}
+}
+
+func (m *Middleware) check(key string, n uint) Decision {
+	decision := Decision{
+		Key:    key,
+		Policy: m.config.policy(),
+		Cost:   n,
+	}
+
+	if m.penalties != nil {
+		if remaining, banned := m.penalties.Banned(key); banned {
+			decision.Banned = true
+			decision.RetryAfter = remaining
+			return decision
+		}
+	}
+
+	m.buckets.With(key, func(b bucket.Bucket) {
+		decision.Allowed = bucket.InputN(b, n)
+
+		if meter, ok := b.(bucket.Meter); ok {
+			level, limit := meter.Level()
+			if level < limit {
+				decision.Remaining = limit - level
+			}
+			decision.limit = limit
+			decision.Reset = time.Duration(level) * m.config.leakInterval()
+		}
+	})
+
+	if !decision.Allowed {
+		decision.RetryAfter = time.Duration(m.config.delay()) * time.Second
+	}
+
+	return decision
+}
+
 // Start starts the middleware's "leak" logic.
 //
-// This will "drain" the bucket at the configured rate. Make sure you call this
+// This will "drain" the buckets at the configured rate. Make sure you call this
 // before you start the http server.
 func (m *Middleware) Start() {
-	if ss, ok := m.bucket.(startStop); ok {
-		go func() { ss.Start() }()
+	if m.bypass != nil {
+		go m.bypass.Start()
+	}
+	if m.shadow != nil {
+		go m.shadow.Start()
+	}
+
+	var cleanup <-chan time.Time
+	if m.penalties != nil {
+		ticker := time.NewTicker(m.config.penalty.ban)
+		defer ticker.Stop()
+		cleanup = ticker.C
+	}
+
+	var leak <-chan time.Time
+	if interval := m.config.leakInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		leak = ticker.C
 	}
 
 	for {
 		select {
-		case <-time.After(time.Second / time.Duration(m.config.requestPerSecond)):
-			m.bucket.Leak()
+		case <-leak:
+			m.buckets.Leak()
+		case <-cleanup:
+			m.penalties.Cleanup()
 		case <-m.quitch:
 			return
 		}
@@ -151,10 +681,16 @@ func (m *Middleware) Start() {
 // Stop stops the middleware's internal loop.
 //
 // After calling this function the middleware is not usable anymore. Make sure
-// you call this after the http server is stopped.
+// you call this after the http server is stopped. If a snapshot file is set,
+// the state of the buckets is written to it.
 func (m *Middleware) Stop() {
 	close(m.quitch)
-	if ss, ok := m.bucket.(startStop); ok {
-		ss.Stop()
+	m.config.snapshot.save(m)
+	m.buckets.Stop()
+	if m.bypass != nil {
+		m.bypass.Stop()
+	}
+	if m.shadow != nil {
+		m.shadow.Stop()
 	}
 }
@@ -25,6 +25,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/bucket"
 )
 
 func TestMiddleware(t *testing.T) {
@@ -94,3 +95,248 @@ func testRetryAfterHeader(mw *ratelimiter.Middleware) int {
 	}
 	return code
 }
+
+func TestHandler(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(1))
+
+	called := false
+	handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.True(t, called)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	called = false
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	resp := w.Result()
+	require.False(t, called)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("Retry-After"))
+}
+
+func TestAdapter(t *testing.T) {
+	mw := ratelimiter.NewChannel(ratelimiter.CreateMiddlewareConfig(10))
+	go mw.Start()
+	t.Cleanup(func() {
+		mw.Stop()
+	})
+
+	handler := ratelimiter.Adapter(mw)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i := 0; i < 10; i++ {
+		require.Equal(t, http.StatusOK, testHandlerResponseCode(handler))
+	}
+	require.Equal(t, http.StatusTooManyRequests, testHandlerResponseCode(handler))
+
+	// Make sure that enough time passes for a tick, even if the CPU is busy.
+	<-time.After(time.Second / 5)
+	require.Equal(t, http.StatusOK, testHandlerResponseCode(handler))
+}
+
+func testHandlerResponseCode(handler http.Handler) int {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	return w.Result().StatusCode
+}
+
+func TestCheck_Keys(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(1))
+
+	require.True(t, mw.Check("a").Allowed)
+	decision := mw.Check("a")
+	require.False(t, decision.Allowed)
+	require.Equal(t, "a", decision.Key)
+	require.NotZero(t, decision.RetryAfter)
+	require.True(t, mw.Check("b").Allowed)
+}
+
+// alternatingBucket is a custom bucket, which accepts every other request.
+type alternatingBucket struct {
+	inputs int
+}
+
+func (ab *alternatingBucket) Input() bool {
+	ab.inputs++
+	return ab.inputs%2 == 1
+}
+
+func (ab *alternatingBucket) Leak() {}
+
+func TestNewWithBucket(t *testing.T) {
+	mw := ratelimiter.NewWithBucket(ratelimiter.CreateMiddlewareConfig(1), bucket.NewMutex(&alternatingBucket{}))
+
+	require.True(t, mw.Check("a").Allowed)
+	require.False(t, mw.Check("b").Allowed)
+	require.True(t, mw.Check("c").Allowed)
+}
+
+func TestNewWithBucketFactory(t *testing.T) {
+	keys := []string{}
+	mw := ratelimiter.NewWithBucketFactory(ratelimiter.CreateMiddlewareConfig(1), func(key string) bucket.Bucket {
+		keys = append(keys, key)
+		return bucket.NewMutex(bucket.NewLeaky(2))
+	})
+
+	require.True(t, mw.Check("a").Allowed)
+	require.True(t, mw.Check("a").Allowed)
+	require.False(t, mw.Check("a").Allowed)
+	require.True(t, mw.Check("b").Allowed)
+	require.Equal(t, []string{"a", "b"}, keys)
+}
+
+func TestMiddleware_KeyFunc(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetKeyFunc(ratelimiter.HeaderKey("X-API-Key"))
+	mw := ratelimiter.New(config)
+
+	require.Equal(t, http.StatusOK, testKeyResponseCode(mw, "a"))
+	require.Equal(t, http.StatusTooManyRequests, testKeyResponseCode(mw, "a"))
+	require.Equal(t, http.StatusOK, testKeyResponseCode(mw, "b"))
+
+	mw.Reset("a")
+	require.Equal(t, http.StatusOK, testKeyResponseCode(mw, "a"))
+}
+
+func testKeyResponseCode(mw *ratelimiter.Middleware, key string) int {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-API-Key", key)
+	mw.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return w.Result().StatusCode
+}
+
+func TestMiddleware_Window(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(5)
+	(&config).SetWindow(15 * time.Minute)
+	mw := ratelimiter.New(config)
+
+	decision := mw.Check("")
+	require.Equal(t, "5;w=900", decision.Policy)
+	require.Equal(t, 3*time.Minute, decision.Reset)
+}
+
+func TestCombineKeys(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?user=alice", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	key := ratelimiter.CombineKeys(ratelimiter.FormValueKey("user"), ratelimiter.ClientIP)
+
+	require.Equal(t, "alice|192.0.2.1", key(r))
+}
+
+func TestMiddleware_DryRun(t *testing.T) {
+	var reported []ratelimiter.Decision
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetDryRun(true, func(decision ratelimiter.Decision) {
+		reported = append(reported, decision)
+	})
+	mw := ratelimiter.New(config)
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, testResponseCode(mw))
+	}
+
+	require.Len(t, reported, 2)
+	for _, decision := range reported {
+		require.False(t, decision.Allowed)
+		require.True(t, decision.DryRun)
+		require.False(t, decision.Rejected())
+	}
+}
+
+func TestMiddleware_DryRunCharge(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(2)
+	(&config).SetDryRun(true, nil)
+	(&config).SetChargeFunc(func(r *http.Request, outcome ratelimiter.Outcome) uint {
+		return 0
+	})
+	mw := ratelimiter.New(config)
+
+	mw.Charge("", 2)
+	require.Equal(t, http.StatusOK, testResponseCode(mw))
+
+	// The request over the limit did not fill the bucket, so it does not
+	// refund the units of the other requests.
+	decision := mw.Check("")
+	require.False(t, decision.Allowed)
+	require.Zero(t, decision.Remaining)
+}
+
+func TestMiddleware_Shadow(t *testing.T) {
+	var active, shadow []bool
+	config := ratelimiter.CreateMiddlewareConfig(3)
+	(&config).SetShadow(ratelimiter.CreateMiddlewareConfig(1), func(a, s ratelimiter.Decision) {
+		require.False(t, a.DryRun)
+		require.True(t, s.DryRun)
+		require.Equal(t, "1;w=1", s.Policy)
+		active = append(active, a.Allowed)
+		shadow = append(shadow, s.Allowed)
+	})
+	mw := ratelimiter.New(config)
+
+	for i := 0; i < 4; i++ {
+		testResponseCode(mw)
+	}
+
+	require.Equal(t, []bool{true, true, true, false}, active)
+	require.Equal(t, []bool{true, false, false, false}, shadow)
+}
+
+func TestMiddleware_ShadowKeyCost(t *testing.T) {
+	var shadow []ratelimiter.Decision
+	candidate := ratelimiter.CreateMiddlewareConfig(3)
+	(&candidate).SetKeyFunc(ratelimiter.FormValueKey("user"))
+	(&candidate).SetCostFunc(func(r *http.Request) uint {
+		return 2
+	})
+	config := ratelimiter.CreateMiddlewareConfig(10)
+	(&config).SetShadow(candidate, func(a, s ratelimiter.Decision) {
+		shadow = append(shadow, s)
+	})
+	mw := ratelimiter.New(config)
+
+	for _, user := range []string{"alice", "alice", "bob"} {
+		w := httptest.NewRecorder()
+		mw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?user="+user, nil), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	require.Len(t, shadow, 3)
+	require.Equal(t, "alice", shadow[0].Key)
+	require.Equal(t, uint(2), shadow[0].Cost)
+	require.True(t, shadow[0].Allowed)
+	require.False(t, shadow[1].Allowed)
+	require.Equal(t, "bob", shadow[2].Key)
+	require.True(t, shadow[2].Allowed)
+}
+
+func TestMiddleware_RateLimitHeaders(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(10))
+	w := httptest.NewRecorder()
+	mw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	require.Equal(t, "10;w=1", w.Header().Get("RateLimit-Policy"))
+	require.Equal(t, "limit=10, remaining=9, reset=1", w.Header().Get("RateLimit"))
+
+	config := ratelimiter.CreateMiddlewareConfig(10)
+	(&config).SetDryRun(true, nil)
+	w = httptest.NewRecorder()
+	ratelimiter.New(config).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	require.Empty(t, w.Header().Get("RateLimit-Policy"))
+	require.Empty(t, w.Header().Get("RateLimit"))
+}
@@ -0,0 +1,60 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// SetRollout changes the percentage of the keys the limit is enforced for.
+//
+// The keys are selected with a stable hash, so a key stays enforced while the
+// percentage is raised. The requests of the other keys are evaluated in
+// dry-run mode, and the would-be rejections are passed to the DecisionFunc
+// of MiddlewareConfig.SetDryRun. The percentage can be changed while the
+// middleware is running, and it is capped at 100.
+func (m *Middleware) SetRollout(percent uint) {
+	if percent > 100 {
+		percent = 100
+	}
+
+	atomic.StoreUint32(&m.rollout, uint32(percent))
+}
+
+// Rollout returns the percentage of the keys the limit is enforced for.
+func (m *Middleware) Rollout() uint {
+	return uint(atomic.LoadUint32(&m.rollout))
+}
+
+// enforced reports whether the limit is enforced for the rollout key.
+func (m *Middleware) enforced(key string) bool {
+	rollout := atomic.LoadUint32(&m.rollout)
+	if rollout >= 100 {
+		return true
+	}
+
+	return rolloutBucket(key) < rollout
+}
+
+// rolloutBucket maps the key to a number between 0 and 99.
+func rolloutBucket(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return h.Sum32() % 100
+}
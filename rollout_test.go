@@ -0,0 +1,112 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func testEnforcedKeys(mw *ratelimiter.Middleware, keys int) map[string]bool {
+	enforced := make(map[string]bool)
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		mw.Check(key)
+		if mw.Check(key).Rejected() {
+			enforced[key] = true
+		}
+	}
+
+	return enforced
+}
+
+func TestMiddleware_Rollout(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetRollout(0)
+	mw := ratelimiter.New(config)
+	require.Equal(t, uint(0), mw.Rollout())
+	require.Empty(t, testEnforcedKeys(mw, 1000))
+
+	mw.SetRollout(10)
+	ten := testEnforcedKeys(mw, 1000)
+	require.InDelta(t, 100, len(ten), 50)
+
+	mw.SetRollout(50)
+	fifty := testEnforcedKeys(mw, 1000)
+	require.InDelta(t, 500, len(fifty), 100)
+	for key := range ten {
+		require.True(t, fifty[key], key)
+	}
+
+	mw.SetRollout(200)
+	require.Equal(t, uint(100), mw.Rollout())
+	require.Len(t, testEnforcedKeys(mw, 1000), 1000)
+}
+
+func TestMiddleware_RolloutDecision(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetRollout(0)
+	mw := ratelimiter.New(config)
+
+	mw.Check("a")
+	decision := mw.Check("a")
+	require.False(t, decision.Allowed)
+	require.True(t, decision.DryRun)
+}
+
+func testRolloutCode(mw *ratelimiter.Middleware, key, tenant string) int {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Key", key)
+	r.Header.Set("X-Tenant", tenant)
+	mw.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {})
+
+	return w.Code
+}
+
+func TestMiddleware_RolloutKeyFunc(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(1)
+	(&config).SetKeyFunc(ratelimiter.HeaderKey("X-Key"))
+	(&config).SetRolloutKeyFunc(ratelimiter.HeaderKey("X-Tenant"))
+	(&config).SetRollout(50)
+	mw := ratelimiter.New(config)
+
+	enforced := 0
+	for i := 0; i < 100; i++ {
+		tenant := strconv.Itoa(i)
+		rejected := 0
+		for j := 0; j < 10; j++ {
+			key := tenant + "-" + strconv.Itoa(j)
+			testRolloutCode(mw, key, tenant)
+			if testRolloutCode(mw, key, tenant) == http.StatusTooManyRequests {
+				rejected++
+			}
+		}
+
+		// Every key of a tenant is either enforced or not.
+		require.Contains(t, []int{0, 10}, rejected, tenant)
+		if rejected > 0 {
+			enforced++
+		}
+	}
+	require.InDelta(t, 50, enforced, 25)
+}
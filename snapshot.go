@@ -0,0 +1,214 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/tamasd/ratelimiter/bucket"
+)
+
+// SnapshotVersion is the version of the snapshot format written by the
+// middleware.
+const SnapshotVersion = 1
+
+var (
+	// ErrSnapshotVersion is returned when restoring a snapshot with an
+	// unknown version.
+	ErrSnapshotVersion = errors.New("ratelimiter: unsupported snapshot version")
+
+	// ErrSnapshotPolicy is returned when restoring a snapshot that was taken
+	// with a different policy.
+	ErrSnapshotPolicy = errors.New("ratelimiter: snapshot policy does not match")
+)
+
+// Snapshot is the state of the buckets of a middleware at a given time.
+type Snapshot struct {
+	// Version is the version of the snapshot format.
+	Version int `json:"version"`
+
+	// Taken is the time the snapshot was taken.
+	Taken time.Time `json:"taken"`
+
+	// Policy is the policy of the middleware, in the format of
+	// Decision.Policy.
+	Policy string `json:"policy"`
+
+	// Buckets are the non-empty buckets, sorted by key.
+	Buckets []BucketSnapshot `json:"buckets"`
+}
+
+// BucketSnapshot is the state of a bucket.
+type BucketSnapshot struct {
+	Key   string `json:"key"`
+	Level uint   `json:"level"`
+}
+
+// Snapshot returns the levels of the non-empty buckets.
+//
+// Only buckets implementing bucket.Meter are included. Buckets that keep their
+// state outside of the process, see bucket.Persistent, are left out, because
+// restoring them would count their units twice.
+func (m *Middleware) Snapshot() Snapshot {
+	snapshot := Snapshot{
+		Version: SnapshotVersion,
+		Taken:   time.Now(),
+		Policy:  m.config.policy(),
+		Buckets: []BucketSnapshot{},
+	}
+
+	m.buckets.Range(func(key string, b bucket.Bucket) {
+		if p, ok := b.(bucket.Persistent); ok && p.Persistent() {
+			return
+		}
+		if meter, ok := b.(bucket.Meter); ok {
+			if level, _ := meter.Level(); level > 0 {
+				snapshot.Buckets = append(snapshot.Buckets, BucketSnapshot{
+					Key:   key,
+					Level: level,
+				})
+			}
+		}
+	})
+
+	sort.Slice(snapshot.Buckets, func(i, j int) bool {
+		return snapshot.Buckets[i].Key < snapshot.Buckets[j].Key
+	})
+
+	return snapshot
+}
+
+// Restore fills the buckets to the levels of the snapshot.
+//
+// The levels are lowered by the units that would have leaked since the
+// snapshot was taken, so the downtime between a Stop() and a restart is
+// accounted for.
+//
+// The levels of a snapshot are only meaningful under the same policy, so a
+// snapshot taken with a different policy is rejected.
+func (m *Middleware) Restore(snapshot Snapshot) error {
+	if snapshot.Version != SnapshotVersion {
+		return fmt.Errorf("%w: %d", ErrSnapshotVersion, snapshot.Version)
+	}
+	if policy := m.config.policy(); snapshot.Policy != policy {
+		return fmt.Errorf("%w: %q instead of %q", ErrSnapshotPolicy, snapshot.Policy, policy)
+	}
+
+	var leaked uint
+	if interval := m.config.leakInterval(); interval > 0 {
+		if downtime := time.Since(snapshot.Taken); downtime > 0 {
+			leaked = uint(downtime / interval)
+		}
+	}
+
+	for _, b := range snapshot.Buckets {
+		if b.Level > leaked {
+			m.Charge(b.Key, b.Level-leaked)
+		}
+	}
+
+	return nil
+}
+
+// WriteSnapshot writes the snapshot of the buckets as JSON.
+func (m *Middleware) WriteSnapshot(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m.Snapshot())
+}
+
+// ReadSnapshot reads a JSON snapshot, and restores it.
+func (m *Middleware) ReadSnapshot(r io.Reader) error {
+	var snapshot Snapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	return m.Restore(snapshot)
+}
+
+// SaveSnapshot writes the snapshot of the buckets to a file.
+//
+// The snapshot is written to a temporary file first, which is renamed to the
+// given path, so a crash does not leave a partial snapshot behind.
+func (m *Middleware) SaveSnapshot(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	err = m.WriteSnapshot(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+
+	return err
+}
+
+// LoadSnapshot restores the snapshot from a file.
+func (m *Middleware) LoadSnapshot(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return m.ReadSnapshot(file)
+}
+
+// snapshotConfig holds the snapshot file settings of the middleware.
+type snapshotConfig struct {
+	path      string
+	errorFunc func(err error)
+}
+
+// load restores the snapshot file, if it exists.
+func (sc snapshotConfig) load(m *Middleware) {
+	if sc.path == "" {
+		return
+	}
+
+	if err := m.LoadSnapshot(sc.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		sc.report(err)
+	}
+}
+
+// save writes the snapshot file.
+func (sc snapshotConfig) save(m *Middleware) {
+	if sc.path == "" {
+		return
+	}
+
+	sc.report(m.SaveSnapshot(sc.path))
+}
+
+func (sc snapshotConfig) report(err error) {
+	if err != nil && sc.errorFunc != nil {
+		sc.errorFunc(err)
+	}
+}
@@ -0,0 +1,151 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+	"github.com/tamasd/ratelimiter/bucket"
+)
+
+func TestMiddleware_Snapshot(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(5))
+	mw.CheckN("b", 2)
+	mw.CheckN("a", 3)
+
+	snapshot := mw.Snapshot()
+	require.Equal(t, ratelimiter.SnapshotVersion, snapshot.Version)
+	require.Equal(t, "5;w=1", snapshot.Policy)
+	require.Equal(t, []ratelimiter.BucketSnapshot{
+		{Key: "a", Level: 3},
+		{Key: "b", Level: 2},
+	}, snapshot.Buckets)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, mw.WriteSnapshot(buf))
+
+	restored := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(5))
+	require.NoError(t, restored.ReadSnapshot(buf))
+	require.Equal(t, snapshot.Buckets, restored.Snapshot().Buckets)
+	require.Equal(t, uint(1), restored.Check("a").Remaining)
+}
+
+func TestMiddleware_Restore_Downtime(t *testing.T) {
+	config := ratelimiter.CreateMiddlewareConfig(10)
+	(&config).SetWindow(10 * time.Second)
+	mw := ratelimiter.New(config)
+
+	require.NoError(t, mw.Restore(ratelimiter.Snapshot{
+		Version: ratelimiter.SnapshotVersion,
+		Taken:   time.Now().Add(-3 * time.Second),
+		Policy:  mw.Snapshot().Policy,
+		Buckets: []ratelimiter.BucketSnapshot{
+			{Key: "a", Level: 10},
+			{Key: "b", Level: 2},
+		},
+	}))
+
+	require.Equal(t, []ratelimiter.BucketSnapshot{
+		{Key: "a", Level: 7},
+	}, mw.Snapshot().Buckets)
+}
+
+func TestMiddleware_Restore_Version(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(1))
+
+	err := mw.Restore(ratelimiter.Snapshot{Version: 2})
+	require.True(t, errors.Is(err, ratelimiter.ErrSnapshotVersion))
+}
+
+func TestMiddleware_Restore_Policy(t *testing.T) {
+	mw := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(5))
+	mw.CheckN("a", 3)
+	snapshot := mw.Snapshot()
+
+	restored := ratelimiter.New(ratelimiter.CreateMiddlewareConfig(10))
+	err := restored.Restore(snapshot)
+	require.True(t, errors.Is(err, ratelimiter.ErrSnapshotPolicy))
+	require.Empty(t, restored.Snapshot().Buckets)
+}
+
+// persistentBucket is a bucket that keeps its state outside of the process.
+type persistentBucket struct {
+	*bucket.Leaky
+}
+
+func (persistentBucket) Persistent() bool {
+	return true
+}
+
+func TestMiddleware_Snapshot_Persistent(t *testing.T) {
+	mw := ratelimiter.NewWithBucketFactory(ratelimiter.CreateMiddlewareConfig(3), func(key string) bucket.Bucket {
+		if key == "shared" {
+			return persistentBucket{bucket.NewLeaky(3)}
+		}
+		return bucket.NewLeaky(3)
+	})
+	mw.Check("shared")
+	mw.Check("local")
+
+	require.Equal(t, []ratelimiter.BucketSnapshot{
+		{Key: "local", Level: 1},
+	}, mw.Snapshot().Buckets)
+}
+
+func TestMiddleware_Snapshot_Shared(t *testing.T) {
+	mw := ratelimiter.NewWithBucket(ratelimiter.CreateMiddlewareConfig(3), bucket.NewMutex(bucket.NewLeaky(3)))
+	mw.Check("a")
+	mw.Check("b")
+
+	require.Equal(t, []ratelimiter.BucketSnapshot{
+		{Key: "", Level: 2},
+	}, mw.Snapshot().Buckets)
+}
+
+func TestMiddleware_SnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	var errs []error
+	config := ratelimiter.CreateMiddlewareConfig(2)
+	(&config).SetWindow(time.Hour)
+	(&config).SetSnapshotFile(path, func(err error) {
+		errs = append(errs, err)
+	})
+
+	mw := ratelimiter.New(config)
+	require.True(t, mw.CheckN("a", 2).Allowed)
+	mw.Stop()
+
+	_, err := os.Stat(path)
+	require.NoError(t, err)
+
+	mw = ratelimiter.New(config)
+	defer mw.Stop()
+	require.False(t, mw.Check("a").Allowed)
+	require.True(t, mw.Check("b").Allowed)
+	require.Empty(t, errs)
+
+	require.NoError(t, os.WriteFile(path, []byte("invalid"), 0o600))
+	ratelimiter.New(config)
+	require.Len(t, errs, 1)
+}
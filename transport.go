@@ -0,0 +1,233 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tamasd/ratelimiter/internal/bucket/leaky"
+	"github.com/tamasd/ratelimiter/internal/bucket/timed"
+)
+
+// TransportConfig holds the configuration for the Transport type.
+type TransportConfig struct {
+	requestPerSecond uint
+	failFast         bool
+	adaptive         bool
+}
+
+// CreateTransportConfig creates the configuration for the transport.
+//
+// The only parameter is requestPerSecond, which tells the transport how many
+// requests per second it can send to a single host. Zero turns off the pacing,
+// the transport only holds back the requests when the hosts ask for it with
+// their Retry-After and RateLimit headers, or publish their limits in adaptive
+// mode.
+func CreateTransportConfig(requestPerSecond uint) TransportConfig {
+	return TransportConfig{
+		requestPerSecond: requestPerSecond,
+	}
+}
+
+// SetFailFast sets what happens with requests over the limit.
+//
+// By default the transport blocks until the request can be sent, or the
+// context of the request is done. In fail fast mode ErrRateLimited is
+// returned instead.
+func (tc *TransportConfig) SetFailFast(failFast bool) {
+	tc.failFast = failFast
+}
+
+// SetAdaptive turns on learning the limits of the servers.
+//
+// In adaptive mode the transport reads the RateLimit-Policy, RateLimit and
+// X-RateLimit-* headers of the responses, and tunes the pacing of the host to
+// stay under its published limits. The configured requests per second value
+// is only used until the first response arrives with such headers.
+func (tc *TransportConfig) SetAdaptive(adaptive bool) {
+	tc.adaptive = adaptive
+}
+
+func (tc TransportConfig) leakInterval() time.Duration {
+	if tc.requestPerSecond == 0 {
+		return 0
+	}
+
+	return time.Second / time.Duration(tc.requestPerSecond)
+}
+
+// Transport is a rate limited http.RoundTripper.
+//
+// The transport paces the outgoing requests separately for every host. When a
+// host answers with 429 Too Many Requests or 503 Service Unavailable and a
+// Retry-After header, or with a RateLimit header without any remaining
+// requests, no requests are sent to the host until the delay is over.
+type Transport struct {
+	config TransportConfig
+	base   http.RoundTripper
+
+	mtx   sync.Mutex
+	hosts map[string]*transportHost
+}
+
+type transportHost struct {
+	bucket *timed.Bucket
+
+	mtx          sync.Mutex
+	blockedUntil time.Time
+
+	// limit is the burst of the host: the configured requests per second,
+	// or the burst of the RateLimit-Policy header of the host.
+	limit uint
+}
+
+// NewTransport creates a rate limited transport.
+//
+// The base transport sends the requests. If it is nil, http.DefaultTransport
+// is used.
+func NewTransport(config TransportConfig, base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Transport{
+		config: config,
+		base:   base,
+		hosts:  make(map[string]*transportHost),
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := t.host(req.URL.Host)
+	if err := t.wait(req.Context(), host); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if t.config.adaptive {
+		host.adapt(resp, now)
+	}
+	if delay, ok := backoffDelay(resp, now); ok {
+		host.block(delay)
+	}
+
+	return resp, nil
+}
+
+func (t *Transport) host(name string) *transportHost {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	host, ok := t.hosts[name]
+	if !ok {
+		host = &transportHost{
+			bucket: timed.New(leaky.New(t.config.requestPerSecond), t.config.leakInterval()),
+			limit:  t.config.requestPerSecond,
+		}
+		t.hosts[name] = host
+	}
+
+	return host
+}
+
+// wait blocks until the request can be sent to the host.
+func (t *Transport) wait(ctx context.Context, host *transportHost) error {
+	for {
+		delay := host.blocked()
+		if delay <= 0 {
+			if host.bucket.Interval() <= 0 || host.bucket.Input() {
+				return nil
+			}
+			delay = host.bucket.Delay()
+		}
+
+		if t.config.failFast {
+			return ErrRateLimited
+		}
+
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// adapt tunes the pacing to the limits published by the server.
+//
+// A RateLimit-Policy header sets both the burst and the pace. Otherwise the
+// remaining requests are spread evenly until the limit of the server resets,
+// and the burst is capped to the remaining requests.
+func (h *transportHost) adapt(resp *http.Response, now time.Time) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if burst, interval, ok := rateLimitPolicy(resp.Header); ok {
+		h.limit = uint(burst)
+		h.bucket.SetLimit(h.limit)
+		h.bucket.SetInterval(interval)
+		return
+	}
+
+	fields := rateLimitFields(resp.Header, now)
+	remaining := fields["remaining"]
+	reset := fields["reset"]
+	if remaining > 0 && reset > 0 {
+		limit := h.limit
+		if limit == 0 || uint64(limit) > remaining {
+			limit = uint(remaining)
+		}
+		h.bucket.SetLimit(limit)
+		h.bucket.SetInterval(time.Duration(reset) * time.Second / time.Duration(remaining))
+	}
+}
+
+func (h *transportHost) block(delay time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if until := time.Now().Add(delay); until.After(h.blockedUntil) {
+		h.blockedUntil = until
+	}
+}
+
+func (h *transportHost) blocked() time.Duration {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return time.Until(h.blockedUntil)
+}
+
+// sleep waits for the given duration, or until the context is done.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
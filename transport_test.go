@@ -0,0 +1,283 @@
+// A simple rate limiter middleware.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimiter_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/ratelimiter"
+)
+
+func createTransportClient(requestPerSecond uint, failFast bool) *http.Client {
+	return createAdaptiveTransportClient(requestPerSecond, failFast, false)
+}
+
+func createAdaptiveTransportClient(requestPerSecond uint, failFast, adaptive bool) *http.Client {
+	config := ratelimiter.CreateTransportConfig(requestPerSecond)
+	(&config).SetFailFast(failFast)
+	(&config).SetAdaptive(adaptive)
+
+	return &http.Client{
+		Transport: ratelimiter.NewTransport(config, nil),
+	}
+}
+
+func createLimitedServer(t *testing.T, requestPerSecond uint) *httptest.Server {
+	config := ratelimiter.CreateMiddlewareConfig(requestPerSecond)
+	(&config).SetRetryDelay(1, 1)
+	mw := ratelimiter.New(config)
+
+	server := httptest.NewServer(mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func testGet(client *http.Client, url string) (int, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+func TestTransport_FailFast(t *testing.T) {
+	server := createLimitedServer(t, 100)
+	client := createTransportClient(2, true)
+
+	for i := 0; i < 2; i++ {
+		code, err := testGet(client, server.URL)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	_, err := testGet(client, server.URL)
+	require.True(t, errors.Is(err, ratelimiter.ErrRateLimited))
+}
+
+func TestTransport_Blocks(t *testing.T) {
+	server := createLimitedServer(t, 100)
+	client := createTransportClient(10, false)
+
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		code, err := testGet(client, server.URL)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	require.True(t, time.Since(start) >= time.Second/20)
+}
+
+func TestTransport_Blocks_Context(t *testing.T) {
+	server := createLimitedServer(t, 100)
+	client := createTransportClient(1, false)
+
+	_, err := testGet(client, server.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	_, err = client.Do(req)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestTransport_Unpaced(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	client := createTransportClient(0, true)
+
+	for i := 0; i < 10; i++ {
+		code, err := testGet(client, server.URL)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, code)
+	}
+}
+
+func TestTransport_Unpaced_Adaptive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit", "limit=10, remaining=1, reset=60")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	client := createAdaptiveTransportClient(0, true, true)
+
+	_, err := testGet(client, server.URL)
+	require.NoError(t, err)
+	_, err = testGet(client, server.URL)
+	require.NoError(t, err)
+
+	// The server allows a request every minute from now on.
+	_, err = testGet(client, server.URL)
+	require.True(t, errors.Is(err, ratelimiter.ErrRateLimited))
+}
+
+func TestTransport_RetryAfter(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) > 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	client := createTransportClient(100, true)
+
+	code, err := testGet(client, server.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, code)
+
+	code, err = testGet(client, server.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, code)
+
+	_, err = testGet(client, server.URL)
+	require.True(t, errors.Is(err, ratelimiter.ErrRateLimited))
+}
+
+func TestTransport_Middleware(t *testing.T) {
+	server := createLimitedServer(t, 1)
+	client := createTransportClient(100, true)
+
+	code, err := testGet(client, server.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, code)
+
+	// The middleware publishes that no requests remain, so the transport
+	// does not send the next request.
+	_, err = testGet(client, server.URL)
+	require.True(t, errors.Is(err, ratelimiter.ErrRateLimited))
+}
+
+func TestTransport_RetryAfter_Date(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+	client := createTransportClient(100, true)
+
+	code, err := testGet(client, server.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+
+	_, err = testGet(client, server.URL)
+	require.True(t, errors.Is(err, ratelimiter.ErrRateLimited))
+}
+
+func TestTransport_RateLimitHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit", "limit=1, remaining=0, reset=60")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	client := createTransportClient(100, true)
+
+	code, err := testGet(client, server.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, code)
+
+	_, err = testGet(client, server.URL)
+	require.True(t, errors.Is(err, ratelimiter.ErrRateLimited))
+}
+
+func TestTransport_XRateLimitHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "10")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	client := createTransportClient(100, true)
+
+	_, err := testGet(client, server.URL)
+	require.NoError(t, err)
+
+	_, err = testGet(client, server.URL)
+	require.True(t, errors.Is(err, ratelimiter.ErrRateLimited))
+}
+
+func TestTransport_Adaptive_Policy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Policy", "1;w=60, 100;w=3600")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	client := createAdaptiveTransportClient(100, true, false)
+	for i := 0; i < 2; i++ {
+		_, err := testGet(client, server.URL)
+		require.NoError(t, err)
+	}
+
+	client = createAdaptiveTransportClient(100, true, true)
+	_, err := testGet(client, server.URL)
+	require.NoError(t, err)
+	_, err = testGet(client, server.URL)
+	require.True(t, errors.Is(err, ratelimiter.ErrRateLimited))
+}
+
+func TestTransport_Adaptive_RemainingBurst(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit", "limit=1000, remaining=1, reset=1")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	client := createAdaptiveTransportClient(10, true, true)
+
+	_, err := testGet(client, server.URL)
+	require.NoError(t, err)
+
+	// The configured burst of 10 is capped to the single remaining request.
+	_, err = testGet(client, server.URL)
+	require.True(t, errors.Is(err, ratelimiter.ErrRateLimited))
+}
+
+func TestTransport_Adaptive_Remaining(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit", "limit=1000, remaining=100, reset=1")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	client := createAdaptiveTransportClient(1, true, true)
+
+	_, err := testGet(client, server.URL)
+	require.NoError(t, err)
+
+	// The server allows a request every 10 ms, instead of the configured 1 s.
+	<-time.After(time.Millisecond * 50)
+	_, err = testGet(client, server.URL)
+	require.NoError(t, err)
+}